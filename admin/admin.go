@@ -0,0 +1,180 @@
+// Package admin serves the state of the plugin and a few operator actions
+// over HTTP on a unix socket. The socket is only accessible by root.
+//
+//	GET  /networks                               the networks and their endpoints
+//	GET  /endpoints                              the endpoints of all the networks
+//	GET  /nics?state=idle                        the attached nics, optionally by state
+//	GET  /errors?n=20                            the last errors of the qingcloud API
+//	GET  /sticky                                 the sticky bindings
+//	POST /endpoints/release?network=&endpoint=   force release an endpoint
+//	POST /nics/detach?nic=                       detach an idle nic
+//	POST /reconcile?dry_run=true                 reconcile the nics
+//	POST /gc                                     remove expired reservations and reconcile
+//	POST /sticky/remove?id=                      remove a sticky binding
+//
+// Errors are returned as {"Err": "..."} like the plugin API.
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/nicescale/qingcloud-docker-network/cloud"
+	"github.com/nicescale/qingcloud-docker-network/drivers/network"
+	"github.com/nicescale/qingcloud-docker-network/util"
+)
+
+type server struct {
+	nd   network.Admin
+	errs *cloud.ErrorLog
+}
+
+// Handler returns the handler of the admin API.
+func Handler(nd network.Admin, errs *cloud.ErrorLog) http.Handler {
+	s := &server{nd: nd, errs: errs}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/networks", s.method("GET", s.networks))
+	mux.HandleFunc("/endpoints", s.method("GET", s.endpoints))
+	mux.HandleFunc("/nics", s.method("GET", s.nics))
+	mux.HandleFunc("/errors", s.method("GET", s.errors))
+	mux.HandleFunc("/sticky", s.method("GET", s.sticky))
+	mux.HandleFunc("/endpoints/release", s.method("POST", s.release))
+	mux.HandleFunc("/nics/detach", s.method("POST", s.detach))
+	mux.HandleFunc("/reconcile", s.method("POST", s.reconcile))
+	mux.HandleFunc("/gc", s.method("POST", s.gc))
+	mux.HandleFunc("/sticky/remove", s.method("POST", s.unbind))
+	return mux
+}
+
+// Serve serves the admin API on the unix socket at path. A stale socket
+// left by a previous run is removed.
+func Serve(path string, h http.Handler) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		l.Close()
+		return err
+	}
+	return http.Serve(l, h)
+}
+
+type errorResponse struct {
+	Err string
+}
+
+func (s *server) method(m string, h func(r *http.Request) (interface{}, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method != m {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			json.NewEncoder(w).Encode(errorResponse{Err: fmt.Sprintf("method %s not allowed", r.Method)})
+			return
+		}
+		v, err := h(r)
+		if err != nil {
+			logrus.WithField("path", r.URL.Path).Errorf("Admin API: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			v = errorResponse{Err: err.Error()}
+		}
+		json.NewEncoder(w).Encode(v)
+	}
+}
+
+func (s *server) networks(r *http.Request) (interface{}, error) {
+	return s.nd.Networks(), nil
+}
+
+func (s *server) endpoints(r *http.Request) (interface{}, error) {
+	eps := []*network.EndpointInfo{}
+	for _, n := range s.nd.Networks() {
+		eps = append(eps, n.Endpoints...)
+	}
+	return eps, nil
+}
+
+func (s *server) nics(r *http.Request) (interface{}, error) {
+	nics, err := s.nd.Reconcile(true)
+	if err != nil {
+		return nil, err
+	}
+	state := r.URL.Query().Get("state")
+	vxnet := r.URL.Query().Get("vxnet")
+	result := []*network.NicStatus{}
+	for _, nic := range nics {
+		if (state == "" || nic.State == state) && (vxnet == "" || nic.Vxnet == vxnet) {
+			result = append(result, nic)
+		}
+	}
+	return result, nil
+}
+
+func (s *server) errors(r *http.Request) (interface{}, error) {
+	errs := s.errs.Errors()
+	if q := r.URL.Query().Get("n"); q != "" {
+		n, err := strconv.Atoi(q)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid n %q", q)
+		}
+		if n < len(errs) {
+			errs = errs[len(errs)-n:]
+		}
+	}
+	return errs, nil
+}
+
+func (s *server) release(r *http.Request) (interface{}, error) {
+	nid, epid := r.URL.Query().Get("network"), r.URL.Query().Get("endpoint")
+	if nid == "" || epid == "" {
+		return nil, fmt.Errorf("network and endpoint are required")
+	}
+	return struct{}{}, s.nd.ForceRelease(nid, epid)
+}
+
+func (s *server) detach(r *http.Request) (interface{}, error) {
+	nic := r.URL.Query().Get("nic")
+	if nic == "" {
+		return nil, fmt.Errorf("nic is required")
+	}
+	return struct{}{}, s.nd.DetachIdleNic(nic)
+}
+
+func (s *server) reconcile(r *http.Request) (interface{}, error) {
+	dryRun := false
+	if q := r.URL.Query().Get("dry_run"); q != "" {
+		var err error
+		if dryRun, err = strconv.ParseBool(q); err != nil {
+			return nil, fmt.Errorf("invalid dry_run %q", q)
+		}
+	}
+	return s.nd.Reconcile(dryRun)
+}
+
+func (s *server) gc(r *http.Request) (interface{}, error) {
+	return s.nd.GC()
+}
+
+func (s *server) sticky(r *http.Request) (interface{}, error) {
+	bs, err := s.nd.StickyBindings()
+	if bs == nil {
+		bs = []*util.StickyBinding{}
+	}
+	return bs, err
+}
+
+func (s *server) unbind(r *http.Request) (interface{}, error) {
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		return nil, fmt.Errorf("id is required")
+	}
+	return struct{}{}, s.nd.Unbind(id)
+}
@@ -0,0 +1,108 @@
+package admin
+
+import (
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nicescale/qingcloud-docker-network/cloud"
+	"github.com/nicescale/qingcloud-docker-network/drivers/network"
+)
+
+// stubAdmin is a network.Admin with canned state that counts the
+// reconciles.
+type stubAdmin struct {
+	network.Admin
+	networks   []*network.NetworkInfo
+	nics       []*network.NicStatus
+	reconciles []bool
+}
+
+func (s *stubAdmin) Networks() []*network.NetworkInfo { return s.networks }
+
+func (s *stubAdmin) Reconcile(dryRun bool) ([]*network.NicStatus, error) {
+	s.reconciles = append(s.reconciles, dryRun)
+	return s.nics, nil
+}
+
+// serve serves the admin API of nd on a socket in a temporary dir and
+// returns a client of it.
+func serve(t *testing.T, nd network.Admin) (*Client, func()) {
+	dir, err := ioutil.TempDir("", "admin-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sock := filepath.Join(dir, "admin.sock")
+	go Serve(sock, Handler(nd, cloud.NewErrorLog(10)))
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		client, err := Dial(sock)
+		if err == nil {
+			return client, func() { os.RemoveAll(dir) }
+		}
+		if time.Now().After(deadline) {
+			os.RemoveAll(dir)
+			t.Fatalf("admin API not served: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestNics(t *testing.T) {
+	nd := &stubAdmin{
+		networks: []*network.NetworkInfo{{ID: "net-1"}},
+		nics: []*network.NicStatus{
+			{NicID: "52:54:00:00:00:01", Vxnet: "vxnet-a", State: "idle"},
+			{NicID: "52:54:00:00:00:02", Vxnet: "vxnet-a", State: "in-use"},
+			{NicID: "52:54:00:00:00:03", Vxnet: "vxnet-b", State: "idle"},
+		},
+	}
+	client, done := serve(t, nd)
+	defer done()
+
+	tests := []struct {
+		query url.Values
+		want  []string
+	}{
+		{want: []string{"52:54:00:00:00:01", "52:54:00:00:00:02", "52:54:00:00:00:03"}},
+		{query: url.Values{"state": {"idle"}}, want: []string{"52:54:00:00:00:01", "52:54:00:00:00:03"}},
+		{query: url.Values{"vxnet": {"vxnet-a"}, "state": {"idle"}}, want: []string{"52:54:00:00:00:01"}},
+	}
+	for _, tt := range tests {
+		var nics []*network.NicStatus
+		if err := client.Call("GET", "/nics", tt.query, &nics); err != nil {
+			t.Fatalf("GET /nics?%s: %v", tt.query.Encode(), err)
+		}
+		var got []string
+		for _, nic := range nics {
+			got = append(got, nic.NicID)
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("GET /nics?%s = %v, want %v", tt.query.Encode(), got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("GET /nics?%s = %v, want %v", tt.query.Encode(), got, tt.want)
+				break
+			}
+		}
+	}
+	for _, dryRun := range nd.reconciles {
+		if !dryRun {
+			t.Error("GET /nics changed the nics")
+		}
+	}
+
+	var networks []*network.NetworkInfo
+	if err := client.Call("GET", "/networks", nil, &networks); err != nil {
+		t.Fatalf("GET /networks: %v", err)
+	}
+	if len(networks) != 1 || networks[0].ID != "net-1" {
+		t.Errorf("GET /networks = %+v, want net-1", networks)
+	}
+}
@@ -0,0 +1,36 @@
+// Package cloud defines the qingcloud API used by the drivers so that
+// the real API can be replaced, e.g. by the fake in package fake.
+package cloud
+
+import (
+	"github.com/nicescale/qcsdk"
+	sdktypes "github.com/nicescale/qcsdk/types"
+)
+
+// API is the subset of the qingcloud API used by the drivers.
+// The methods behave like those of *qcsdk.Api.
+type API interface {
+	DescribeNics(filters ...qcsdk.Params) ([]*sdktypes.Nic, error)
+	CreateNics(vxnet, name string, count int, ips []string) ([]*sdktypes.Nic, error)
+	AttachNics(nics []string, instanceID string, wait bool) (string, error)
+	DetachNics(nics []string, wait bool) (string, error)
+	DeleteNics(nics []string) error
+	ModifyNicAttributes(id, name, vxnet, ip string) error
+	ApplySecurityGroup(sg string, nics []string, wait bool) (string, error)
+	DescribeVxnets(filters ...qcsdk.Params) ([]*sdktypes.Vxnet, error)
+	DescribeJobs(filters ...qcsdk.Params) ([]*sdktypes.Job, error)
+
+	DescribeEips(filters ...qcsdk.Params) ([]*sdktypes.Eip, error)
+	AllocateEips(bandwidth int, billingMode string, count int, name string) ([]string, error)
+	AssociateEip(eip, instanceID, nic string, wait bool) (string, error)
+	DissociateEips(eips []string, wait bool) (string, error)
+	ReleaseEips(eips []string) error
+
+	DescribeLoadBalancerListeners(filters ...qcsdk.Params) ([]*sdktypes.LoadBalancerListener, error)
+	DescribeLoadBalancerBackends(filters ...qcsdk.Params) ([]*sdktypes.LoadBalancerBackend, error)
+	AddLoadBalancerBackends(listener string, backends []*sdktypes.LoadBalancerBackend) ([]string, error)
+	DeleteLoadBalancerBackends(backends []string) error
+	UpdateLoadBalancers(loadbalancers []string, wait bool) (string, error)
+}
+
+var _ API = (*qcsdk.Api)(nil)
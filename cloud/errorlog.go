@@ -0,0 +1,79 @@
+package cloud
+
+import (
+	"sync"
+	"time"
+
+	sdktypes "github.com/nicescale/qcsdk/types"
+)
+
+// APIError is a failed request or job of the qingcloud API.
+type APIError struct {
+	Time   time.Time
+	Action string
+	// Code is the ret_code of the response, or 0 for transport errors and
+	// jobs.
+	Code    int `json:",omitempty"`
+	Message string
+}
+
+// ErrorLog keeps the last errors of the qingcloud API.
+// It's an Observer.
+type ErrorLog struct {
+	mu   sync.Mutex
+	errs []APIError
+	next int
+	full bool
+}
+
+var _ Observer = (*ErrorLog)(nil)
+
+// NewErrorLog creates an ErrorLog that keeps the last size errors.
+func NewErrorLog(size int) *ErrorLog {
+	return &ErrorLog{errs: make([]APIError, size)}
+}
+
+func (l *ErrorLog) add(e APIError) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.errs) == 0 {
+		return
+	}
+	l.errs[l.next] = e
+	l.next = (l.next + 1) % len(l.errs)
+	if l.next == 0 {
+		l.full = true
+	}
+}
+
+// Errors returns the kept errors, the oldest first.
+func (l *ErrorLog) Errors() []APIError {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.full {
+		return append([]APIError{}, l.errs[:l.next]...)
+	}
+	return append(append([]APIError{}, l.errs[l.next:]...), l.errs[:l.next]...)
+}
+
+// ObserveRequest implements Observer.
+func (l *ErrorLog) ObserveRequest(action string, d time.Duration, err error) {
+	if err == nil {
+		return
+	}
+	e := APIError{Time: time.Now(), Action: action, Message: err.Error()}
+	if s, ok := err.(sdktypes.ResponseStatus); ok {
+		e.Code, e.Message = s.Code, s.Message
+	}
+	l.add(e)
+}
+
+// ObserveJobWait implements Observer.
+func (l *ErrorLog) ObserveJobWait(status string, d time.Duration, err error) {
+	switch {
+	case err != nil:
+		l.add(APIError{Time: time.Now(), Action: "WaitForJob", Message: err.Error()})
+	case status == "failed":
+		l.add(APIError{Time: time.Now(), Action: "WaitForJob", Message: "job failed"})
+	}
+}
@@ -0,0 +1,916 @@
+// Package fake implements cloud.API in memory. It models the status
+// transitions of nics, the latency of asynchronous jobs and allows errors
+// to be injected, so that the drivers can be exercised without qingcloud.
+package fake
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nicescale/qcsdk"
+	sdktypes "github.com/nicescale/qcsdk/types"
+	"github.com/nicescale/qingcloud-docker-network/cloud"
+)
+
+// Error codes returned by the fake, as documented by qingcloud.
+const (
+	CodeParameterError = 1200
+	CodeNotFound       = 2100
+	CodeResourceInUse  = 2300
+	CodeStatusMismatch = 2400
+	CodeQuotaExceeded  = 2500
+	CodeInternalError  = 5000
+)
+
+// pollInterval is how often a waiting AttachNics or DetachNics call
+// checks its job.
+const pollInterval = 10 * time.Millisecond
+
+var _ cloud.API = (*Cloud)(nil)
+
+type job struct {
+	sdktypes.Job
+	done  time.Time
+	apply func()
+}
+
+// Cloud is an in-memory qingcloud zone.
+// The zero value is not usable, create one with New.
+type Cloud struct {
+	// JobLatency is how long AttachNics and DetachNics jobs take.
+	// The status of the nics changes when the job finishes.
+	JobLatency time.Duration
+	// WaitTimeout is how long the calls that wait for their jobs wait
+	// before they fail with sdktypes.ErrJobTimeout. The job still finishes
+	// afterwards. Defaults to qcsdk.DefaultJobWaitTimeout seconds.
+	WaitTimeout time.Duration
+	// OnAttach and OnDetach are called when a nic job finishes, e.g. to
+	// create or remove the corresponding link. They're called without
+	// holding the lock of the fake.
+	OnAttach func(nic *sdktypes.Nic)
+	OnDetach func(nic *sdktypes.Nic)
+
+	mu     sync.Mutex
+	seq    int
+	nics   map[string]*sdktypes.Nic
+	vxnets map[string]*sdktypes.Vxnet
+	eips   map[string]*sdktypes.Eip
+	sgs    map[string]bool
+	lbls   map[string]*sdktypes.LoadBalancerListener
+	lbbs   map[string]*sdktypes.LoadBalancerBackend
+	jobs   map[string]*job
+	errs   map[string][]error
+	calls  map[string]int
+}
+
+// New creates an empty zone.
+func New() *Cloud {
+	return &Cloud{
+		nics:   make(map[string]*sdktypes.Nic),
+		vxnets: make(map[string]*sdktypes.Vxnet),
+		eips:   make(map[string]*sdktypes.Eip),
+		sgs:    make(map[string]bool),
+		lbls:   make(map[string]*sdktypes.LoadBalancerListener),
+		lbbs:   make(map[string]*sdktypes.LoadBalancerBackend),
+		jobs:   make(map[string]*job),
+		errs:   make(map[string][]error),
+		calls:  make(map[string]int),
+	}
+}
+
+// AddVxnet adds a vxnet joined to a router with the network cidr.
+// The first address of the network is the manager IP of the router.
+func (c *Cloud) AddVxnet(id, cidr string) *sdktypes.Vxnet {
+	_, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		panic(err)
+	}
+
+	v := &sdktypes.Vxnet{ID: id, Name: id, CreateTime: time.Now()}
+	v.Router.ID = "rtr-" + strings.TrimPrefix(id, "vxnet-")
+	v.Router.IPNetwork.IPNet = *ipnet
+	v.Router.ManagerIP = nthIP(ipnet, 1)
+	v.Router.DynIPStart = nthIP(ipnet, 2)
+	v.Router.DynIPEnd = nthIP(ipnet, 254)
+
+	c.mu.Lock()
+	c.vxnets[id] = v
+	c.mu.Unlock()
+	return v
+}
+
+// EnableIPv6 makes the vxnet dual-stack with the IPv6 network cidr.
+// The nics created afterwards get an IPv6 address as well.
+func (c *Cloud) EnableIPv6(vxnet, cidr string) {
+	_, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		panic(err)
+	}
+	c.mu.Lock()
+	c.vxnets[vxnet].Router.IPv6Network.IPNet = *ipnet
+	c.mu.Unlock()
+}
+
+// AddNic adds a nic. The ID is generated if empty.
+func (c *Cloud) AddNic(nic *sdktypes.Nic) *sdktypes.Nic {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if nic.ID == "" {
+		nic.ID = c.nextMAC()
+	}
+	if nic.Status == "" {
+		nic.Status = "available"
+	}
+	c.nics[nic.ID] = nic
+	return copyNic(nic)
+}
+
+// Nic returns a copy of the nic with the ID, or nil if there is no such nic.
+func (c *Cloud) Nic(id string) *sdktypes.Nic {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if nic := c.nics[id]; nic != nil {
+		return copyNic(nic)
+	}
+	return nil
+}
+
+// Eip returns a copy of the eip with the ID, or nil if there is no such eip.
+func (c *Cloud) Eip(id string) *sdktypes.Eip {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if eip := c.eips[id]; eip != nil {
+		cp := *eip
+		return &cp
+	}
+	return nil
+}
+
+// AddSecurityGroup adds a security group that can be applied to nics.
+func (c *Cloud) AddSecurityGroup(id string) {
+	c.mu.Lock()
+	c.sgs[id] = true
+	c.mu.Unlock()
+}
+
+// AddLoadBalancerListener adds a listener of the load balancer on port.
+func (c *Cloud) AddLoadBalancerListener(loadbalancer string, port int) *sdktypes.LoadBalancerListener {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.seq++
+	l := &sdktypes.LoadBalancerListener{
+		ID:             fmt.Sprintf("lbl-%08d", c.seq),
+		LoadBalancerID: loadbalancer,
+		Port:           port,
+		Protocol:       "tcp",
+		CreateTime:     time.Now(),
+	}
+	c.lbls[l.ID] = l
+	cp := *l
+	return &cp
+}
+
+// LoadBalancerBackend returns a copy of the backend with the ID, or nil if
+// there is no such backend.
+func (c *Cloud) LoadBalancerBackend(id string) *sdktypes.LoadBalancerBackend {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if b := c.lbbs[id]; b != nil {
+		cp := *b
+		return &cp
+	}
+	return nil
+}
+
+// SetBackendStatus sets the health check status of the backend, which is
+// "down" until it's changed.
+func (c *Cloud) SetBackendStatus(id, status string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if b := c.lbbs[id]; b != nil {
+		b.Status = status
+	}
+}
+
+// InjectError makes the next call of the action fail with err.
+// Errors injected for the same action are returned in order.
+func (c *Cloud) InjectError(action string, err error) {
+	c.mu.Lock()
+	c.errs[action] = append(c.errs[action], err)
+	c.mu.Unlock()
+}
+
+// Calls returns how many times the action has been called.
+func (c *Cloud) Calls(action string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.calls[action]
+}
+
+// call records the call of action and returns the injected error, if any.
+// It must be called with the lock held.
+func (c *Cloud) call(action string) error {
+	c.calls[action]++
+	c.finishJobs()
+	errs := c.errs[action]
+	if len(errs) == 0 {
+		return nil
+	}
+	c.errs[action] = errs[1:]
+	return errs[0]
+}
+
+func apiError(action string, code int, format string, args ...interface{}) error {
+	return sdktypes.ResponseStatus{
+		Code:    code,
+		Message: fmt.Sprintf(format, args...),
+		Action:  action,
+	}
+}
+
+func (c *Cloud) DescribeNics(filters ...qcsdk.Params) ([]*sdktypes.Nic, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.call("DescribeNics"); err != nil {
+		return nil, err
+	}
+
+	f := newFilter(filters)
+	var ret []*sdktypes.Nic
+	for _, nic := range c.nics {
+		if !f.match("nics", nic.ID) || !f.match("vxnets", nic.VxnetID) ||
+			!f.match("status", nic.Status) || !f.match("instances", nic.InstanceID) {
+			continue
+		}
+		if w := f.params["search_word"]; w != "" && !strings.Contains(nic.PrivateIP.String(), w) &&
+			!strings.Contains(nic.ID, w) && !strings.Contains(nic.NicName, w) {
+			continue
+		}
+		ret = append(ret, copyNic(nic))
+	}
+	sort.Sort(nicsByID(ret))
+	return ret, nil
+}
+
+func (c *Cloud) CreateNics(vxnet, name string, count int, ips []string) ([]*sdktypes.Nic, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	const action = "CreateNics"
+	if err := c.call(action); err != nil {
+		return nil, err
+	}
+
+	v := c.vxnets[vxnet]
+	if v == nil {
+		return nil, apiError(action, CodeNotFound, "resource [%s] not found", vxnet)
+	}
+	if count < 1 {
+		count = 1
+	}
+	if len(ips) > 0 && len(ips) != count {
+		return nil, apiError(action, CodeParameterError, "the number of private_ips must equal count")
+	}
+
+	used := make(map[string]bool)
+	for _, nic := range c.nics {
+		if nic.VxnetID == vxnet {
+			used[nic.PrivateIP.String()] = true
+		}
+	}
+	subnet := &v.Router.IPNetwork.IPNet
+	used[v.Router.ManagerIP.String()] = true
+
+	var addrs []net.IP
+	for _, s := range ips {
+		ip := net.ParseIP(s)
+		if ip == nil || !subnet.Contains(ip) {
+			return nil, apiError(action, CodeParameterError, "invalid private ip [%s]", s)
+		}
+		if used[s] {
+			return nil, apiError(action, CodeResourceInUse, "private ip [%s] is in use", s)
+		}
+		used[s] = true
+		addrs = append(addrs, ip)
+	}
+	for i := 2; len(addrs) < count; i++ {
+		ip := nthIP(subnet, i)
+		if !subnet.Contains(ip) {
+			return nil, apiError(action, CodeQuotaExceeded, "no free address in vxnet [%s]", vxnet)
+		}
+		if !used[ip.String()] {
+			used[ip.String()] = true
+			addrs = append(addrs, ip)
+		}
+	}
+
+	var ret []*sdktypes.Nic
+	for _, ip := range addrs {
+		nic := &sdktypes.Nic{
+			ID:         c.nextMAC(),
+			NicName:    name,
+			VxnetID:    vxnet,
+			PrivateIP:  ip,
+			Status:     "available",
+			CreateTime: time.Now(),
+			StatusTime: time.Now(),
+		}
+		if net6 := &v.Router.IPv6Network.IPNet; net6.IP != nil {
+			// Derive the interface ID from the IPv4 address.
+			ip4 := ip.To4()
+			nic.PrivateIPv6 = nthIP(net6, int(ip4[2])<<8|int(ip4[3]))
+		}
+		c.nics[nic.ID] = nic
+		ret = append(ret, copyNic(nic))
+	}
+	return ret, nil
+}
+
+func (c *Cloud) AttachNics(nics []string, instanceID string, wait bool) (string, error) {
+	c.mu.Lock()
+	const action = "AttachNics"
+	if err := c.call(action); err != nil {
+		c.mu.Unlock()
+		return "", err
+	}
+
+	var attached []*sdktypes.Nic
+	for _, id := range nics {
+		nic := c.nics[id]
+		if nic == nil {
+			c.mu.Unlock()
+			return "", apiError(action, CodeNotFound, "resource [%s] not found", id)
+		}
+		if nic.Status != "available" {
+			c.mu.Unlock()
+			return "", apiError(action, CodeStatusMismatch, "nic [%s] is not available, status [%s]", id, nic.Status)
+		}
+		attached = append(attached, nic)
+	}
+	for _, nic := range attached {
+		nic.Status = "pending"
+	}
+	jobID := c.newJob(action, nics, func() []*sdktypes.Nic {
+		for _, nic := range attached {
+			nic.Status = "in-use"
+			nic.InstanceID = instanceID
+			nic.StatusTime = time.Now()
+		}
+		return attached
+	}, c.OnAttach)
+	c.mu.Unlock()
+
+	return c.wait(jobID, wait)
+}
+
+func (c *Cloud) DetachNics(nics []string, wait bool) (string, error) {
+	c.mu.Lock()
+	const action = "DetachNics"
+	if err := c.call(action); err != nil {
+		c.mu.Unlock()
+		return "", err
+	}
+
+	var detached []*sdktypes.Nic
+	for _, id := range nics {
+		nic := c.nics[id]
+		if nic == nil {
+			c.mu.Unlock()
+			return "", apiError(action, CodeNotFound, "resource [%s] not found", id)
+		}
+		if nic.Status != "in-use" {
+			c.mu.Unlock()
+			return "", apiError(action, CodeStatusMismatch, "nic [%s] is not in use, status [%s]", id, nic.Status)
+		}
+		if nic.Role == 1 {
+			c.mu.Unlock()
+			return "", apiError(action, CodeParameterError, "can't detach the primary nic [%s]", id)
+		}
+		detached = append(detached, nic)
+	}
+	for _, nic := range detached {
+		nic.Status = "pending"
+	}
+	jobID := c.newJob(action, nics, func() []*sdktypes.Nic {
+		for _, nic := range detached {
+			nic.Status = "available"
+			nic.InstanceID = ""
+			nic.StatusTime = time.Now()
+		}
+		return detached
+	}, c.OnDetach)
+	c.mu.Unlock()
+
+	return c.wait(jobID, wait)
+}
+
+func (c *Cloud) DeleteNics(nics []string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	const action = "DeleteNics"
+	if err := c.call(action); err != nil {
+		return err
+	}
+
+	for _, id := range nics {
+		nic := c.nics[id]
+		if nic == nil {
+			return apiError(action, CodeNotFound, "resource [%s] not found", id)
+		}
+		if nic.Status != "available" {
+			return apiError(action, CodeStatusMismatch, "nic [%s] is not available, status [%s]", id, nic.Status)
+		}
+	}
+	for _, id := range nics {
+		delete(c.nics, id)
+	}
+	return nil
+}
+
+// ModifyNicAttributes only supports changing the name of a nic.
+func (c *Cloud) ModifyNicAttributes(id, name, vxnet, ip string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	const action = "ModifyNicAttributes"
+	if err := c.call(action); err != nil {
+		return err
+	}
+
+	nic := c.nics[id]
+	if nic == nil {
+		return apiError(action, CodeNotFound, "resource [%s] not found", id)
+	}
+	if vxnet != "" || ip != "" {
+		return apiError(action, CodeParameterError, "changing the vxnet or private ip is not supported by the fake")
+	}
+	if name != "" {
+		nic.NicName = name
+	}
+	return nil
+}
+
+func (c *Cloud) ApplySecurityGroup(sg string, nics []string, wait bool) (string, error) {
+	c.mu.Lock()
+	const action = "ApplySecurityGroup"
+	if err := c.call(action); err != nil {
+		c.mu.Unlock()
+		return "", err
+	}
+
+	if !c.sgs[sg] {
+		c.mu.Unlock()
+		return "", apiError(action, CodeNotFound, "resource [%s] not found", sg)
+	}
+	var applied []*sdktypes.Nic
+	for _, id := range nics {
+		nic := c.nics[id]
+		if nic == nil {
+			c.mu.Unlock()
+			return "", apiError(action, CodeNotFound, "resource [%s] not found", id)
+		}
+		applied = append(applied, nic)
+	}
+	jobID := c.newJob(action, nics, func() []*sdktypes.Nic {
+		for _, nic := range applied {
+			nic.SecurityGroup = sg
+		}
+		return nil
+	}, nil)
+	c.mu.Unlock()
+
+	return c.wait(jobID, wait)
+}
+
+func (c *Cloud) DescribeVxnets(filters ...qcsdk.Params) ([]*sdktypes.Vxnet, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.call("DescribeVxnets"); err != nil {
+		return nil, err
+	}
+
+	f := newFilter(filters)
+	var ret []*sdktypes.Vxnet
+	for _, v := range c.vxnets {
+		if f.match("vxnets", v.ID) {
+			cp := *v
+			ret = append(ret, &cp)
+		}
+	}
+	return ret, nil
+}
+
+func (c *Cloud) DescribeJobs(filters ...qcsdk.Params) ([]*sdktypes.Job, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.call("DescribeJobs"); err != nil {
+		return nil, err
+	}
+
+	f := newFilter(filters)
+	var ret []*sdktypes.Job
+	for _, j := range c.jobs {
+		if f.match("jobs", j.ID) && f.match("status", j.Status) {
+			cp := j.Job
+			ret = append(ret, &cp)
+		}
+	}
+	return ret, nil
+}
+
+func (c *Cloud) DescribeEips(filters ...qcsdk.Params) ([]*sdktypes.Eip, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.call("DescribeEips"); err != nil {
+		return nil, err
+	}
+
+	f := newFilter(filters)
+	var ret []*sdktypes.Eip
+	for _, eip := range c.eips {
+		if f.match("eips", eip.ID) && f.match("status", eip.Status) {
+			cp := *eip
+			ret = append(ret, &cp)
+		}
+	}
+	return ret, nil
+}
+
+func (c *Cloud) AllocateEips(bandwidth int, billingMode string, count int, name string) ([]string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	const action = "AllocateEips"
+	if err := c.call(action); err != nil {
+		return nil, err
+	}
+	if bandwidth < 1 {
+		return nil, apiError(action, CodeParameterError, "invalid bandwidth [%d]", bandwidth)
+	}
+	if count < 1 {
+		count = 1
+	}
+
+	var ids []string
+	for i := 0; i < count; i++ {
+		c.seq++
+		eip := &sdktypes.Eip{
+			ID:          fmt.Sprintf("eip-%08d", c.seq),
+			Name:        name,
+			Addr:        net.IPv4(139, 198, byte(c.seq>>8), byte(c.seq)),
+			Status:      "available",
+			Bandwidth:   bandwidth,
+			BillingMode: billingMode,
+			CreateTime:  time.Now(),
+			StatusTime:  time.Now(),
+		}
+		c.eips[eip.ID] = eip
+		ids = append(ids, eip.ID)
+	}
+	return ids, nil
+}
+
+func (c *Cloud) AssociateEip(eip, instanceID, nic string, wait bool) (string, error) {
+	c.mu.Lock()
+	const action = "AssociateEip"
+	if err := c.call(action); err != nil {
+		c.mu.Unlock()
+		return "", err
+	}
+
+	e := c.eips[eip]
+	if e == nil {
+		c.mu.Unlock()
+		return "", apiError(action, CodeNotFound, "resource [%s] not found", eip)
+	}
+	if e.Status != "available" {
+		c.mu.Unlock()
+		return "", apiError(action, CodeStatusMismatch, "eip [%s] is not available, status [%s]", eip, e.Status)
+	}
+	if nic != "" {
+		n := c.nics[nic]
+		if n == nil || n.InstanceID != instanceID {
+			c.mu.Unlock()
+			return "", apiError(action, CodeParameterError, "nic [%s] is not attached to instance [%s]", nic, instanceID)
+		}
+	}
+	e.Status = "pending"
+	jobID := c.newJob(action, []string{eip}, func() []*sdktypes.Nic {
+		e.Status = "associated"
+		e.Resource.ID, e.Resource.Type = instanceID, "instance"
+		if nic != "" {
+			e.Resource.ID, e.Resource.Type = nic, "nic"
+		}
+		e.StatusTime = time.Now()
+		return nil
+	}, nil)
+	c.mu.Unlock()
+
+	return c.wait(jobID, wait)
+}
+
+func (c *Cloud) DissociateEips(eips []string, wait bool) (string, error) {
+	c.mu.Lock()
+	const action = "DissociateEips"
+	if err := c.call(action); err != nil {
+		c.mu.Unlock()
+		return "", err
+	}
+
+	var dissociated []*sdktypes.Eip
+	for _, id := range eips {
+		e := c.eips[id]
+		if e == nil {
+			c.mu.Unlock()
+			return "", apiError(action, CodeNotFound, "resource [%s] not found", id)
+		}
+		if e.Status != "associated" {
+			c.mu.Unlock()
+			return "", apiError(action, CodeStatusMismatch, "eip [%s] is not associated, status [%s]", id, e.Status)
+		}
+		dissociated = append(dissociated, e)
+	}
+	for _, e := range dissociated {
+		e.Status = "pending"
+	}
+	jobID := c.newJob(action, eips, func() []*sdktypes.Nic {
+		for _, e := range dissociated {
+			e.Status = "available"
+			e.Resource.ID, e.Resource.Type = "", ""
+			e.StatusTime = time.Now()
+		}
+		return nil
+	}, nil)
+	c.mu.Unlock()
+
+	return c.wait(jobID, wait)
+}
+
+func (c *Cloud) ReleaseEips(eips []string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	const action = "ReleaseEips"
+	if err := c.call(action); err != nil {
+		return err
+	}
+
+	for _, id := range eips {
+		e := c.eips[id]
+		if e == nil {
+			return apiError(action, CodeNotFound, "resource [%s] not found", id)
+		}
+		if e.Status != "available" {
+			return apiError(action, CodeStatusMismatch, "eip [%s] is not available, status [%s]", id, e.Status)
+		}
+	}
+	for _, id := range eips {
+		delete(c.eips, id)
+	}
+	return nil
+}
+
+func (c *Cloud) DescribeLoadBalancerListeners(filters ...qcsdk.Params) ([]*sdktypes.LoadBalancerListener, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.call("DescribeLoadBalancerListeners"); err != nil {
+		return nil, err
+	}
+
+	f := newFilter(filters)
+	var ret []*sdktypes.LoadBalancerListener
+	for _, l := range c.lbls {
+		if f.match("loadbalancer_listeners", l.ID) && f.match("loadbalancer", l.LoadBalancerID) {
+			cp := *l
+			ret = append(ret, &cp)
+		}
+	}
+	return ret, nil
+}
+
+func (c *Cloud) DescribeLoadBalancerBackends(filters ...qcsdk.Params) ([]*sdktypes.LoadBalancerBackend, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.call("DescribeLoadBalancerBackends"); err != nil {
+		return nil, err
+	}
+
+	f := newFilter(filters)
+	var ret []*sdktypes.LoadBalancerBackend
+	for _, b := range c.lbbs {
+		if f.match("loadbalancer_backends", b.ID) && f.match("loadbalancer_listener", b.ListenerID) {
+			cp := *b
+			ret = append(ret, &cp)
+		}
+	}
+	return ret, nil
+}
+
+func (c *Cloud) AddLoadBalancerBackends(listener string, backends []*sdktypes.LoadBalancerBackend) ([]string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	const action = "AddLoadBalancerBackends"
+	if err := c.call(action); err != nil {
+		return nil, err
+	}
+
+	if c.lbls[listener] == nil {
+		return nil, apiError(action, CodeNotFound, "resource [%s] not found", listener)
+	}
+	for _, b := range backends {
+		if b.Port < 1 || b.Port > 65535 {
+			return nil, apiError(action, CodeParameterError, "invalid port [%d]", b.Port)
+		}
+		if b.NicID != "" && c.nics[b.NicID] == nil {
+			return nil, apiError(action, CodeNotFound, "resource [%s] not found", b.NicID)
+		}
+	}
+
+	var ids []string
+	for _, b := range backends {
+		c.seq++
+		cp := *b
+		cp.ID = fmt.Sprintf("lbb-%08d", c.seq)
+		cp.ListenerID = listener
+		cp.Status = "down"
+		cp.CreateTime = time.Now()
+		c.lbbs[cp.ID] = &cp
+		ids = append(ids, cp.ID)
+	}
+	return ids, nil
+}
+
+func (c *Cloud) DeleteLoadBalancerBackends(backends []string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	const action = "DeleteLoadBalancerBackends"
+	if err := c.call(action); err != nil {
+		return err
+	}
+
+	for _, id := range backends {
+		if c.lbbs[id] == nil {
+			return apiError(action, CodeNotFound, "resource [%s] not found", id)
+		}
+	}
+	for _, id := range backends {
+		delete(c.lbbs, id)
+	}
+	return nil
+}
+
+func (c *Cloud) UpdateLoadBalancers(loadbalancers []string, wait bool) (string, error) {
+	c.mu.Lock()
+	const action = "UpdateLoadBalancers"
+	if err := c.call(action); err != nil {
+		c.mu.Unlock()
+		return "", err
+	}
+
+	jobID := c.newJob(action, loadbalancers, func() []*sdktypes.Nic {
+		return nil
+	}, nil)
+	c.mu.Unlock()
+
+	return c.wait(jobID, wait)
+}
+
+// newJob creates a job that calls apply when JobLatency has passed.
+// It must be called with the lock held.
+func (c *Cloud) newJob(action string, resources []string, apply func() []*sdktypes.Nic, hook func(*sdktypes.Nic)) string {
+	c.seq++
+	j := &job{
+		Job: sdktypes.Job{
+			ID:          fmt.Sprintf("j-%08d", c.seq),
+			CreateTime:  time.Now(),
+			ResourceIds: strings.Join(resources, ","),
+			Status:      "working",
+			StatusTime:  time.Now(),
+		},
+		done: time.Now().Add(c.JobLatency),
+	}
+	j.apply = func() {
+		nics := apply()
+		if hook == nil {
+			return
+		}
+		copies := make([]*sdktypes.Nic, len(nics))
+		for i, nic := range nics {
+			copies[i] = copyNic(nic)
+		}
+		// Run the hook outside of the lock of the fake.
+		go func() {
+			for _, nic := range copies {
+				hook(nic)
+			}
+		}()
+	}
+	c.jobs[j.ID] = j
+	if c.JobLatency <= 0 {
+		c.finishJobs()
+	}
+	return j.ID
+}
+
+// finishJobs applies the jobs whose latency has passed.
+// It must be called with the lock held.
+func (c *Cloud) finishJobs() {
+	now := time.Now()
+	for _, j := range c.jobs {
+		if j.Status == "working" && !now.Before(j.done) {
+			j.apply()
+			j.Status = "successful"
+			j.StatusTime = now
+		}
+	}
+}
+
+// wait polls the job like qcsdk.Api.WaitForJobSuccess.
+func (c *Cloud) wait(jobID string, wait bool) (string, error) {
+	if !wait {
+		return jobID, nil
+	}
+
+	timeout := c.WaitTimeout
+	if timeout <= 0 {
+		timeout = qcsdk.DefaultJobWaitTimeout * time.Second
+	}
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		jobs, err := c.DescribeJobs(qcsdk.Params{"jobs": jobID})
+		if err != nil {
+			return jobID, err
+		}
+		if len(jobs) == 1 && jobs[0].Status == "successful" {
+			return jobID, nil
+		}
+		if len(jobs) == 1 && jobs[0].Status == "failed" {
+			return jobID, fmt.Errorf("job %s failed: %s", jobID, jobs[0].ErrorCodes)
+		}
+		time.Sleep(pollInterval)
+	}
+	return jobID, sdktypes.ErrJobTimeout
+}
+
+// nextMAC returns a MAC address in the range used by qingcloud nics.
+// It must be called with the lock held.
+func (c *Cloud) nextMAC() string {
+	c.seq++
+	return fmt.Sprintf("52:54:%02x:%02x:%02x:%02x", byte(c.seq>>24), byte(c.seq>>16), byte(c.seq>>8), byte(c.seq))
+}
+
+type filter struct {
+	params qcsdk.Params
+}
+
+func newFilter(filters []qcsdk.Params) filter {
+	params := make(qcsdk.Params)
+	for _, f := range filters {
+		for k, v := range f {
+			params[k] = v
+		}
+	}
+	return filter{params}
+}
+
+// match reports whether value is one of the comma separated values of key.
+// A missing key matches everything.
+func (f filter) match(key, value string) bool {
+	v, ok := f.params[key]
+	if !ok || v == "" {
+		return true
+	}
+	for _, s := range strings.Split(v, ",") {
+		if s == value {
+			return true
+		}
+	}
+	return false
+}
+
+type nicsByID []*sdktypes.Nic
+
+func (n nicsByID) Len() int           { return len(n) }
+func (n nicsByID) Less(i, j int) bool { return n[i].ID < n[j].ID }
+func (n nicsByID) Swap(i, j int)      { n[i], n[j] = n[j], n[i] }
+
+func copyNic(nic *sdktypes.Nic) *sdktypes.Nic {
+	cp := *nic
+	cp.Tags = append([]string(nil), nic.Tags...)
+	return &cp
+}
+
+func nthIP(ipnet *net.IPNet, n int) net.IP {
+	base := ipnet.IP.To4()
+	if base == nil {
+		base = ipnet.IP.To16()
+	}
+	ip := make(net.IP, len(base))
+	copy(ip, base)
+	for i := len(ip) - 1; i >= 0 && n > 0; i-- {
+		sum := int(ip[i]) + n
+		ip[i] = byte(sum)
+		n = sum >> 8
+	}
+	return ip
+}
@@ -0,0 +1,220 @@
+package cloud
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/nicescale/qcsdk"
+	sdktypes "github.com/nicescale/qcsdk/types"
+)
+
+// Observer is notified of the requests and job waits of an API, e.g. to
+// collect metrics. The methods must not block.
+type Observer interface {
+	// ObserveRequest is called after each request with the error that the
+	// request returned, which is a types.ResponseStatus for a nonzero
+	// ret_code.
+	ObserveRequest(action string, d time.Duration, err error)
+	// ObserveJobWait is called after waiting for a job. status is the last
+	// status of the job, which is empty if it couldn't be described.
+	ObserveJobWait(status string, d time.Duration, err error)
+}
+
+type observers []Observer
+
+// Observers returns an Observer that notifies all of obs.
+func Observers(obs ...Observer) Observer {
+	return observers(obs)
+}
+
+func (os observers) ObserveRequest(action string, d time.Duration, err error) {
+	for _, o := range os {
+		o.ObserveRequest(action, d, err)
+	}
+}
+
+func (os observers) ObserveJobWait(status string, d time.Duration, err error) {
+	for _, o := range os {
+		o.ObserveJobWait(status, d, err)
+	}
+}
+
+// jobPollInterval is how often an observed job is described while it's
+// awaited, like the SDK does.
+var jobPollInterval = 500 * time.Millisecond
+
+// observed is an API whose requests and job waits are reported to an
+// Observer. The jobs are awaited by the wrapper rather than the SDK, so
+// that the waits and the requests they make are observed too.
+type observed struct {
+	api API
+	o   Observer
+}
+
+// Observe returns api with its requests and job waits reported to o.
+func Observe(api API, o Observer) API {
+	return &observed{api: api, o: o}
+}
+
+// observe reports a request of action that started at start and returned
+// *err.
+func (a *observed) observe(action string, start time.Time, err *error) {
+	a.o.ObserveRequest(action, time.Since(start), *err)
+}
+
+// startJob reports the request of action that starts a job without
+// waiting for it.
+func (a *observed) startJob(action string, f func() (string, error)) (string, error) {
+	start := time.Now()
+	jobID, err := f()
+	a.o.ObserveRequest(action, time.Since(start), err)
+	return jobID, err
+}
+
+// job waits for the job started by a request if wait is true, like the
+// SDK waits for its success.
+func (a *observed) job(jobID string, err error, wait bool) (string, error) {
+	if err != nil || !wait {
+		return jobID, err
+	}
+	job, err := a.waitForJob(jobID, qcsdk.DefaultJobWaitTimeout)
+	if err != nil || job.Status == "successful" {
+		return jobID, err
+	}
+	return jobID, fmt.Errorf("job %s failed: %s", jobID, job.ErrorCodes)
+}
+
+func (a *observed) waitForJob(id string, timeout int) (job *sdktypes.Job, err error) {
+	defer func(start time.Time) {
+		status := ""
+		if job != nil {
+			status = job.Status
+		}
+		a.o.ObserveJobWait(status, time.Since(start), err)
+	}(time.Now())
+
+	deadline := time.Now().Add(time.Duration(timeout) * time.Second)
+	for {
+		jobs, err := a.DescribeJobs(qcsdk.Params{"jobs": id})
+		if err != nil {
+			return nil, err
+		}
+		if len(jobs) == 1 {
+			job = jobs[0]
+			if job.Status == "successful" || job.Status == "failed" {
+				return job, nil
+			}
+		}
+		if time.Now().After(deadline) {
+			return job, sdktypes.ErrJobTimeout
+		}
+		time.Sleep(jobPollInterval)
+	}
+}
+
+func (a *observed) DescribeNics(filters ...qcsdk.Params) (_ []*sdktypes.Nic, err error) {
+	defer a.observe("DescribeNics", time.Now(), &err)
+	return a.api.DescribeNics(filters...)
+}
+
+func (a *observed) CreateNics(vxnet, name string, count int, ips []string) (_ []*sdktypes.Nic, err error) {
+	defer a.observe("CreateNics", time.Now(), &err)
+	return a.api.CreateNics(vxnet, name, count, ips)
+}
+
+func (a *observed) AttachNics(nics []string, instanceID string, wait bool) (string, error) {
+	jobID, err := a.startJob("AttachNics", func() (string, error) {
+		return a.api.AttachNics(nics, instanceID, false)
+	})
+	return a.job(jobID, err, wait)
+}
+
+func (a *observed) DetachNics(nics []string, wait bool) (string, error) {
+	jobID, err := a.startJob("DetachNics", func() (string, error) {
+		return a.api.DetachNics(nics, false)
+	})
+	return a.job(jobID, err, wait)
+}
+
+func (a *observed) DeleteNics(nics []string) (err error) {
+	defer a.observe("DeleteNics", time.Now(), &err)
+	return a.api.DeleteNics(nics)
+}
+
+func (a *observed) ModifyNicAttributes(id, name, vxnet, ip string) (err error) {
+	defer a.observe("ModifyNicAttributes", time.Now(), &err)
+	return a.api.ModifyNicAttributes(id, name, vxnet, ip)
+}
+
+func (a *observed) ApplySecurityGroup(sg string, nics []string, wait bool) (string, error) {
+	jobID, err := a.startJob("ApplySecurityGroup", func() (string, error) {
+		return a.api.ApplySecurityGroup(sg, nics, false)
+	})
+	return a.job(jobID, err, wait)
+}
+
+func (a *observed) DescribeVxnets(filters ...qcsdk.Params) (_ []*sdktypes.Vxnet, err error) {
+	defer a.observe("DescribeVxnets", time.Now(), &err)
+	return a.api.DescribeVxnets(filters...)
+}
+
+func (a *observed) DescribeJobs(filters ...qcsdk.Params) (_ []*sdktypes.Job, err error) {
+	defer a.observe("DescribeJobs", time.Now(), &err)
+	return a.api.DescribeJobs(filters...)
+}
+
+func (a *observed) DescribeEips(filters ...qcsdk.Params) (_ []*sdktypes.Eip, err error) {
+	defer a.observe("DescribeEips", time.Now(), &err)
+	return a.api.DescribeEips(filters...)
+}
+
+func (a *observed) AllocateEips(bandwidth int, billingMode string, count int, name string) (_ []string, err error) {
+	defer a.observe("AllocateEips", time.Now(), &err)
+	return a.api.AllocateEips(bandwidth, billingMode, count, name)
+}
+
+func (a *observed) AssociateEip(eip, instanceID, nic string, wait bool) (string, error) {
+	jobID, err := a.startJob("AssociateEip", func() (string, error) {
+		return a.api.AssociateEip(eip, instanceID, nic, false)
+	})
+	return a.job(jobID, err, wait)
+}
+
+func (a *observed) DissociateEips(eips []string, wait bool) (string, error) {
+	jobID, err := a.startJob("DissociateEips", func() (string, error) {
+		return a.api.DissociateEips(eips, false)
+	})
+	return a.job(jobID, err, wait)
+}
+
+func (a *observed) ReleaseEips(eips []string) (err error) {
+	defer a.observe("ReleaseEips", time.Now(), &err)
+	return a.api.ReleaseEips(eips)
+}
+
+func (a *observed) DescribeLoadBalancerListeners(filters ...qcsdk.Params) (_ []*sdktypes.LoadBalancerListener, err error) {
+	defer a.observe("DescribeLoadBalancerListeners", time.Now(), &err)
+	return a.api.DescribeLoadBalancerListeners(filters...)
+}
+
+func (a *observed) DescribeLoadBalancerBackends(filters ...qcsdk.Params) (_ []*sdktypes.LoadBalancerBackend, err error) {
+	defer a.observe("DescribeLoadBalancerBackends", time.Now(), &err)
+	return a.api.DescribeLoadBalancerBackends(filters...)
+}
+
+func (a *observed) AddLoadBalancerBackends(listener string, backends []*sdktypes.LoadBalancerBackend) (_ []string, err error) {
+	defer a.observe("AddLoadBalancerBackends", time.Now(), &err)
+	return a.api.AddLoadBalancerBackends(listener, backends)
+}
+
+func (a *observed) DeleteLoadBalancerBackends(backends []string) (err error) {
+	defer a.observe("DeleteLoadBalancerBackends", time.Now(), &err)
+	return a.api.DeleteLoadBalancerBackends(backends)
+}
+
+func (a *observed) UpdateLoadBalancers(loadbalancers []string, wait bool) (string, error) {
+	jobID, err := a.startJob("UpdateLoadBalancers", func() (string, error) {
+		return a.api.UpdateLoadBalancers(loadbalancers, false)
+	})
+	return a.job(jobID, err, wait)
+}
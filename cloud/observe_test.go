@@ -0,0 +1,75 @@
+package cloud_test
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	sdktypes "github.com/nicescale/qcsdk/types"
+	"github.com/nicescale/qingcloud-docker-network/cloud"
+	"github.com/nicescale/qingcloud-docker-network/cloud/fake"
+)
+
+type recorder struct {
+	mu       sync.Mutex
+	requests map[string]int
+	errors   map[string]int
+	jobs     []string
+}
+
+func newRecorder() *recorder {
+	return &recorder{requests: make(map[string]int), errors: make(map[string]int)}
+}
+
+func (r *recorder) ObserveRequest(action string, d time.Duration, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.requests[action]++
+	if err != nil {
+		r.errors[action]++
+	}
+}
+
+func (r *recorder) ObserveJobWait(status string, d time.Duration, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.jobs = append(r.jobs, status)
+}
+
+func TestObserve(t *testing.T) {
+	c := fake.New()
+	c.AddVxnet("vxnet-a", "192.168.0.0/24")
+	nic := c.AddNic(&sdktypes.Nic{VxnetID: "vxnet-a", PrivateIP: net.ParseIP("192.168.0.10")})
+	r := newRecorder()
+	api := cloud.Observe(c, r)
+
+	if _, err := api.AttachNics([]string{nic.ID}, "i-test", true); err != nil {
+		t.Fatalf("AttachNics: %v", err)
+	}
+	if got := c.Nic(nic.ID); got.Status != "in-use" {
+		t.Errorf("nic is %s after the job is awaited, want in-use", got.Status)
+	}
+	if r.requests["AttachNics"] != 1 || r.requests["DescribeJobs"] == 0 {
+		t.Errorf("requests = %v, want AttachNics and the DescribeJobs of the wait", r.requests)
+	}
+	if len(r.jobs) != 1 || r.jobs[0] != "successful" {
+		t.Errorf("job waits = %v, want one successful", r.jobs)
+	}
+
+	// Requests without wait don't wait for their jobs.
+	if _, err := api.DetachNics([]string{nic.ID}, false); err != nil {
+		t.Fatalf("DetachNics: %v", err)
+	}
+	if len(r.jobs) != 1 {
+		t.Errorf("job waits = %v, want no wait for DetachNics", r.jobs)
+	}
+
+	c.InjectError("DescribeNics", sdktypes.ResponseStatus{Code: fake.CodeInternalError, Message: "internal error"})
+	if _, err := api.DescribeNics(); err == nil {
+		t.Fatal("DescribeNics succeeded with an injected error")
+	}
+	if r.errors["DescribeNics"] != 1 {
+		t.Errorf("errors = %v, want the one of DescribeNics", r.errors)
+	}
+}
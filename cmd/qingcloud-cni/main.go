@@ -0,0 +1,9 @@
+// Command qingcloud-cni is the CNI plugin that attaches a qingcloud nic to
+// each pod. See package cni for the network configuration.
+package main
+
+import "github.com/nicescale/qingcloud-docker-network/cni"
+
+func main() {
+	cni.Main()
+}
@@ -0,0 +1,411 @@
+// Package cni implements a CNI plugin that gives each pod a qingcloud nic,
+// the same way as the docker plugin gives each container one.
+// The nics are allocated by the IPAM driver logic and claimed in the
+// reservation store shared with the docker plugin of the host.
+package cni
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/nicescale/qcsdk"
+	"github.com/nicescale/qingcloud-docker-network/drivers/ipam"
+	"github.com/nicescale/qingcloud-docker-network/drivers/network"
+	"github.com/nicescale/qingcloud-docker-network/util"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+)
+
+const (
+	// DefaultDataDir is the default data dir of the docker plugin.
+	DefaultDataDir = "/var/lib/docker/qingcloud-network"
+
+	defaultLinkTimeout     = 30 * time.Second
+	defaultTakeoverTimeout = 2 * time.Minute
+	defaultStickyTTL       = 24 * time.Hour
+	// reservationTTL only matters between Allocate and ClaimLink of ADD.
+	reservationTTL = 5 * time.Minute
+)
+
+// cmdArgs are the arguments passed by the runtime in the environment.
+type cmdArgs struct {
+	Command     string
+	ContainerID string
+	Netns       string
+	IfName      string
+	Args        map[string]string
+}
+
+type plugin struct {
+	conf   *NetConf
+	nl     util.Netlink
+	rs     *util.ReservationStore
+	sticky *util.StickyStore
+	host   *util.HostGuard
+	alloc  *ipam.Allocator
+}
+
+// Main runs the command in CNI_COMMAND and exits. The result or the error
+// is printed to stdout as required by the CNI spec.
+func Main() {
+	logrus.SetOutput(os.Stderr)
+
+	result, err := run(os.Stdin)
+	if err != nil {
+		e, ok := err.(*Error)
+		if !ok {
+			e = newError(errInternal, "%v", err)
+		}
+		if e.CNIVersion == "" {
+			e.CNIVersion = SupportedVersions[len(SupportedVersions)-1]
+		}
+		json.NewEncoder(os.Stdout).Encode(e)
+		os.Exit(1)
+	}
+	if result != nil {
+		json.NewEncoder(os.Stdout).Encode(result)
+	}
+}
+
+func run(stdin io.Reader) (interface{}, error) {
+	args := &cmdArgs{
+		Command:     os.Getenv("CNI_COMMAND"),
+		ContainerID: os.Getenv("CNI_CONTAINERID"),
+		Netns:       os.Getenv("CNI_NETNS"),
+		IfName:      os.Getenv("CNI_IFNAME"),
+	}
+	if args.Command == "VERSION" {
+		return map[string]interface{}{
+			"cniVersion":        SupportedVersions[len(SupportedVersions)-1],
+			"supportedVersions": SupportedVersions,
+		}, nil
+	}
+
+	var err error
+	if args.Args, err = parseArgs(os.Getenv("CNI_ARGS")); err != nil {
+		return nil, err
+	}
+	if args.ContainerID == "" || args.IfName == "" {
+		return nil, newError(errInvalidEnv, "CNI_CONTAINERID and CNI_IFNAME must be provided")
+	}
+	if args.Netns == "" && args.Command != "DEL" {
+		return nil, newError(errInvalidEnv, "CNI_NETNS must be provided")
+	}
+
+	data, err := ioutil.ReadAll(stdin)
+	if err != nil {
+		return nil, err
+	}
+	conf := &NetConf{}
+	if err := json.Unmarshal(data, conf); err != nil {
+		return nil, newError(errDecode, "failed to decode the network configuration: %v", err)
+	}
+	if err := checkVersion(conf.CNIVersion); err != nil {
+		return nil, err
+	}
+
+	p, err := newPlugin(conf)
+	if err != nil {
+		if e, ok := err.(*Error); ok {
+			e.CNIVersion = conf.CNIVersion
+		}
+		return nil, err
+	}
+
+	switch args.Command {
+	case "ADD":
+		return p.add(args)
+	case "DEL":
+		return nil, p.del(args)
+	case "CHECK":
+		return nil, p.check(args)
+	}
+	return nil, newError(errInvalidEnv, "unknown CNI_COMMAND %q", args.Command)
+}
+
+func newPlugin(conf *NetConf) (*plugin, error) {
+	if conf.Vxnet == "" || conf.AccessKeyID == "" || conf.SecretKey == "" || conf.Zone == "" {
+		return nil, newError(errInvalidConfig, "vxnet, accessKeyID, secretKey and zone must be provided")
+	}
+	if conf.DataDir == "" {
+		conf.DataDir = DefaultDataDir
+	}
+	// The watermarks saved by the docker plugin in the data dir take
+	// precedence over the default.
+	cfg := ipam.Config{LinkTimeout: defaultLinkTimeout, TakeoverTimeout: defaultTakeoverTimeout, WarmHigh: ipam.DefaultWarmHigh, StickyTTL: defaultStickyTTL}
+	if conf.LinkTimeout != "" {
+		d, err := time.ParseDuration(conf.LinkTimeout)
+		if err != nil {
+			return nil, newError(errInvalidConfig, "invalid linkTimeout %q: %v", conf.LinkTimeout, err)
+		}
+		cfg.LinkTimeout = d
+	}
+	if conf.StickyTTL != "" {
+		d, err := time.ParseDuration(conf.StickyTTL)
+		if err != nil {
+			return nil, newError(errInvalidConfig, "invalid stickyTTL %q: %v", conf.StickyTTL, err)
+		}
+		cfg.StickyTTL = d
+	}
+
+	if err := util.Init(conf.InstanceID); err != nil {
+		return nil, err
+	}
+	nl, err := util.NewNetlink()
+	if err != nil {
+		return nil, err
+	}
+	api := qcsdk.NewApi(conf.AccessKeyID, conf.SecretKey, conf.Zone)
+	host, err := util.NewHostGuard(api, nl, conf.IdleLink)
+	if err != nil {
+		return nil, newError(errInvalidConfig, "%v", err)
+	}
+	cfg.Host = host
+	rs := util.NewReservationStore(conf.DataDir, reservationTTL)
+	return &plugin{
+		conf:   conf,
+		nl:     nl,
+		rs:     rs,
+		sticky: util.NewStickyStore(conf.DataDir),
+		host:   host,
+		alloc:  ipam.NewAllocator(api, nl, conf.DataDir, rs, cfg),
+	}, nil
+}
+
+// owner is the endpoint ID of the reservations claimed by the plugin.
+func owner(args *cmdArgs) string {
+	return fmt.Sprintf("cni/%s/%s", args.ContainerID, args.IfName)
+}
+
+// stickyID returns the identity that the address of the pod is bound to.
+// STICKY_ID in CNI_ARGS takes precedence over the pod name passed by
+// kubelet. It's empty unless sticky is enabled in the configuration.
+func (p *plugin) stickyID(args *cmdArgs) string {
+	if !p.conf.Sticky {
+		return ""
+	}
+	if id := args.Args["STICKY_ID"]; id != "" {
+		return id
+	}
+	ns, name := args.Args["K8S_POD_NAMESPACE"], args.Args["K8S_POD_NAME"]
+	if ns == "" || name == "" {
+		logrus.Warnf("Sticky address requested but the pod name of container %s is unknown", args.ContainerID)
+		return ""
+	}
+	return fmt.Sprintf("k8s/%s/%s", ns, name)
+}
+
+func (p *plugin) add(args *cmdArgs) (*Result, error) {
+	stickyID := p.stickyID(args)
+	var prev *util.StickyBinding
+	if stickyID != "" {
+		var err error
+		if prev, err = p.sticky.Get(stickyID); err != nil {
+			return nil, err
+		}
+	}
+	addr, err := p.alloc.Allocate(p.conf.Vxnet, args.Args["IP"], stickyID)
+	if err != nil {
+		return nil, err
+	}
+	log := logrus.WithField("nic", addr.Nic.ID).WithField("container", args.ContainerID)
+
+	_, link, err := network.ClaimLink(p.nl, p.rs, p.host, p.conf.Vxnet, addr.IP.IP.String(), owner(args))
+	if err == nil {
+		err = p.setupLink(link, args, addr)
+	}
+	if err != nil {
+		if err := p.restoreLink(addr.Nic.ID, p.conf.Vxnet, addr.IP.IP, args.Netns); err != nil {
+			log.Errorf("Failed to restore link: %v", err)
+		}
+		// The binding is restored before the release so that the nic
+		// isn't held for the identity of the failed pod.
+		if stickyID != "" {
+			if err := p.restoreBinding(stickyID, prev); err != nil {
+				log.Errorf("Failed to restore the sticky binding of %s: %v", stickyID, err)
+			}
+		}
+		if err := p.alloc.Release(p.conf.Vxnet, addr.IP.IP); err != nil {
+			log.Errorf("Failed to release %s: %v", addr.IP.IP, err)
+		}
+		return nil, err
+	}
+
+	log.Infof("Nic with address %s added to %s as %s", addr.IP, args.Netns, args.IfName)
+	return newResult(p.conf.CNIVersion, args.IfName, args.Netns, addr.Nic.ID, addr.IP, addr.Gateway), nil
+}
+
+// restoreBinding reverts the binding of the identity made by Allocate to
+// prev, or removes it if the identity had none.
+func (p *plugin) restoreBinding(id string, prev *util.StickyBinding) error {
+	if prev != nil {
+		return p.sticky.Set(prev)
+	}
+	return p.sticky.Remove(id)
+}
+
+// setupLink moves the link into the sandbox, renames it to the requested
+// interface name, and configures the address and the default route.
+func (p *plugin) setupLink(link netlink.Link, args *cmdArgs, addr *ipam.Address) error {
+	if err := p.nl.LinkSetDown(link); err != nil {
+		return err
+	}
+	if err := p.nl.LinkSetNs(link, args.Netns); err != nil {
+		return fmt.Errorf("failed to move link of nic %s to %s: %v", addr.Nic.ID, args.Netns, err)
+	}
+
+	nsnl, err := netlinkAt(args.Netns)
+	if err != nil {
+		return err
+	}
+	links, err := nsnl.LinkList()
+	if err != nil {
+		return err
+	}
+	link = links[addr.Nic.ID]
+	if link == nil {
+		return fmt.Errorf("link of nic %s not found in %s", addr.Nic.ID, args.Netns)
+	}
+	if err := nsnl.RenameLink(link, args.IfName); err != nil {
+		return err
+	}
+	if err := nsnl.AddrAdd(link, &netlink.Addr{IPNet: addr.IP}); err != nil {
+		return fmt.Errorf("failed to add address %s: %v", addr.IP, err)
+	}
+	if err := nsnl.LinkSetUp(link); err != nil {
+		return err
+	}
+	if addr.Gateway == nil {
+		return nil
+	}
+	route := &netlink.Route{LinkIndex: link.Attrs().Index, Gw: addr.Gateway}
+	if err := nsnl.RouteAdd(route); err != nil {
+		return fmt.Errorf("failed to add default route via %s: %v", addr.Gateway, err)
+	}
+	return nil
+}
+
+func (p *plugin) del(args *cmdArgs) error {
+	r, err := p.findReservation(args)
+	if err != nil || r == nil {
+		// DEL may be called more than once.
+		return err
+	}
+
+	log := logrus.WithField("nic", r.NicID).WithField("container", args.ContainerID)
+	if err := p.restoreLink(r.NicID, r.PoolID, net.ParseIP(r.Address), args.Netns); err != nil {
+		// The link is moved back to the host by the kernel when the
+		// sandbox is destroyed, and requeued by the docker plugin.
+		log.Warnf("Failed to restore link: %v", err)
+	}
+	if err := p.alloc.Release(r.PoolID, net.ParseIP(r.Address)); err != nil {
+		return err
+	}
+	log.Infof("Nic with address %s released", r.Address)
+	return nil
+}
+
+// restoreLink moves the link of the nic from the sandbox back to the host
+// and renames it to the canonical name, so that it can be reused as an
+// idle nic with the address ip in the vxnet.
+func (p *plugin) restoreLink(mac, vxnet string, ip net.IP, sandbox string) error {
+	if sandbox != "" {
+		if _, err := os.Stat(sandbox); err == nil {
+			nsnl, err := netlinkAt(sandbox)
+			if err != nil {
+				return err
+			}
+			links, err := nsnl.LinkList()
+			if err != nil {
+				return err
+			}
+			if link := links[mac]; link != nil {
+				if err := nsnl.LinkSetDown(link); err != nil {
+					return err
+				}
+				if err := nsnl.LinkSetNs(link, "/proc/self/ns/net"); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	links, err := p.nl.LinkList()
+	if err != nil {
+		return err
+	}
+	link := links[mac]
+	if link == nil {
+		return fmt.Errorf("link of nic %s not found in the host", mac)
+	}
+	if err := p.nl.RenameLink(link, util.CanonicalNicName(mac)); err != nil {
+		return err
+	}
+	return p.host.PrepareIdle(link, vxnet, ip)
+}
+
+func (p *plugin) check(args *cmdArgs) error {
+	r, err := p.findReservation(args)
+	if err != nil {
+		return err
+	}
+	if r == nil {
+		return fmt.Errorf("no nic is claimed by container %s", args.ContainerID)
+	}
+
+	nsnl, err := netlinkAt(args.Netns)
+	if err != nil {
+		return err
+	}
+	links, err := nsnl.LinkList()
+	if err != nil {
+		return err
+	}
+	link := links[r.NicID]
+	if link == nil {
+		return fmt.Errorf("link of nic %s not found in %s", r.NicID, args.Netns)
+	}
+	if name := link.Attrs().Name; name != args.IfName {
+		return fmt.Errorf("link of nic %s is named %s instead of %s", r.NicID, name, args.IfName)
+	}
+	addrs, err := nsnl.AddrList(link, netlink.FAMILY_V4)
+	if err != nil {
+		return err
+	}
+	for _, a := range addrs {
+		if a.IP.String() == r.Address {
+			return nil
+		}
+	}
+	return fmt.Errorf("address %s not found on %s in %s", r.Address, args.IfName, args.Netns)
+}
+
+func (p *plugin) findReservation(args *cmdArgs) (*util.Reservation, error) {
+	rs, err := p.rs.List()
+	if err != nil {
+		return nil, err
+	}
+	id := owner(args)
+	for _, r := range rs {
+		if r.EndpointID == id {
+			return r, nil
+		}
+	}
+	return nil, nil
+}
+
+// netlinkAt returns a Netlink operating in the network namespace at path.
+// The namespace stays open until the process exits.
+var netlinkAt = func(path string) (util.Netlink, error) {
+	ns, err := netns.GetFromPath(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open network namespace %s: %v", path, err)
+	}
+	return util.NewNetlinkAt(ns)
+}
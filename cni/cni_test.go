@@ -0,0 +1,211 @@
+package cni
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nicescale/qingcloud-docker-network/cloud/fake"
+	"github.com/nicescale/qingcloud-docker-network/drivers/ipam"
+	"github.com/nicescale/qingcloud-docker-network/util"
+	"github.com/nicescale/qingcloud-docker-network/util/nltest"
+)
+
+const (
+	testInstance = "i-test"
+	testVxnet    = "vxnet-a"
+	testPool     = "192.168.0.0/24"
+	testSticky   = "k8s/default/web-0"
+)
+
+// testEnv is a plugin on an in-memory cloud and host, with the sandbox of
+// the pod connected to the host.
+type testEnv struct {
+	p       *plugin
+	c       *fake.Cloud
+	host    *nltest.Memory
+	sandbox *nltest.Memory
+	dir     string
+	args    *cmdArgs
+	restore func()
+}
+
+func newTestEnv(t *testing.T) *testEnv {
+	util.InstanceID = testInstance
+	dir, err := ioutil.TempDir("", "cni-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	netns := filepath.Join(dir, "netns")
+	if err := ioutil.WriteFile(netns, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	c := fake.New()
+	c.AddVxnet(testVxnet, testPool)
+	host, sandbox := nltest.NewMemory(), nltest.NewMemory()
+	host.Connect(netns, sandbox)
+	sandbox.Connect("/proc/self/ns/net", host)
+	c.OnAttach, c.OnDetach = host.AttachHook(), host.DetachHook()
+
+	orig := netlinkAt
+	netlinkAt = func(path string) (util.Netlink, error) {
+		if path != netns {
+			return nil, fmt.Errorf("failed to open network namespace %s", path)
+		}
+		return sandbox, nil
+	}
+
+	rs := util.NewReservationStore(dir, time.Minute)
+	// The nics of released addresses are kept to check their links.
+	cfg := ipam.Config{LinkTimeout: time.Second, WarmHigh: 1}
+	return &testEnv{
+		p: &plugin{
+			conf:   &NetConf{CNIVersion: "0.4.0", Vxnet: testVxnet, DataDir: dir, Sticky: true},
+			nl:     host,
+			rs:     rs,
+			sticky: util.NewStickyStore(dir),
+			alloc:  ipam.NewAllocator(c, host, dir, rs, cfg),
+		},
+		c:       c,
+		host:    host,
+		sandbox: sandbox,
+		dir:     dir,
+		args: &cmdArgs{
+			ContainerID: "c1",
+			Netns:       netns,
+			IfName:      "eth0",
+			Args:        map[string]string{"K8S_POD_NAMESPACE": "default", "K8S_POD_NAME": "web-0"},
+		},
+		restore: func() { netlinkAt = orig },
+	}
+}
+
+func (e *testEnv) close() {
+	e.restore()
+	os.RemoveAll(e.dir)
+}
+
+// checkReleased checks that the nic is back in the host as an idle nic.
+func (e *testEnv) checkReleased(t *testing.T, mac string) {
+	if link := e.sandbox.Link(mac); link != nil {
+		t.Errorf("link %s left in the sandbox", link.Attrs().Name)
+	}
+	if link := e.host.Link(mac); link == nil || link.Attrs().Name != util.CanonicalNicName(mac) {
+		t.Errorf("link = %+v, want %s in the host", link, util.CanonicalNicName(mac))
+	}
+	if r, err := e.p.findReservation(e.args); err != nil || r != nil {
+		t.Errorf("reservation %+v, %v left", r, err)
+	}
+	rs, err := e.p.rs.List()
+	if err != nil || len(rs) != 0 {
+		t.Errorf("reservations = %+v, %v, want none", rs, err)
+	}
+}
+
+func TestAddDelCheck(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+
+	result, err := e.p.add(e.args)
+	if err != nil {
+		t.Fatalf("ADD: %v", err)
+	}
+	mac := result.Interfaces[0].Mac
+	ip, _, err := net.ParseCIDR(result.IPs[0].Address)
+	if err != nil || result.IPs[0].Gateway != "192.168.0.1" {
+		t.Fatalf("result IPs = %+v, want an address with gateway 192.168.0.1", result.IPs[0])
+	}
+	link := e.sandbox.Link(mac)
+	if link == nil || link.Attrs().Name != "eth0" || link.Attrs().Flags&net.FlagUp == 0 {
+		t.Fatalf("link in the sandbox = %+v, want eth0 up", link)
+	}
+	if b, err := e.p.sticky.Get(testSticky); err != nil || b == nil || b.Address != ip.String() {
+		t.Errorf("sticky binding = %+v, %v, want address %s", b, err, ip)
+	}
+	if err := e.p.check(e.args); err != nil {
+		t.Errorf("CHECK: %v", err)
+	}
+
+	if err := e.p.del(e.args); err != nil {
+		t.Fatalf("DEL: %v", err)
+	}
+	e.checkReleased(t, mac)
+	if err := e.p.check(e.args); err == nil {
+		t.Errorf("CHECK succeeded after DEL")
+	}
+	// DEL may be called more than once.
+	if err := e.p.del(e.args); err != nil {
+		t.Errorf("second DEL: %v", err)
+	}
+
+	// The recreated pod gets the address bound to its name.
+	result, err = e.p.add(e.args)
+	if err != nil {
+		t.Fatalf("ADD of the recreated pod: %v", err)
+	}
+	if result.Interfaces[0].Mac != mac {
+		t.Errorf("recreated pod got nic %s, want the bound %s", result.Interfaces[0].Mac, mac)
+	}
+}
+
+func TestAddFailure(t *testing.T) {
+	tests := []struct {
+		name   string
+		inject func(e *testEnv)
+		// prev is the address that the identity was bound to before ADD.
+		prev string
+	}{
+		{
+			name:   "move failure",
+			inject: func(e *testEnv) { e.host.InjectError("LinkSetNs", fmt.Errorf("device or resource busy")) },
+		},
+		{
+			name:   "address failure",
+			inject: func(e *testEnv) { e.sandbox.InjectError("AddrAdd", fmt.Errorf("file exists")) },
+		},
+		{
+			name:   "address failure with a previous binding",
+			inject: func(e *testEnv) { e.sandbox.InjectError("AddrAdd", fmt.Errorf("file exists")) },
+			prev:   "192.168.0.20",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEnv(t)
+			defer e.close()
+			var prev *util.StickyBinding
+			if tt.prev != "" {
+				prev = &util.StickyBinding{ID: testSticky, Vxnet: testVxnet, NicID: "52:54:00:00:00:99", Address: tt.prev}
+				if err := e.p.sticky.Set(prev); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			tt.inject(e)
+			if _, err := e.p.add(e.args); err == nil {
+				t.Fatalf("ADD succeeded")
+			}
+
+			b, err := e.p.sticky.Get(testSticky)
+			switch {
+			case err != nil:
+				t.Fatal(err)
+			case prev == nil && b != nil:
+				t.Errorf("sticky binding %+v left after the failure", b)
+			case prev != nil && (b == nil || b.NicID != prev.NicID):
+				t.Errorf("sticky binding = %+v, want the previous %+v", b, prev)
+			}
+			nics, err := e.c.DescribeNics()
+			if err != nil || len(nics) != 1 {
+				t.Fatalf("nics = %+v, %v, want the allocated one", nics, err)
+			}
+			e.checkReleased(t, nics[0].ID)
+		})
+	}
+}
@@ -0,0 +1,145 @@
+package cni
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// SupportedVersions are the versions of the CNI spec implemented by the plugin.
+var SupportedVersions = []string{"0.3.0", "0.3.1", "0.4.0"}
+
+// The well-known error codes of the CNI spec.
+const (
+	errIncompatibleVersion = 1
+	errInvalidEnv          = 4
+	errDecode              = 6
+	errInvalidConfig       = 7
+	// errInternal is the plugin-specific code for all the other failures.
+	errInternal = 100
+)
+
+// NetConf is the network configuration passed to the plugin on stdin.
+type NetConf struct {
+	CNIVersion string `json:"cniVersion"`
+	Name       string `json:"name"`
+	Type       string `json:"type"`
+
+	// Vxnet is the vxnet that the nics of the pods are attached to.
+	Vxnet string `json:"vxnet"`
+
+	AccessKeyID string `json:"accessKeyID"`
+	SecretKey   string `json:"secretKey"`
+	Zone        string `json:"zone"`
+	// InstanceID is detected from the host if empty.
+	InstanceID string `json:"instanceID,omitempty"`
+
+	// DataDir is the data dir of the docker plugin. The CNI plugin and the
+	// docker plugin of a host must use the same data dir so that they
+	// don't take each other's nics.
+	DataDir string `json:"dataDir,omitempty"`
+	// LinkTimeout is how long to wait for the link of an attached nic.
+	LinkTimeout string `json:"linkTimeout,omitempty"`
+	// IdleLink is the policy for the links of the idle nics in the host,
+	// "down" (default) or "up". It should match the docker plugin.
+	IdleLink string `json:"idleLink,omitempty"`
+	// Sticky binds the address of each pod to the pod name, so that a
+	// recreated pod gets the same nic and address.
+	Sticky bool `json:"sticky,omitempty"`
+	// StickyTTL is how long the nic of a deleted pod stays bound to its
+	// name. It should match the docker plugin.
+	StickyTTL string `json:"stickyTTL,omitempty"`
+
+	PrevResult json.RawMessage `json:"prevResult,omitempty"`
+}
+
+// Result is the result of ADD in the format of CNI spec 0.3.0 and later.
+type Result struct {
+	CNIVersion string       `json:"cniVersion"`
+	Interfaces []*Interface `json:"interfaces"`
+	IPs        []*IPConfig  `json:"ips"`
+	Routes     []*Route     `json:"routes,omitempty"`
+	DNS        struct{}     `json:"dns"`
+}
+
+// Interface is a link created or configured by the plugin.
+type Interface struct {
+	Name    string `json:"name"`
+	Mac     string `json:"mac"`
+	Sandbox string `json:"sandbox"`
+}
+
+// IPConfig is an address assigned to an interface.
+type IPConfig struct {
+	Version   string `json:"version"`
+	Address   string `json:"address"`
+	Gateway   string `json:"gateway,omitempty"`
+	Interface *int   `json:"interface,omitempty"`
+}
+
+// Route is a route added to the sandbox.
+type Route struct {
+	Dst string `json:"dst"`
+	GW  string `json:"gw,omitempty"`
+}
+
+// Error is printed to stdout if a command fails.
+type Error struct {
+	CNIVersion string `json:"cniVersion"`
+	Code       int    `json:"code"`
+	Msg        string `json:"msg"`
+	Details    string `json:"details,omitempty"`
+}
+
+func (e *Error) Error() string {
+	return e.Msg
+}
+
+func newError(code int, format string, args ...interface{}) *Error {
+	return &Error{Code: code, Msg: fmt.Sprintf(format, args...)}
+}
+
+func checkVersion(v string) error {
+	for _, s := range SupportedVersions {
+		if s == v {
+			return nil
+		}
+	}
+	return newError(errIncompatibleVersion, "unsupported CNI version %q. Supported versions are %s",
+		v, strings.Join(SupportedVersions, ", "))
+}
+
+// parseArgs parses CNI_ARGS, which is in the form of K1=V1;K2=V2.
+func parseArgs(s string) (map[string]string, error) {
+	args := make(map[string]string)
+	if s == "" {
+		return args, nil
+	}
+	for _, kv := range strings.Split(s, ";") {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 {
+			return nil, newError(errInvalidEnv, "invalid CNI_ARGS pair %q", kv)
+		}
+		args[parts[0]] = parts[1]
+	}
+	return args, nil
+}
+
+func newResult(version, ifName, netns string, mac string, ip *net.IPNet, gw net.IP) *Result {
+	idx := 0
+	r := &Result{
+		CNIVersion: version,
+		Interfaces: []*Interface{{Name: ifName, Mac: mac, Sandbox: netns}},
+		IPs: []*IPConfig{{
+			Version:   "4",
+			Address:   ip.String(),
+			Interface: &idx,
+		}},
+	}
+	if gw != nil {
+		r.IPs[0].Gateway = gw.String()
+		r.Routes = []*Route{{Dst: "0.0.0.0/0", GW: gw.String()}}
+	}
+	return r
+}
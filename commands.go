@@ -0,0 +1,389 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/nicescale/qingcloud-docker-network/admin"
+	"github.com/nicescale/qingcloud-docker-network/cloud"
+	"github.com/nicescale/qingcloud-docker-network/drivers/network"
+	"github.com/nicescale/qingcloud-docker-network/util"
+	"github.com/urfave/cli"
+)
+
+var jsonFlag = cli.BoolFlag{
+	Name:  "json",
+	Usage: "Print JSON instead of a table.",
+}
+
+// commands are the operator commands. They read the state in the data dir
+// and call the qingcloud API with the global flags, so they work whether or
+// not the plugin is running. The commands that change anything, and those
+// that reconcile the nics to show them, are sent to the admin API of the
+// plugin if it's running, so that they don't race with it.
+var commands = []cli.Command{
+	{
+		Name:   "serve",
+		Usage:  "Serve the docker network and IPAM plugin. It's the default command.",
+		Action: Run,
+	},
+	{
+		Name:   "status",
+		Usage:  "Show a summary of the networks, endpoints and nics on this host.",
+		Action: status,
+	},
+	{
+		Name:  "networks",
+		Usage: "Inspect the networks.",
+		Subcommands: []cli.Command{
+			{
+				Name:   "ls",
+				Usage:  "List the networks and their subnets.",
+				Flags:  []cli.Flag{jsonFlag},
+				Action: listNetworks,
+			},
+		},
+	},
+	{
+		Name:  "endpoints",
+		Usage: "Inspect the endpoints.",
+		Subcommands: []cli.Command{
+			{
+				Name:  "ls",
+				Usage: "List the endpoints and their nics.",
+				Flags: []cli.Flag{
+					cli.StringFlag{Name: "network", Usage: "Only list the endpoints of the network."},
+					jsonFlag,
+				},
+				Action: listEndpoints,
+			},
+		},
+	},
+	{
+		Name:  "nics",
+		Usage: "Inspect the nics attached to this instance.",
+		Subcommands: []cli.Command{
+			{
+				Name:  "ls",
+				Usage: "List the attached nics and their state.",
+				Flags: []cli.Flag{
+					cli.StringFlag{Name: "vxnet", Usage: "Only list the nics of the vxnet."},
+					cli.StringFlag{Name: "state", Usage: "Only list the nics in the state: in-use, idle, leaked or missing."},
+					jsonFlag,
+				},
+				Action: listNics,
+			},
+		},
+	},
+	{
+		Name:  "sticky",
+		Usage: "Inspect and remove the sticky bindings.",
+		Subcommands: []cli.Command{
+			{
+				Name:   "ls",
+				Usage:  "List the sticky bindings.",
+				Flags:  []cli.Flag{jsonFlag},
+				Action: listSticky,
+			},
+			{
+				Name:      "rm",
+				Usage:     "Remove the sticky bindings of the identities, so that their nics can be detached or used by others.",
+				ArgsUsage: "ID [ID...]",
+				Action:    removeSticky,
+			},
+		},
+	},
+	{
+		Name:   "gc",
+		Usage:  "Remove the expired reservations and reconcile the nics.",
+		Flags:  []cli.Flag{jsonFlag},
+		Action: gc,
+	},
+	{
+		Name:  "reconcile",
+		Usage: "Reconcile the attached nics with the endpoints.",
+		Flags: []cli.Flag{
+			cli.BoolFlag{Name: "dry-run", Usage: "Only show what would be done."},
+			jsonFlag,
+		},
+		Action: reconcile,
+	},
+}
+
+// loadState loads the networks in the data dir.
+func loadState(c *cli.Context) network.Admin {
+	e := setup(c, nil)
+	nd, err := network.Load(e.api, e.nl, e.dir, e.rs, e.networkConfig(c))
+	if err != nil {
+		errExit(1, err.Error())
+	}
+	return nd
+}
+
+// dialPlugin returns a client of the admin API, or nil if the plugin isn't
+// running.
+func dialPlugin(c *cli.Context) *admin.Client {
+	client, err := admin.Dial(adminSock(c))
+	if err != nil {
+		return nil
+	}
+	return client
+}
+
+// stateOf returns the networks and the status of the attached nics from
+// the plugin if it's running, or from the data dir and a dry run of the
+// reconciler otherwise. The nics are filtered by the query parameters
+// vxnet and state if they are set.
+func stateOf(c *cli.Context, client *admin.Client, q url.Values) ([]*network.NetworkInfo, []*network.NicStatus, error) {
+	var networks []*network.NetworkInfo
+	var nics []*network.NicStatus
+	if client != nil {
+		setup(c, nil)
+		if err := client.Call("GET", "/networks", nil, &networks); err != nil {
+			return nil, nil, err
+		}
+		if err := client.Call("GET", "/nics", q, &nics); err != nil {
+			return nil, nil, err
+		}
+		return networks, nics, nil
+	}
+
+	nd := loadState(c)
+	all, err := nd.Reconcile(true)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, nic := range all {
+		if (q.Get("vxnet") == "" || nic.Vxnet == q.Get("vxnet")) && (q.Get("state") == "" || nic.State == q.Get("state")) {
+			nics = append(nics, nic)
+		}
+	}
+	return nd.Networks(), nics, nil
+}
+
+func status(c *cli.Context) error {
+	client := dialPlugin(c)
+	networks, nics, err := stateOf(c, client, nil)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "Instance:\t%s\n", util.InstanceID)
+	fmt.Fprintf(w, "Zone:\t%s\n", c.GlobalString("zone"))
+	fmt.Fprintf(w, "Data dir:\t%s\n", c.GlobalString("data-dir"))
+	if client != nil {
+		fmt.Fprintf(w, "Plugin:\trunning (%s)\n", adminSock(c))
+	} else {
+		fmt.Fprintf(w, "Plugin:\tnot running\n")
+	}
+
+	endpoints, stale := 0, 0
+	for _, n := range networks {
+		endpoints += len(n.Endpoints)
+		for _, ep := range n.Endpoints {
+			if ep.Stale {
+				stale++
+			}
+		}
+	}
+	fmt.Fprintf(w, "Networks:\t%d\n", len(networks))
+	fmt.Fprintf(w, "Endpoints:\t%d (%d stale)\n", endpoints, stale)
+
+	states := make(map[string]int)
+	for _, nic := range nics {
+		states[nic.State]++
+	}
+	var counts []string
+	for state, n := range states {
+		counts = append(counts, fmt.Sprintf("%s %d", state, n))
+	}
+	sort.Strings(counts)
+	fmt.Fprintf(w, "Nics:\t%d (%s)\n", len(nics), strings.Join(counts, ", "))
+	w.Flush()
+
+	if client == nil {
+		return nil
+	}
+	var errs []cloud.APIError
+	if err := client.Call("GET", "/errors", url.Values{"n": {"5"}}, &errs); err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	if len(errs) > 0 {
+		fmt.Println("\nRecent API errors:")
+		w = tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		for _, e := range errs {
+			fmt.Fprintf(w, "%s\t%s\t%d\t%s\n", e.Time.Format("2006-01-02 15:04:05"), e.Action, e.Code, e.Message)
+		}
+		w.Flush()
+	}
+	return nil
+}
+
+func listNetworks(c *cli.Context) error {
+	networks := loadState(c).Networks()
+	if c.Bool("json") {
+		return printJSON(networks)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NETWORK\tVXNET\tPOOL\tGATEWAY\tENDPOINTS")
+	for _, n := range networks {
+		for _, s := range n.Subnets {
+			pool, gw := s.Pool, s.Gateway
+			if s.PoolIPv6 != "" {
+				pool, gw = pool+","+s.PoolIPv6, gw+","+s.GatewayIPv6
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\n", shortID(n.ID), s.Vxnet, pool, gw, len(n.Endpoints))
+		}
+	}
+	return w.Flush()
+}
+
+func listEndpoints(c *cli.Context) error {
+	var eps []*network.EndpointInfo
+	for _, n := range loadState(c).Networks() {
+		if c.String("network") == "" || strings.HasPrefix(n.ID, c.String("network")) {
+			eps = append(eps, n.Endpoints...)
+		}
+	}
+	if c.Bool("json") {
+		return printJSON(eps)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NETWORK\tENDPOINT\tNIC\tVXNET\tIP\tSANDBOX\tSTALE")
+	for _, ep := range eps {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", shortID(ep.NetworkID), shortID(ep.ID), ep.NicID, ep.Vxnet, ep.IP, ep.SandboxKey, strconv.FormatBool(ep.Stale))
+	}
+	return w.Flush()
+}
+
+func listNics(c *cli.Context) error {
+	q := url.Values{}
+	if c.String("vxnet") != "" {
+		q.Set("vxnet", c.String("vxnet"))
+	}
+	if c.String("state") != "" {
+		q.Set("state", c.String("state"))
+	}
+	_, nics, err := stateOf(c, dialPlugin(c), q)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	return printNics(c, nics)
+}
+
+func listSticky(c *cli.Context) error {
+	var bs []*util.StickyBinding
+	if client := dialPlugin(c); client != nil {
+		if err := client.Call("GET", "/sticky", nil, &bs); err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+	} else {
+		var err error
+		if bs, err = loadState(c).StickyBindings(); err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+	}
+	if c.Bool("json") {
+		return printJSON(bs)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tVXNET\tIP\tNIC\tUPDATED")
+	for _, b := range bs {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", b.ID, b.Vxnet, b.Address, b.NicID, b.Updated.Format("2006-01-02 15:04:05"))
+	}
+	return w.Flush()
+}
+
+func removeSticky(c *cli.Context) error {
+	if c.NArg() == 0 {
+		return cli.NewExitError("at least one ID is required", 1)
+	}
+	client := dialPlugin(c)
+	var nd network.Admin
+	if client == nil {
+		nd = loadState(c)
+	}
+	for _, id := range c.Args() {
+		var err error
+		if client != nil {
+			err = client.Call("POST", "/sticky/remove", url.Values{"id": {id}}, nil)
+		} else {
+			err = nd.Unbind(id)
+		}
+		if err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+		fmt.Println(id)
+	}
+	return nil
+}
+
+func gc(c *cli.Context) error {
+	var result *network.GCResult
+	if client := dialPlugin(c); client != nil {
+		if err := client.Call("POST", "/gc", nil, &result); err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+	} else {
+		var err error
+		if result, err = loadState(c).GC(); err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+	}
+	if c.Bool("json") {
+		return printJSON(result)
+	}
+	for _, r := range result.Reservations {
+		fmt.Printf("Removed the expired reservation of %s on nic %s\n", r.Address, r.NicID)
+	}
+	return printNics(c, result.Nics)
+}
+
+func reconcile(c *cli.Context) error {
+	var nics []*network.NicStatus
+	if client := dialPlugin(c); client != nil {
+		q := url.Values{"dry_run": {strconv.FormatBool(c.Bool("dry-run"))}}
+		if err := client.Call("POST", "/reconcile", q, &nics); err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+	} else {
+		var err error
+		if nics, err = loadState(c).Reconcile(c.Bool("dry-run")); err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+	}
+	return printNics(c, nics)
+}
+
+func printNics(c *cli.Context, nics []*network.NicStatus) error {
+	if c.Bool("json") {
+		return printJSON(nics)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NIC\tVXNET\tIP\tSTATE\tLINK\tENDPOINT\tREASON")
+	for _, nic := range nics {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", nic.NicID, nic.Vxnet, nic.IP, nic.State, nic.Link, shortID(nic.EndpointID), nic.Reason)
+	}
+	return w.Flush()
+}
+
+func printJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// shortID truncates a docker ID like docker does.
+func shortID(id string) string {
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
@@ -0,0 +1,91 @@
+package ipam
+
+import (
+	"net"
+
+	"github.com/Sirupsen/logrus"
+	sdktypes "github.com/nicescale/qcsdk/types"
+	"github.com/nicescale/qingcloud-docker-network/cloud"
+	"github.com/nicescale/qingcloud-docker-network/util"
+)
+
+// Allocator allocates nics the same way as the IPAM driver for callers
+// that don't speak the docker IPAM API, e.g. the CNI plugin.
+// The pool of an address is the vxnet. Pools saved by the IPAM driver in
+// root are honored, so that the docker plugin and other callers can share
+// the vxnets, the idle nics and the reservation store of the host.
+// Unlike the IPAM driver, an Allocator doesn't maintain warm pools, but it
+// keeps the idle nics up to the high watermark of the IPAM driver in root
+// when it releases addresses.
+type Allocator struct {
+	d *driver
+}
+
+// Address is an address allocated by an Allocator.
+type Address struct {
+	Nic     *sdktypes.Nic
+	IP      *net.IPNet
+	Gateway net.IP
+}
+
+// NewAllocator creates an Allocator. See New for the arguments. The
+// watermarks of cfg are only used if the IPAM driver hasn't saved its own
+// in root.
+func NewAllocator(api cloud.API, nl util.Netlink, root string, rs *util.ReservationStore, cfg Config) *Allocator {
+	if err := loadWatermarks(root, &cfg); err != nil {
+		logrus.Warnf("Failed to load the watermarks of the IPAM driver: %v", err)
+	}
+	return &Allocator{d: newDriver(api, nl, root, rs, cfg)}
+}
+
+// Allocate reserves a nic of the vxnet for ip, attaching one to the
+// instance if no idle nic is available. Any address is chosen if ip is
+// empty. The reservation must be claimed by the caller before it expires.
+//
+// If stickyID is not empty and ip is empty, the address last used by the
+// identity is allocated again, and the binding of the identity is updated.
+func (a *Allocator) Allocate(vxnet, ip, stickyID string) (*Address, error) {
+	p, err := a.d.getPool(vxnet)
+	if err != nil {
+		return nil, err
+	}
+
+	if stickyID != "" && ip == "" {
+		if _, ip, err = a.d.boundAddress(stickyID, vxnet); err != nil {
+			return nil, err
+		}
+	}
+	nic, err := a.d.findOrCreateNic(p, ip)
+	if err != nil {
+		return nil, err
+	}
+	if stickyID != "" {
+		if err := a.d.bind(stickyID, nic); err != nil {
+			a.d.releaseAddress(p, nic.PrivateIP)
+			return nil, err
+		}
+	}
+
+	return &Address{
+		Nic:     nic,
+		IP:      &net.IPNet{IP: nic.PrivateIP, Mask: p.Subnet.Mask},
+		Gateway: p.Gateway,
+	}, nil
+}
+
+// Release removes the reservation of ip and releases its nic according
+// to the release policy of the pool. The expired sticky bindings of the
+// vxnet are removed as well, since there is no warm pool to do it.
+func (a *Allocator) Release(vxnet string, ip net.IP) error {
+	p, err := a.d.getPool(vxnet)
+	if err != nil {
+		return err
+	}
+	if err := a.d.releaseAddress(p, ip); err != nil {
+		return err
+	}
+	if err := a.d.expireSticky(p); err != nil {
+		logrus.Errorf("Failed to expire the sticky bindings of vxnet %s: %v", vxnet, err)
+	}
+	return nil
+}
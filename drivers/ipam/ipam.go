@@ -3,6 +3,8 @@ package ipam
 import (
 	"fmt"
 	"math/rand"
+	"net"
+	"strings"
 	"sync"
 	"time"
 
@@ -10,19 +12,97 @@ import (
 	"github.com/docker/go-plugins-helpers/ipam"
 	"github.com/nicescale/qcsdk"
 	sdktypes "github.com/nicescale/qcsdk/types"
+	"github.com/nicescale/qingcloud-docker-network/cloud"
+	"github.com/nicescale/qingcloud-docker-network/metrics"
 	"github.com/nicescale/qingcloud-docker-network/util"
 )
 
 var errNoAvailableNic = fmt.Errorf("no available nic")
 
+// Config holds the tunables of the IPAM driver.
+type Config struct {
+	// LinkTimeout is how long to wait for the link of an attached nic
+	// to show up in the host.
+	LinkTimeout time.Duration
+
+	// WarmLow and WarmHigh are the default watermarks of idle nics
+	// kept attached for each vxnet. See warmPool.
+	WarmLow  int
+	WarmHigh int
+	// WarmInterval is how often the warm pools are checked.
+	WarmInterval time.Duration
+
+	// StickyTTL is how long a sticky binding holds the nic of a released
+	// address. The nic is then released according to the release policy
+	// of its pool. Bindings never expire if it's 0.
+	StickyTTL time.Duration
+
+	// LeaseInterval is how often the leases of the attached nics are
+	// renewed. No leases are published if it's 0, so the nics can't be
+	// taken over by other instances.
+	LeaseInterval time.Duration
+	// RefuseTakeover makes the leases refuse any takeover.
+	RefuseTakeover bool
+	// TakeoverTimeout is how long to wait for a nic taken over from
+	// another instance to be detached.
+	TakeoverTimeout time.Duration
+
+	// Host guards the routing of the host against the links of the
+	// attached nics. The links are left alone if it's nil.
+	Host *util.HostGuard
+}
+
 type driver struct {
-	api     *qcsdk.Api
+	api    cloud.API
+	nl     util.Netlink
+	root   string // The root path to store IPAM files.
+	rs     *util.ReservationStore
+	sticky *util.StickyStore
+	cfg    Config
+	nics   *nicManager
+	warm   *warmPool
+	leases *leaseKeeper
+	// nicLock serializes counting, reserving, attaching and detaching the
+	// nics of the instance. The nics of released addresses are detached
+	// without it once nicManager.plan has hidden them from the others.
 	nicLock sync.Mutex
+	// attaching are the available nics that the warm pool is attaching
+	// without nicLock. Guarded by nicLock.
+	attaching map[string]bool
+	pools     map[string]*addressPool
+	poolLock  sync.Mutex
 }
 
-func New(api *qcsdk.Api) ipam.Ipam {
+func New(api cloud.API, nl util.Netlink, root string, rs *util.ReservationStore, cfg Config) (ipam.Ipam, error) {
+	d := newDriver(api, nl, root, rs, cfg)
+	if err := d.loadPools(); err != nil {
+		return nil, err
+	}
+	if err := saveWatermarks(root, cfg); err != nil {
+		return nil, fmt.Errorf("failed to save the watermarks: %v", err)
+	}
+	d.warm = newWarmPool(d, cfg.WarmInterval)
+	go d.warm.run()
+	if cfg.LeaseInterval > 0 {
+		d.leases = newLeaseKeeper(d, cfg.LeaseInterval, cfg.RefuseTakeover)
+		go d.leases.run()
+	}
+	return d, nil
+}
+
+func newDriver(api cloud.API, nl util.Netlink, root string, rs *util.ReservationStore, cfg Config) *driver {
+	sticky := util.NewStickyStore(root)
 	return &driver{
-		api: api,
+		api:    api,
+		nl:     nl,
+		root:   root,
+		rs:     rs,
+		sticky: sticky,
+		cfg:    cfg,
+		nics:   &nicManager{api: api, nl: nl, rs: rs, sticky: sticky, host: cfg.Host, releasing: make(map[string]bool)},
+		pools:  make(map[string]*addressPool),
+
+		attaching: make(map[string]bool),
 	}
 }
 
@@ -44,57 +124,251 @@ func (d *driver) RequestPool(req *ipam.RequestPoolRequest) (*ipam.RequestPoolRes
 	if req.Options == nil || req.Options["vxnet"] == "" {
 		return nil, fmt.Errorf("--ipam-opt vxnet=xxx must be provided")
 	}
-	return &ipam.RequestPoolResponse{
-		PoolID: req.Options["vxnet"],
-		Pool:   req.Pool,
-	}, nil
+	vxnets := util.SplitVxnets(req.Options["vxnet"])
+	if len(vxnets) == 0 {
+		return nil, fmt.Errorf("--ipam-opt vxnet=xxx must be provided")
+	}
+	v, err := d.selectVxnet(vxnets, req.Pool, req.V6)
+	if err != nil {
+		return nil, err
+	}
+	overflow := overflowAfter(vxnets, v.ID)
+	if req.V6 {
+		return d.requestPool6(req, v, overflow)
+	}
+	p := newPool(v.ID, v)
+	p.Overflow = overflow
+	p.AllowMismatch = util.BoolOpt(req.Options, util.OptAllowSubnetMismatch)
+	if policy := req.Options[optReleasePolicy]; policy != "" {
+		if err := validReleasePolicy(policy); err != nil {
+			return nil, err
+		}
+		p.ReleasePolicy = policy
+	}
+	if p.WarmLow, err = parseWatermark(req.Options, optWarmLow); err != nil {
+		return nil, err
+	}
+	if p.WarmHigh, err = parseWatermark(req.Options, optWarmHigh); err != nil {
+		return nil, err
+	}
+	p.Takeover = util.BoolOpt(req.Options, optTakeover)
+	if _, ok := req.Options[util.OptStickyID]; ok {
+		// The identity of a network would be shared by its containers.
+		return nil, fmt.Errorf("%s is an endpoint option. Use --driver-opt %s=<id> on each container instead", util.OptStickyID, util.OptStickyID)
+	}
+	if err := util.CheckVxnetNetwork(v, req.Pool, ""); err != nil {
+		if !p.AllowMismatch {
+			return nil, fmt.Errorf("%v. Use --ipam-opt %s=true to override", err, util.OptAllowSubnetMismatch)
+		}
+		logrus.Warnf("ipam.RequestPool: %v", err)
+		if _, p.Subnet, err = net.ParseCIDR(req.Pool); err != nil {
+			return nil, fmt.Errorf("invalid pool %q: %v", req.Pool, err)
+		}
+		if !p.Subnet.Contains(p.Gateway) {
+			p.Gateway = nil
+		}
+	}
+	if err := d.savePool(p); err != nil {
+		return nil, err
+	}
+	d.warm.kick()
+	return poolResponse(p), nil
+}
+
+// requestPool6 creates the IPv6 pool of a dual-stack vxnet.
+func (d *driver) requestPool6(req *ipam.RequestPoolRequest, v *sdktypes.Vxnet, overflow []string) (*ipam.RequestPoolResponse, error) {
+	p, err := newPool6(v)
+	if err != nil {
+		return nil, err
+	}
+	p.Overflow = overflow
+	p.AllowMismatch = util.BoolOpt(req.Options, util.OptAllowSubnetMismatch)
+	if err := util.CheckVxnetIPv6(v, req.Pool, ""); err != nil {
+		if !p.AllowMismatch {
+			return nil, fmt.Errorf("%v. Use --ipam-opt %s=true to override", err, util.OptAllowSubnetMismatch)
+		}
+		logrus.Warnf("ipam.RequestPool: %v", err)
+		if _, p.Subnet, err = net.ParseCIDR(req.Pool); err != nil {
+			return nil, fmt.Errorf("invalid pool %q: %v", req.Pool, err)
+		}
+		if !p.Subnet.Contains(p.Gateway) {
+			p.Gateway = nil
+		}
+	}
+	if err := d.savePool(p); err != nil {
+		return nil, err
+	}
+	return poolResponse(p), nil
+}
+
+// overflowAfter returns the vxnets listed after vxnet, which the addresses
+// of its pool overflow to.
+func overflowAfter(vxnets []string, vxnet string) []string {
+	for i, v := range vxnets {
+		if v == vxnet {
+			return vxnets[i+1:]
+		}
+	}
+	return nil
+}
+
+func poolResponse(p *addressPool) *ipam.RequestPoolResponse {
+	resp := &ipam.RequestPoolResponse{
+		PoolID: p.ID,
+		Pool:   p.Subnet.String(),
+	}
+	if p.Gateway != nil {
+		// Tell libnetwork the gateway so that it won't request one from us.
+		resp.Data = map[string]string{
+			"com.docker.network.gateway": p.cidr(p.Gateway),
+		}
+	}
+	return resp
 }
 
 func (d *driver) ReleasePool(req *ipam.ReleasePoolRequest) error {
 	logrus.WithField("req", req).Debug("ipam.ReleasePool called")
-	return nil
+	return d.releasePool(req.PoolID)
 }
 
 func (d *driver) RequestAddress(req *ipam.RequestAddressRequest) (*ipam.RequestAddressResponse, error) {
 	logrus.WithField("req", req).Debug("ipam.RequestAddress called")
+	p, err := d.getPool(req.PoolID)
+	if err != nil {
+		return nil, err
+	}
+
+	if req.Address != "" {
+		ip := net.ParseIP(req.Address)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid address %s", req.Address)
+		}
+		if !p.Subnet.Contains(ip) {
+			return nil, fmt.Errorf("address %s is out of the subnet %s of vxnet %s", req.Address, p.Subnet, p.Vxnet)
+		}
+	}
+
 	if req.Options != nil && req.Options["RequestAddressType"] == "com.docker.network.gateway" {
+		gw := p.Gateway
+		if req.Address != "" {
+			gw = net.ParseIP(req.Address)
+			if !gw.Equal(p.Gateway) && !p.AllowMismatch {
+				return nil, fmt.Errorf("gateway %s doesn't match the router manager IP %s of vxnet %s. Use --ipam-opt %s=true to override",
+					gw, p.Gateway, p.Vxnet, util.OptAllowSubnetMismatch)
+			}
+		}
+		if gw == nil {
+			return nil, fmt.Errorf("can't determine the gateway of vxnet %s", p.Vxnet)
+		}
 		return &ipam.RequestAddressResponse{
-			Address: req.Address + "/24", // TODO: call qingcloud API to get the mask
+			Address: p.cidr(gw),
 		}, nil
 	}
 
-	nic, err := d.findOrCreateNic(req.PoolID, req.Address)
-	if err != nil {
-		return nil, err
+	if p.V6 {
+		// The IPv4 address may have overflowed to another vxnet.
+		r, err := d.rs.AssignIPv6(append([]string{p.Vxnet}, p.Overflow...), req.Address)
+		if err != nil {
+			return nil, err
+		}
+		return &ipam.RequestAddressResponse{
+			Address: p.cidr(net.ParseIP(r.AddressIPv6)),
+		}, nil
 	}
 
-	links, err := util.LinkList()
+	nic, q, err := d.allocate(p, req.Address)
 	if err != nil {
 		return nil, err
 	}
-	util.NicStore.Add(nic.PrivateIP.String(), links[nic.ID])
+	d.warm.kick()
+	d.leases.kick()
 
 	return &ipam.RequestAddressResponse{
-		Address: nic.PrivateIP.String() + "/24",
+		Address: q.cidr(nic.PrivateIP),
 	}, nil
 }
 
 func (d *driver) ReleaseAddress(req *ipam.ReleaseAddressRequest) error {
 	logrus.WithField("req", req).Debug("ipam.ReleaseAddress called")
+	p, err := d.getPool(req.PoolID)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(strings.Split(req.Address, "/")[0])
+	if ip == nil {
+		return fmt.Errorf("invalid address %s", req.Address)
+	}
+	// The IPv6 address is released with the nic of its IPv4 address.
+	if ip.Equal(p.Gateway) || p.V6 {
+		return nil
+	}
+
+	if p, err = d.poolOf(p, ip); err != nil {
+		return err
+	}
+	return d.releaseAddress(p, ip)
+}
+
+// releaseAddress removes the reservation of ip and releases its nic
+// according to the release policy of the pool.
+func (d *driver) releaseAddress(p *addressPool, ip net.IP) error {
+	// The nic is no longer owned by the endpoint, or it may have been
+	// reserved for an endpoint that failed to be created.
+	if err := d.rs.Remove(p.ID, ip.String()); err != nil {
+		return err
+	}
+	d.leases.kick()
+
+	nics, err := d.api.DescribeNics(qcsdk.Params{"vxnets": p.Vxnet, "instances": util.InstanceID})
+	if err != nil {
+		return err
+	}
+	for _, nic := range nics {
+		if nic.Role != 1 && nic.PrivateIP.Equal(ip) {
+			d.nicLock.Lock()
+			metrics.MoveNic(p.Vxnet, metrics.NicInUse, metrics.NicIdle)
+			_, high := d.watermarks(p)
+			policy, err := d.nics.plan(nic, p.releasePolicy(), high)
+			d.nicLock.Unlock()
+			if err != nil || policy == policyKeep {
+				return err
+			}
+			return d.nics.release(nic, policy)
+		}
+	}
+
+	logrus.Warnf("No nic with address %s is attached to instance %s", ip, util.InstanceID)
 	return nil
 }
 
-func (d *driver) findOrCreateNic(vxnet, ip string) (*sdktypes.Nic, error) {
-	nic, err := d.findAttachedIdleNic(vxnet, ip)
+// findOrCreateNic reserves a nic for ip in the vxnet of p. It holds nicLock
+// so that the warm pool doesn't count or attach the same nics meanwhile.
+func (d *driver) findOrCreateNic(p *addressPool, ip string) (*sdktypes.Nic, error) {
+	d.nicLock.Lock()
+	defer d.nicLock.Unlock()
+
+	nic, err := d.findAttachedIdleNic(p, ip)
 	if err == nil {
+		metrics.NicAllocations.Inc(metrics.SourceIdle)
+		metrics.MoveNic(p.Vxnet, metrics.NicIdle, metrics.NicInUse)
 		return nic, nil
 	}
+	if err != errNoAvailableNic {
+		return nil, err
+	}
+
+	vxnet := p.Vxnet
 
 	var ips []string
+	source := metrics.SourceAvailable
 	if ip == "" {
 		nic, err = d.findRandomAvailableNic(vxnet)
 	} else {
 		nic, err = d.findAvailableNicByIP(vxnet, ip)
+		if err == errNoAvailableNic && p.Takeover {
+			nic, err = d.takeover(vxnet, ip)
+			source = metrics.SourceTakeover
+		}
 		ips = append(ips, ip)
 	}
 	if err != nil && err != errNoAvailableNic {
@@ -103,57 +377,78 @@ func (d *driver) findOrCreateNic(vxnet, ip string) (*sdktypes.Nic, error) {
 
 	// Create a network interface and attach it to the instance.
 	if err == errNoAvailableNic {
-		nics, err := d.api.CreateNics(vxnet, "", 1, ips)
+		nics, err := d.api.CreateNics(vxnet, util.NicName, 1, ips)
 		if err != nil {
 			return nil, err
 		}
 		nic = nics[0]
+		source = metrics.SourceCreated
 	}
 
 	if _, err := d.api.AttachNics([]string{nic.ID}, util.InstanceID, true); err != nil {
 		return nil, err
 	}
-	return nic, nil
-}
-
-func (d *driver) findAttachedIdleNic(vxnet, ip string) (*sdktypes.Nic, error) {
-	nics, err := d.api.DescribeNics(qcsdk.Params{"vxnets": vxnet, "instances": util.InstanceID})
+	// The attach job may finish before the kernel registers the device.
+	// The link of the host guard is brought up by the guard, if at all.
+	link, err := d.nl.WaitForLink(nic.ID, d.cfg.LinkTimeout, d.cfg.Host == nil)
 	if err != nil {
 		return nil, err
 	}
+	if err := d.cfg.Host.PrepareIdle(link, nic.VxnetID, nic.PrivateIP); err != nil {
+		logrus.WithField("nic", nic.ID).Errorf("Failed to prepare the link of the nic: %v", err)
+	}
+	if err := d.reserve(p, nic); err != nil {
+		return nil, err
+	}
+	metrics.NicAllocations.Inc(source)
+	metrics.MoveNic(p.Vxnet, "", metrics.NicInUse)
+	return nic, nil
+}
 
-	m, err := util.LinkList()
+// findAttachedIdleNic reserves an idle nic that's already attached to
+// the instance. If ip is not empty only the nic with that address is used,
+// which may be held by a sticky binding. The caller holds nicLock.
+func (d *driver) findAttachedIdleNic(p *addressPool, ip string) (*sdktypes.Nic, error) {
+	var nics []*sdktypes.Nic
+	var err error
+	if ip == "" {
+		nics, err = d.nics.idleNics(p.Vxnet)
+	} else {
+		nics, err = d.nics.unreservedNics(p.Vxnet)
+	}
 	if err != nil {
 		return nil, err
 	}
-
-	var preferedNic *sdktypes.Nic
-	d.nicLock.Lock()
-	defer d.nicLock.Unlock()
 	for _, nic := range nics {
-		if nic.Role == 1 {
-			// Role == 1 means the interface is used by the VM
-			continue
-		}
-		if m[nic.ID] == nil {
-			continue
-		}
 		if ip != "" && nic.PrivateIP.String() != ip {
 			continue
 		}
-
-		preferedNic = nic
-		break
+		if err := d.reserve(p, nic); err != nil {
+			// Another process sharing the store took it.
+			if err == util.ErrReserved {
+				continue
+			}
+			return nil, err
+		}
+		return nic, nil
 	}
+	return nil, errNoAvailableNic
+}
 
-	if preferedNic == nil {
-		return nil, errNoAvailableNic
+func (d *driver) reserve(p *addressPool, nic *sdktypes.Nic) error {
+	r := &util.Reservation{
+		PoolID:  p.ID,
+		Address: nic.PrivateIP.String(),
+		NicID:   nic.ID,
+	}
+	if nic.PrivateIPv6 != nil {
+		r.AddressIPv6 = nic.PrivateIPv6.String()
 	}
-	return preferedNic, nil
+	return d.rs.Add(r)
 }
 
 func (d *driver) findRandomAvailableNic(vxnet string) (*sdktypes.Nic, error) {
-	nics, err := d.api.DescribeNics(qcsdk.Params{"status": "available", "vxnets": vxnet})
+	nics, err := d.availableNics(vxnet)
 	if err != nil {
 		return nil, err
 	}
@@ -179,10 +474,32 @@ func (d *driver) findAvailableNicByIP(vxnet, ip string) (*sdktypes.Nic, error) {
 	}
 
 	for _, nic := range nics {
-		if nic.PrivateIP.String() == ip {
+		if nic.PrivateIP.String() == ip && !d.attaching[nic.ID] {
 			return nic, nil
 		}
 	}
 
 	return nil, errNoAvailableNic
 }
+
+// availableNics returns the nics of the vxnet that are not attached to any
+// instance, except the ones held by a sticky binding or being attached by
+// the warm pool.
+func (d *driver) availableNics(vxnet string) ([]*sdktypes.Nic, error) {
+	nics, err := d.api.DescribeNics(qcsdk.Params{"status": "available", "vxnets": vxnet})
+	if err != nil {
+		return nil, err
+	}
+	held, err := d.sticky.Held()
+	if err != nil {
+		return nil, err
+	}
+
+	var available []*sdktypes.Nic
+	for _, nic := range nics {
+		if !held[nic.ID] && !d.attaching[nic.ID] {
+			available = append(available, nic)
+		}
+	}
+	return available, nil
+}
@@ -0,0 +1,693 @@
+package ipam
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/ipam"
+	"github.com/nicescale/qcsdk"
+	sdktypes "github.com/nicescale/qcsdk/types"
+	"github.com/nicescale/qingcloud-docker-network/cloud/fake"
+	"github.com/nicescale/qingcloud-docker-network/util"
+	"github.com/nicescale/qingcloud-docker-network/util/nltest"
+)
+
+const (
+	testInstance = "i-test"
+	testVxnet    = "vxnet-a"
+	testPool     = "192.168.0.0/24"
+)
+
+type testEnv struct {
+	d   *driver
+	c   *fake.Cloud
+	nl  *nltest.Memory
+	dir string
+}
+
+func newTestEnv(t *testing.T, cfg Config) *testEnv {
+	util.InstanceID = testInstance
+	dir, err := ioutil.TempDir("", "ipam-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := fake.New()
+	c.AddVxnet(testVxnet, testPool)
+	nl := nltest.NewMemory()
+	c.OnAttach, c.OnDetach = nl.AttachHook(), nl.DetachHook()
+	if cfg.LinkTimeout == 0 {
+		cfg.LinkTimeout = time.Second
+	}
+	rs := util.NewReservationStore(dir, time.Minute)
+	return &testEnv{d: newDriver(c, nl, dir, rs, cfg), c: c, nl: nl, dir: dir}
+}
+
+func (e *testEnv) close() {
+	os.RemoveAll(e.dir)
+}
+
+func (e *testEnv) requestPool(t *testing.T, opts map[string]string) string {
+	if opts == nil {
+		opts = make(map[string]string)
+	}
+	opts["vxnet"] = testVxnet
+	resp, err := e.d.RequestPool(&ipam.RequestPoolRequest{Pool: testPool, Options: opts})
+	if err != nil {
+		t.Fatalf("RequestPool: %v", err)
+	}
+	return resp.PoolID
+}
+
+// addNic adds a nic with the address in the vxnet. It's attached to the
+// instance and its link is in the host if attached is true.
+func (e *testEnv) addNic(t *testing.T, ip string, attached bool) *sdktypes.Nic {
+	nic := &sdktypes.Nic{VxnetID: testVxnet, PrivateIP: net.ParseIP(ip)}
+	if attached {
+		nic.Status, nic.InstanceID = "in-use", testInstance
+	}
+	nic = e.c.AddNic(nic)
+	if attached {
+		if _, err := e.nl.AddLink(nic.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return nic
+}
+
+func (e *testEnv) reservations(t *testing.T) []*util.Reservation {
+	rs, err := e.d.rs.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rs
+}
+
+func TestRequestAddress(t *testing.T) {
+	tests := []struct {
+		name    string
+		setup   func(t *testing.T, e *testEnv)
+		address string
+		// want is the allocated address, or the error if err is set.
+		want    string
+		err     bool
+		creates int
+		attachs int
+	}{
+		{
+			name:  "idle attached nic",
+			setup: func(t *testing.T, e *testEnv) { e.addNic(t, "192.168.0.10", true) },
+			want:  "192.168.0.10/24",
+		},
+		{
+			name:    "available nic",
+			setup:   func(t *testing.T, e *testEnv) { e.addNic(t, "192.168.0.11", false) },
+			want:    "192.168.0.11/24",
+			attachs: 1,
+		},
+		{
+			name: "requested address",
+			setup: func(t *testing.T, e *testEnv) {
+				e.addNic(t, "192.168.0.12", false)
+				e.addNic(t, "192.168.0.13", false)
+			},
+			address: "192.168.0.13",
+			want:    "192.168.0.13/24",
+			attachs: 1,
+		},
+		{
+			name:    "new nic",
+			want:    "192.168.0.2/24",
+			creates: 1,
+			attachs: 1,
+		},
+		{
+			name:    "new nic with requested address",
+			address: "192.168.0.20",
+			want:    "192.168.0.20/24",
+			creates: 1,
+			attachs: 1,
+		},
+		{
+			name: "attach failure",
+			setup: func(t *testing.T, e *testEnv) {
+				e.c.InjectError("AttachNics", sdktypes.ResponseStatus{Code: fake.CodeInternalError, Message: "internal error"})
+			},
+			want:    "internal error",
+			err:     true,
+			creates: 1,
+			attachs: 1,
+		},
+		{
+			name: "job timeout",
+			setup: func(t *testing.T, e *testEnv) {
+				e.c.JobLatency = 200 * time.Millisecond
+				e.c.WaitTimeout = 20 * time.Millisecond
+			},
+			want:    sdktypes.ErrJobTimeout.Error(),
+			err:     true,
+			creates: 1,
+			attachs: 1,
+		},
+		{
+			name: "link timeout",
+			setup: func(t *testing.T, e *testEnv) {
+				e.c.OnAttach = nil
+				e.d.cfg.LinkTimeout = 20 * time.Millisecond
+			},
+			want:    "didn't come up",
+			err:     true,
+			creates: 1,
+			attachs: 1,
+		},
+		{
+			name:    "address out of the pool",
+			address: "10.0.0.1",
+			want:    "out of the subnet",
+			err:     true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEnv(t, Config{})
+			defer e.close()
+			poolID := e.requestPool(t, nil)
+			if tt.setup != nil {
+				tt.setup(t, e)
+			}
+
+			resp, err := e.d.RequestAddress(&ipam.RequestAddressRequest{PoolID: poolID, Address: tt.address})
+			if tt.err {
+				if err == nil || !strings.Contains(err.Error(), tt.want) {
+					t.Fatalf("RequestAddress error = %v, want %q", err, tt.want)
+				}
+				if rs := e.reservations(t); len(rs) != 0 {
+					t.Errorf("%d reservations left after a failed request", len(rs))
+				}
+			} else {
+				if err != nil {
+					t.Fatalf("RequestAddress: %v", err)
+				}
+				if resp.Address != tt.want {
+					t.Fatalf("address = %s, want %s", resp.Address, tt.want)
+				}
+				rs := e.reservations(t)
+				if len(rs) != 1 || rs[0].Address != strings.Split(tt.want, "/")[0] || rs[0].EndpointID != "" {
+					t.Fatalf("reservations = %+v, want an unclaimed one of %s", rs, tt.want)
+				}
+				nic := e.c.Nic(rs[0].NicID)
+				if nic.Status != "in-use" || nic.InstanceID != testInstance {
+					t.Errorf("nic %s is %s on %q, want in-use on %s", nic.ID, nic.Status, nic.InstanceID, testInstance)
+				}
+				if e.nl.Link(nic.ID) == nil {
+					t.Errorf("link of nic %s not found", nic.ID)
+				}
+			}
+			if n := e.c.Calls("CreateNics"); n != tt.creates {
+				t.Errorf("CreateNics called %d times, want %d", n, tt.creates)
+			}
+			if n := e.c.Calls("AttachNics"); n != tt.attachs {
+				t.Errorf("AttachNics called %d times, want %d", n, tt.attachs)
+			}
+		})
+	}
+}
+
+func TestReleaseAddress(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   string
+		warmHigh int
+		// status is the status of the nic after the release, or "" if it
+		// has been deleted.
+		status string
+	}{
+		{name: "keep", policy: policyKeep, warmHigh: 1, status: "in-use"},
+		{name: "keep over the watermark", policy: policyKeep, status: "available"},
+		{name: "detach", policy: policyDetach, warmHigh: 1, status: "available"},
+		{name: "delete", policy: policyDelete, warmHigh: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEnv(t, Config{WarmHigh: tt.warmHigh})
+			defer e.close()
+			poolID := e.requestPool(t, map[string]string{optReleasePolicy: tt.policy})
+			nic := e.addNic(t, "192.168.0.10", true)
+
+			resp, err := e.d.RequestAddress(&ipam.RequestAddressRequest{PoolID: poolID})
+			if err != nil {
+				t.Fatalf("RequestAddress: %v", err)
+			}
+			if err := e.d.ReleaseAddress(&ipam.ReleaseAddressRequest{PoolID: poolID, Address: resp.Address}); err != nil {
+				t.Fatalf("ReleaseAddress: %v", err)
+			}
+
+			if rs := e.reservations(t); len(rs) != 0 {
+				t.Errorf("reservations = %+v, want none", rs)
+			}
+			got := e.c.Nic(nic.ID)
+			switch {
+			case tt.status == "" && got != nil:
+				t.Errorf("nic %s is %s, want deleted", nic.ID, got.Status)
+			case tt.status != "" && (got == nil || got.Status != tt.status):
+				t.Errorf("nic %s = %+v, want %s", nic.ID, got, tt.status)
+			}
+		})
+	}
+}
+
+func TestReleaseKeptLink(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy string
+		up     bool
+	}{
+		{name: "no guard", up: false},
+		{name: "idle links down", policy: util.IdleLinkDown, up: false},
+		{name: "idle links up", policy: util.IdleLinkUp, up: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEnv(t, Config{WarmHigh: 1})
+			defer e.close()
+			if tt.policy != "" {
+				g, err := util.NewHostGuard(e.c, e.nl, tt.policy)
+				if err != nil {
+					t.Fatal(err)
+				}
+				e.d.cfg.Host, e.d.nics.host = g, g
+			}
+			poolID := e.requestPool(t, map[string]string{optReleasePolicy: policyKeep})
+			nic := e.addNic(t, "192.168.0.10", true)
+			resp, err := e.d.RequestAddress(&ipam.RequestAddressRequest{PoolID: poolID})
+			if err != nil {
+				t.Fatalf("RequestAddress: %v", err)
+			}
+			// The endpoint renamed the link and docker brought it up.
+			if err := e.nl.RenameLink(e.nl.Link(nic.ID), "0123456789ab"); err != nil {
+				t.Fatal(err)
+			}
+			if err := e.nl.LinkSetUp(e.nl.Link(nic.ID)); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := e.d.ReleaseAddress(&ipam.ReleaseAddressRequest{PoolID: poolID, Address: resp.Address}); err != nil {
+				t.Fatalf("ReleaseAddress: %v", err)
+			}
+			link := e.nl.Link(nic.ID)
+			if name := util.CanonicalNicName(nic.ID); link.Attrs().Name != name {
+				t.Errorf("kept link is named %s, want %s", link.Attrs().Name, name)
+			}
+			if up := link.Attrs().Flags&net.FlagUp != 0; up != tt.up {
+				t.Errorf("kept link up = %v, want %v", up, tt.up)
+			}
+		})
+	}
+}
+
+// TestReleaseOutsideNicLock checks that the nic of a released address is
+// deleted without blocking the allocations meanwhile.
+func TestReleaseOutsideNicLock(t *testing.T) {
+	e := newTestEnv(t, Config{})
+	defer e.close()
+	poolID := e.requestPool(t, map[string]string{optReleasePolicy: policyDelete})
+	nic := e.addNic(t, "192.168.0.10", true)
+	e.addNic(t, "192.168.0.11", true)
+	resp, err := e.d.RequestAddress(&ipam.RequestAddressRequest{PoolID: poolID, Address: "192.168.0.10"})
+	if err != nil {
+		t.Fatalf("RequestAddress: %v", err)
+	}
+
+	e.c.JobLatency = 300 * time.Millisecond
+	released := make(chan error, 1)
+	go func() {
+		released <- e.d.ReleaseAddress(&ipam.ReleaseAddressRequest{PoolID: poolID, Address: resp.Address})
+	}()
+	for e.c.Calls("DetachNics") == 0 {
+		select {
+		case err := <-released:
+			t.Fatalf("ReleaseAddress returned %v before deleting the nic", err)
+		case <-time.After(time.Millisecond):
+		}
+	}
+
+	// The nic being deleted must not be handed out again.
+	r, err := e.d.RequestAddress(&ipam.RequestAddressRequest{PoolID: poolID})
+	if err != nil || r.Address != "192.168.0.11/24" {
+		t.Errorf("RequestAddress while deleting = %+v, %v, want 192.168.0.11/24", r, err)
+	}
+	select {
+	case err = <-released:
+		t.Errorf("RequestAddress waited for nic %s to be deleted", nic.ID)
+	default:
+		err = <-released
+	}
+	if err != nil {
+		t.Fatalf("ReleaseAddress: %v", err)
+	}
+	if got := e.c.Nic(nic.ID); got != nil {
+		t.Errorf("released nic is %s, want deleted", got.Status)
+	}
+}
+
+// waitForLinks waits for the links of the attached nics of the vxnet to
+// be plugged by the hook of the fake cloud.
+func (e *testEnv) waitForLinks(t *testing.T, n int) []*sdktypes.Nic {
+	deadline := time.Now().Add(time.Second)
+	for {
+		nics, err := e.c.DescribeNics(qcsdk.Params{"vxnets": testVxnet, "instances": testInstance})
+		if err != nil {
+			t.Fatal(err)
+		}
+		linked := 0
+		for _, nic := range nics {
+			if e.nl.Link(nic.ID) != nil {
+				linked++
+			}
+		}
+		if linked == n && len(nics) == n {
+			return nics
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d of %d nics attached with links, want %d", linked, len(nics), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestWarmFillOutsideNicLock checks that the warm pool attaches nics
+// without blocking the allocations meanwhile.
+func TestWarmFillOutsideNicLock(t *testing.T) {
+	e := newTestEnv(t, Config{WarmLow: 2, WarmHigh: 2})
+	defer e.close()
+	e.d.warm = newWarmPool(e.d, time.Hour)
+	poolID := e.requestPool(t, nil)
+	p, err := e.d.getPool(poolID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.addNic(t, "192.168.0.10", true)
+
+	e.c.JobLatency = 300 * time.Millisecond
+	filled := make(chan error, 1)
+	go func() { filled <- e.d.warm.fill(p) }()
+	for e.c.Calls("AttachNics") == 0 {
+		select {
+		case err := <-filled:
+			t.Fatalf("fill returned %v before attaching nics", err)
+		case <-time.After(time.Millisecond):
+		}
+	}
+
+	r, err := e.d.RequestAddress(&ipam.RequestAddressRequest{PoolID: poolID})
+	if err != nil || r.Address != "192.168.0.10/24" {
+		t.Errorf("RequestAddress while filling = %+v, %v, want the idle 192.168.0.10/24", r, err)
+	}
+	select {
+	case err = <-filled:
+		t.Errorf("RequestAddress waited for the warm nics to be attached")
+	default:
+		err = <-filled
+	}
+	if err != nil {
+		t.Fatalf("fill: %v", err)
+	}
+	if n := e.c.Calls("CreateNics"); n != 1 {
+		t.Errorf("CreateNics called %d times, want 1", n)
+	}
+	if n := e.d.warm.pending[testVxnet]; n != 0 || len(e.d.attaching) != 0 {
+		t.Errorf("%d nics pending and %v attaching after the fill", n, e.d.attaching)
+	}
+}
+
+func TestReleasePoolDetachesWarmNics(t *testing.T) {
+	e := newTestEnv(t, Config{WarmLow: 2, WarmHigh: 2})
+	defer e.close()
+	e.d.warm = newWarmPool(e.d, time.Hour)
+	poolID := e.requestPool(t, nil)
+	p, err := e.d.getPool(poolID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.d.warm.fill(p); err != nil {
+		t.Fatalf("fill: %v", err)
+	}
+	warm := e.waitForLinks(t, 2)
+
+	if err := e.d.ReleasePool(&ipam.ReleasePoolRequest{PoolID: poolID}); err != nil {
+		t.Fatalf("ReleasePool: %v", err)
+	}
+	for _, nic := range warm {
+		if got := e.c.Nic(nic.ID); got.Status != "available" {
+			t.Errorf("warm nic %s is %s after the pool is released, want available", nic.ID, got.Status)
+		}
+	}
+}
+
+func TestAllocatorWatermarks(t *testing.T) {
+	tests := []struct {
+		name string
+		// saved is the high watermark saved by the IPAM driver, if not
+		// negative.
+		saved  int
+		cfg    int
+		status string
+	}{
+		{name: "saved by the driver", saved: 1, status: "in-use"},
+		{name: "saved zero", saved: 0, cfg: DefaultWarmHigh, status: "available"},
+		{name: "not saved", saved: -1, cfg: DefaultWarmHigh, status: "in-use"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEnv(t, Config{})
+			defer e.close()
+			if tt.saved >= 0 {
+				if err := saveWatermarks(e.dir, Config{WarmHigh: tt.saved}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			a := NewAllocator(e.c, e.nl, e.dir, e.d.rs, Config{LinkTimeout: time.Second, WarmHigh: tt.cfg})
+			nic := e.addNic(t, "192.168.0.10", true)
+
+			addr, err := a.Allocate(testVxnet, "", "")
+			if err != nil {
+				t.Fatalf("Allocate: %v", err)
+			}
+			if err := a.Release(testVxnet, addr.IP.IP); err != nil {
+				t.Fatalf("Release: %v", err)
+			}
+			if got := e.c.Nic(nic.ID); got.Status != tt.status {
+				t.Errorf("nic %s is %s, want %s", nic.ID, got.Status, tt.status)
+			}
+		})
+	}
+}
+
+func TestSticky(t *testing.T) {
+	e := newTestEnv(t, Config{StickyTTL: time.Hour})
+	defer e.close()
+	opts := map[string]string{"vxnet": testVxnet, util.OptStickyID: "web"}
+	if _, err := e.d.RequestPool(&ipam.RequestPoolRequest{Pool: testPool, Options: opts}); err == nil {
+		t.Errorf("RequestPool with the network option %s succeeded", util.OptStickyID)
+	}
+	poolID := e.requestPool(t, map[string]string{optReleasePolicy: policyDelete})
+	e.addNic(t, "192.168.0.10", true)
+	e.addNic(t, "192.168.0.11", true)
+	a := &Allocator{d: e.d}
+
+	// Each container of the network gets its own nic back when recreated.
+	bound := make(map[string]string)
+	for i := 0; i < 3; i++ {
+		for _, id := range []string{"web-0", "web-1"} {
+			addr, err := a.Allocate(testVxnet, "", id)
+			if err != nil {
+				t.Fatalf("Allocate for %s: %v", id, err)
+			}
+			if nicID := bound[id]; nicID != "" && nicID != addr.Nic.ID {
+				t.Fatalf("%s got nic %s, want the bound %s", id, addr.Nic.ID, nicID)
+			}
+			bound[id] = addr.Nic.ID
+		}
+		if bound["web-0"] == bound["web-1"] {
+			t.Fatalf("both containers got nic %s", bound["web-0"])
+		}
+		for _, id := range []string{"web-0", "web-1"} {
+			if err := a.Release(testVxnet, e.c.Nic(bound[id]).PrivateIP); err != nil {
+				t.Fatalf("Release for %s: %v", id, err)
+			}
+			if nic := e.c.Nic(bound[id]); nic.Status != "in-use" {
+				t.Errorf("nic bound to %s is %s after the release, want in-use", id, nic.Status)
+			}
+		}
+	}
+
+	// The binding of web-0 expires and its nic is released by the policy.
+	b, err := e.d.sticky.Get("web-0")
+	if err != nil || b == nil || b.Released.IsZero() {
+		t.Fatalf("binding = %+v, %v, want a released one", b, err)
+	}
+	b.Released = time.Now().Add(-2 * time.Hour)
+	if err := e.d.sticky.Set(b); err != nil {
+		t.Fatal(err)
+	}
+	p, err := e.d.getPool(poolID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.d.expireSticky(p); err != nil {
+		t.Fatalf("expireSticky: %v", err)
+	}
+	if b, err := e.d.sticky.Get("web-0"); err != nil || b != nil {
+		t.Errorf("expired binding = %+v, %v, want none", b, err)
+	}
+	if nic := e.c.Nic(bound["web-0"]); nic != nil {
+		t.Errorf("nic of the expired binding = %+v, want it deleted", nic)
+	}
+	if b, err := e.d.sticky.Get("web-1"); err != nil || b == nil || b.NicID != bound["web-1"] {
+		t.Errorf("binding of web-1 = %+v, %v, want nic %s", b, err, bound["web-1"])
+	}
+	if nic := e.c.Nic(bound["web-1"]); nic.Status != "in-use" {
+		t.Errorf("nic bound to web-1 is %s, want in-use", nic.Status)
+	}
+}
+
+func TestNewLinkState(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy string
+		up     bool
+	}{
+		{name: "no host guard", up: true},
+		{name: "idle link down", policy: util.IdleLinkDown},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEnv(t, Config{})
+			defer e.close()
+			if tt.policy != "" {
+				host, err := util.NewHostGuard(e.c, e.nl, tt.policy)
+				if err != nil {
+					t.Fatal(err)
+				}
+				e.d.cfg.Host = host
+				// The guard can't take the link down again if it's
+				// brought up when it appears.
+				e.nl.InjectError("LinkSetDown", fmt.Errorf("link set down"))
+			}
+			poolID := e.requestPool(t, nil)
+			if _, err := e.d.RequestAddress(&ipam.RequestAddressRequest{PoolID: poolID}); err != nil {
+				t.Fatalf("RequestAddress: %v", err)
+			}
+
+			rs := e.reservations(t)
+			if len(rs) != 1 {
+				t.Fatalf("reservations = %+v, want one", rs)
+			}
+			link := e.nl.Link(rs[0].NicID)
+			if up := link.Attrs().Flags&net.FlagUp != 0; up != tt.up {
+				t.Errorf("link of the new nic is up: %v, want %v", up, tt.up)
+			}
+		})
+	}
+}
+
+func TestRequestPoolMismatch(t *testing.T) {
+	tests := []struct {
+		name    string
+		pool    string
+		allow   bool
+		err     bool
+		gateway bool
+	}{
+		{name: "match", pool: testPool, gateway: true},
+		{name: "mismatch", pool: "10.0.0.0/24", err: true},
+		{name: "allowed mismatch", pool: "10.0.0.0/24", allow: true},
+		{name: "allowed mismatch containing the gateway", pool: "192.168.0.0/16", allow: true, gateway: true},
+		{name: "invalid pool", pool: "bogus", allow: true, err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEnv(t, Config{})
+			defer e.close()
+			opts := map[string]string{"vxnet": testVxnet}
+			if tt.allow {
+				opts[util.OptAllowSubnetMismatch] = "true"
+			}
+			resp, err := e.d.RequestPool(&ipam.RequestPoolRequest{Pool: tt.pool, Options: opts})
+			if (err != nil) != tt.err {
+				t.Fatalf("RequestPool(%s) error = %v, want error %v", tt.pool, err, tt.err)
+			}
+			if err != nil {
+				return
+			}
+			if _, ok := resp.Data["com.docker.network.gateway"]; ok != tt.gateway {
+				t.Errorf("gateway in %v = %v, want %v", resp.Data, ok, tt.gateway)
+			}
+		})
+	}
+}
+
+func TestIPv6(t *testing.T) {
+	e := newTestEnv(t, Config{})
+	defer e.close()
+	req6 := &ipam.RequestPoolRequest{Pool: "fd00:1::/64", V6: true, Options: map[string]string{"vxnet": testVxnet}}
+	if _, err := e.d.RequestPool(req6); err == nil {
+		t.Errorf("RequestPool of IPv6 succeeded on a vxnet without IPv6")
+	}
+	e.c.EnableIPv6(testVxnet, "fd00:1::/64")
+	poolID := e.requestPool(t, map[string]string{optReleasePolicy: policyDelete})
+	resp, err := e.d.RequestPool(req6)
+	if err != nil {
+		t.Fatalf("RequestPool of IPv6: %v", err)
+	}
+	if resp.PoolID != testVxnet+v6PoolSuffix || resp.Pool != "fd00:1::/64" || resp.Data["com.docker.network.gateway"] != "fd00:1::1/64" {
+		t.Fatalf("RequestPool of IPv6 = %+v, want pool fd00:1::/64 with gateway fd00:1::1", resp)
+	}
+	pool6 := resp.PoolID
+
+	// The IPv6 address is the one of the nic of an IPv4 address.
+	if addr6, err := e.d.RequestAddress(&ipam.RequestAddressRequest{PoolID: pool6}); err == nil {
+		t.Fatalf("RequestAddress of IPv6 = %s without an IPv4 address", addr6.Address)
+	}
+	addr, err := e.d.RequestAddress(&ipam.RequestAddressRequest{PoolID: poolID})
+	if err != nil {
+		t.Fatalf("RequestAddress: %v", err)
+	}
+	nic := e.c.Nic(e.reservations(t)[0].NicID)
+	addr6, err := e.d.RequestAddress(&ipam.RequestAddressRequest{PoolID: pool6})
+	if err != nil {
+		t.Fatalf("RequestAddress of IPv6: %v", err)
+	}
+	if want := nic.PrivateIPv6.String() + "/64"; addr6.Address != want {
+		t.Errorf("IPv6 address = %s, want %s of nic %s", addr6.Address, want, nic.ID)
+	}
+	if addr6, err := e.d.RequestAddress(&ipam.RequestAddressRequest{PoolID: pool6}); err == nil {
+		t.Errorf("IPv6 address %s assigned twice", addr6.Address)
+	}
+	if _, err := e.d.RequestAddress(&ipam.RequestAddressRequest{PoolID: pool6, Address: "fd00:1::99"}); err == nil {
+		t.Errorf("RequestAddress of IPv6 succeeded for an address of no nic")
+	}
+
+	// The nic is released with its IPv4 address only.
+	if err := e.d.ReleaseAddress(&ipam.ReleaseAddressRequest{PoolID: pool6, Address: addr6.Address}); err != nil {
+		t.Fatalf("ReleaseAddress of IPv6: %v", err)
+	}
+	if rs := e.reservations(t); len(rs) != 1 || e.c.Nic(nic.ID) == nil {
+		t.Fatalf("reservations = %+v after the IPv6 release, want the one of nic %s", rs, nic.ID)
+	}
+	if err := e.d.ReleaseAddress(&ipam.ReleaseAddressRequest{PoolID: poolID, Address: addr.Address}); err != nil {
+		t.Fatalf("ReleaseAddress: %v", err)
+	}
+	if rs := e.reservations(t); len(rs) != 0 || e.c.Nic(nic.ID) != nil {
+		t.Errorf("reservations = %+v, nic = %+v, want both deleted", rs, e.c.Nic(nic.ID))
+	}
+}
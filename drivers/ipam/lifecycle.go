@@ -0,0 +1,188 @@
+package ipam
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/nicescale/qcsdk"
+	sdktypes "github.com/nicescale/qcsdk/types"
+	"github.com/nicescale/qingcloud-docker-network/cloud"
+	"github.com/nicescale/qingcloud-docker-network/metrics"
+	"github.com/nicescale/qingcloud-docker-network/util"
+)
+
+const (
+	// optReleasePolicy is the IPAM option to select what happens to the nic
+	// of a released address.
+	optReleasePolicy = "release_policy"
+
+	// policyKeep keeps the nic attached to the instance for reuse as long as
+	// the idle nics of the vxnet don't exceed the high watermark of the
+	// warm pool. The nic is detached otherwise.
+	policyKeep = "keep"
+	// policyDetach detaches the nic so that it's available to other instances.
+	policyDetach = "detach"
+	// policyDelete deletes the nic.
+	policyDelete = "delete"
+)
+
+func validReleasePolicy(policy string) error {
+	switch policy {
+	case policyKeep, policyDetach, policyDelete:
+		return nil
+	}
+	return fmt.Errorf("invalid %s %q. Valid values are %s, %s and %s",
+		optReleasePolicy, policy, policyKeep, policyDetach, policyDelete)
+}
+
+// nicManager returns the nics of released addresses to qingcloud.
+type nicManager struct {
+	api    cloud.API
+	nl     util.Netlink
+	rs     *util.ReservationStore
+	sticky *util.StickyStore
+	host   *util.HostGuard
+
+	// releasing are the nics being detached or deleted. They are neither
+	// idle nor reserved meanwhile, so they are hidden from unreservedNics.
+	mu        sync.Mutex
+	releasing map[string]bool
+}
+
+// plan decides what to do with the nic of a released address. The caller
+// holds nicLock. A kept nic is prepared as an idle nic right away; any
+// other nic is marked as releasing and has to be passed to release after
+// nicLock is unlocked.
+// maxIdle is the number of idle nics to keep with policyKeep.
+// Nics held by a sticky binding are kept until the binding expires.
+func (m *nicManager) plan(nic *sdktypes.Nic, policy string, maxIdle int) (string, error) {
+	log := logrus.WithField("nic", nic.ID).WithField("ip", nic.PrivateIP.String())
+	held, err := m.sticky.Held()
+	if err != nil {
+		return "", err
+	}
+	if held[nic.ID] {
+		log.Debug("Keep the nic attached for its sticky binding")
+		if err := m.sticky.MarkReleased(nic.ID); err != nil {
+			return "", err
+		}
+		return policyKeep, m.keep(nic)
+	}
+	if policy == policyKeep {
+		idle, err := m.idleNics(nic.VxnetID)
+		if err != nil {
+			return "", err
+		}
+		if len(idle) <= maxIdle {
+			log.Debugf("Keep the nic attached. %d idle nics in vxnet %s", len(idle), nic.VxnetID)
+			return policyKeep, m.keep(nic)
+		}
+		policy = policyDetach
+	}
+
+	m.mu.Lock()
+	m.releasing[nic.ID] = true
+	m.mu.Unlock()
+	return policy, nil
+}
+
+// keep gives the link of a kept nic its canonical name back and prepares
+// it as an idle link, since it still has the name and state that the
+// endpoint of the released address gave it.
+func (m *nicManager) keep(nic *sdktypes.Nic) error {
+	links, err := m.nl.LinkList()
+	if err != nil {
+		return err
+	}
+	link := links[nic.ID]
+	if link == nil {
+		return nil
+	}
+	if name := util.CanonicalNicName(nic.ID); link.Attrs().Name != name {
+		if err := m.nl.RenameLink(link, name); err != nil {
+			return fmt.Errorf("failed to rename link %s of nic %s to %s: %v", link.Attrs().Name, nic.ID, name, err)
+		}
+	}
+	return m.host.PrepareIdle(link, nic.VxnetID, nic.PrivateIP)
+}
+
+// release detaches or deletes a nic marked as releasing by plan. It calls
+// the qingcloud API and must not be called with nicLock held.
+func (m *nicManager) release(nic *sdktypes.Nic, policy string) error {
+	defer func() {
+		m.mu.Lock()
+		delete(m.releasing, nic.ID)
+		m.mu.Unlock()
+	}()
+
+	log := logrus.WithField("nic", nic.ID).WithField("ip", nic.PrivateIP.String())
+	if err := m.host.Release(nic.PrivateIP); err != nil {
+		log.Errorf("Failed to remove the rules of the nic: %v", err)
+	}
+	if _, err := m.api.DetachNics([]string{nic.ID}, policy == policyDelete); err != nil {
+		return fmt.Errorf("failed to detach nic %s: %v", nic.ID, err)
+	}
+	metrics.MoveNic(nic.VxnetID, metrics.NicIdle, "")
+	log.Info("Nic detached")
+	if policy != policyDelete {
+		return nil
+	}
+
+	if err := m.api.DeleteNics([]string{nic.ID}); err != nil {
+		return fmt.Errorf("failed to delete nic %s: %v", nic.ID, err)
+	}
+	log.Info("Nic deleted")
+	return nil
+}
+
+// idleNics returns the unreserved nics of the vxnet that are not held by
+// a sticky binding.
+func (m *nicManager) idleNics(vxnet string) ([]*sdktypes.Nic, error) {
+	nics, err := m.unreservedNics(vxnet)
+	if err != nil {
+		return nil, err
+	}
+	held, err := m.sticky.Held()
+	if err != nil {
+		return nil, err
+	}
+
+	var idle []*sdktypes.Nic
+	for _, nic := range nics {
+		if !held[nic.ID] {
+			idle = append(idle, nic)
+		}
+	}
+	return idle, nil
+}
+
+// unreservedNics returns the nics of the vxnet that are attached to the
+// instance, present in the host network namespace and not reserved for an
+// endpoint.
+func (m *nicManager) unreservedNics(vxnet string) ([]*sdktypes.Nic, error) {
+	nics, err := m.api.DescribeNics(qcsdk.Params{"vxnets": vxnet, "instances": util.InstanceID})
+	if err != nil {
+		return nil, err
+	}
+	links, err := m.nl.LinkList()
+	if err != nil {
+		return nil, err
+	}
+	reserved, err := m.rs.Reserved()
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var idle []*sdktypes.Nic
+	for _, nic := range nics {
+		// Role == 1 means the interface is used by the VM
+		if nic.Role == 1 || links[nic.ID] == nil || reserved[nic.ID] || m.releasing[nic.ID] {
+			continue
+		}
+		idle = append(idle, nic)
+	}
+	return idle, nil
+}
@@ -0,0 +1,108 @@
+package ipam
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	sdktypes "github.com/nicescale/qcsdk/types"
+	"github.com/nicescale/qingcloud-docker-network/util"
+)
+
+// codeQuotaExceeded is the error code of qingcloud when a vxnet has no free
+// address for a new nic.
+const codeQuotaExceeded = 2500
+
+// exhausted reports whether err means that the vxnet ran out of addresses.
+func exhausted(err error) bool {
+	e, ok := err.(sdktypes.ResponseStatus)
+	return ok && e.Code == codeQuotaExceeded
+}
+
+// selectVxnet returns the vxnet of the pool requested by docker among the
+// vxnets of the network. With more than one vxnet, the requested pool must
+// be the network of one of them. The first vxnet is used if no pool is
+// requested.
+func (d *driver) selectVxnet(vxnets []string, pool string, v6 bool) (*sdktypes.Vxnet, error) {
+	if len(vxnets) == 1 || pool == "" {
+		return util.DescribeVxnet(d.api, vxnets[0])
+	}
+	check := util.CheckVxnetNetwork
+	if v6 {
+		check = util.CheckVxnetIPv6
+	}
+	for _, id := range vxnets {
+		v, err := util.DescribeVxnet(d.api, id)
+		if err != nil {
+			return nil, err
+		}
+		if check(v, pool, "") == nil {
+			return v, nil
+		}
+	}
+	return nil, fmt.Errorf("subnet %s doesn't match the network of any of vxnets %s", pool, strings.Join(vxnets, ","))
+}
+
+// overflowPools returns the pools of the overflow vxnets of p in order.
+// An overflow vxnet that docker didn't request a pool for inherits the
+// settings of p.
+func (d *driver) overflowPools(p *addressPool) ([]*addressPool, error) {
+	var pools []*addressPool
+	for _, vxnet := range p.Overflow {
+		d.poolLock.Lock()
+		q := d.pools[vxnet]
+		d.poolLock.Unlock()
+		if q == nil {
+			v, err := util.DescribeVxnet(d.api, vxnet)
+			if err != nil {
+				return nil, err
+			}
+			q = newPool(vxnet, v)
+			q.ReleasePolicy = p.ReleasePolicy
+			q.Takeover = p.Takeover
+		}
+		pools = append(pools, q)
+	}
+	return pools, nil
+}
+
+// poolOf returns the pool among p and its overflow pools whose subnet
+// contains ip. p is returned if none does.
+func (d *driver) poolOf(p *addressPool, ip net.IP) (*addressPool, error) {
+	if p.Subnet.Contains(ip) || len(p.Overflow) == 0 {
+		return p, nil
+	}
+	pools, err := d.overflowPools(p)
+	if err != nil {
+		return nil, err
+	}
+	for _, q := range pools {
+		if q.Subnet.Contains(ip) {
+			return q, nil
+		}
+	}
+	return p, nil
+}
+
+// allocate finds or creates a nic for ip in the vxnet of p. If any address
+// will do and the vxnet has no free address, the overflow vxnets of p are
+// tried in order. The pool that the nic is reserved in is returned.
+func (d *driver) allocate(p *addressPool, ip string) (*sdktypes.Nic, *addressPool, error) {
+	nic, err := d.findOrCreateNic(p, ip)
+	if ip != "" || !exhausted(err) {
+		return nic, p, err
+	}
+	pools, oerr := d.overflowPools(p)
+	if oerr != nil {
+		return nil, nil, oerr
+	}
+	for _, q := range pools {
+		logrus.Infof("Vxnet %s has no free address, overflow to vxnet %s", p.Vxnet, q.Vxnet)
+		nic, err = d.findOrCreateNic(q, "")
+		if !exhausted(err) {
+			return nic, q, err
+		}
+	}
+	return nil, nil, err
+}
@@ -0,0 +1,160 @@
+package ipam
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/docker/go-plugins-helpers/ipam"
+	sdktypes "github.com/nicescale/qcsdk/types"
+)
+
+// fillVxnet adds a vxnet whose addresses are all used by another instance.
+func (e *testEnv) fillVxnet(id, cidr string) {
+	e.c.AddVxnet(id, cidr)
+	_, ipnet, _ := net.ParseCIDR(cidr)
+	for i := 2; ; i++ {
+		ip := make(net.IP, len(ipnet.IP))
+		copy(ip, ipnet.IP)
+		ip[len(ip)-1] += byte(i)
+		if !ipnet.Contains(ip) {
+			return
+		}
+		e.c.AddNic(&sdktypes.Nic{VxnetID: id, PrivateIP: ip, Status: "in-use", InstanceID: otherInstance})
+	}
+}
+
+func TestSelectVxnet(t *testing.T) {
+	tests := []struct {
+		name   string
+		vxnets []string
+		pool   string
+		v6     bool
+		// want is the selected vxnet, or the error if it starts with "!".
+		want string
+	}{
+		{name: "single", vxnets: []string{"vxnet-b"}, pool: testPool, want: "vxnet-b"},
+		{name: "no pool", vxnets: []string{"vxnet-b", testVxnet}, want: "vxnet-b"},
+		{name: "first", vxnets: []string{testVxnet, "vxnet-b"}, pool: testPool, want: testVxnet},
+		{name: "second", vxnets: []string{testVxnet, "vxnet-b"}, pool: "10.0.1.0/24", want: "vxnet-b"},
+		{name: "IPv6", vxnets: []string{testVxnet, "vxnet-b"}, pool: "fd00:b::/64", v6: true, want: "vxnet-b"},
+		{name: "no match", vxnets: []string{testVxnet, "vxnet-b"}, pool: "10.0.9.0/24", want: "!doesn't match the network of any of vxnets vxnet-a,vxnet-b"},
+		{name: "unknown vxnet", vxnets: []string{testVxnet, "vxnet-gone"}, pool: "10.0.9.0/24", want: "!not found"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEnv(t, Config{})
+			defer e.close()
+			e.c.AddVxnet("vxnet-b", "10.0.1.0/24")
+			e.c.EnableIPv6(testVxnet, "fd00:a::/64")
+			e.c.EnableIPv6("vxnet-b", "fd00:b::/64")
+
+			v, err := e.d.selectVxnet(tt.vxnets, tt.pool, tt.v6)
+			if strings.HasPrefix(tt.want, "!") {
+				if err == nil || !strings.Contains(err.Error(), tt.want[1:]) {
+					t.Fatalf("selectVxnet = %+v, %v, want error %q", v, err, tt.want[1:])
+				}
+				return
+			}
+			if err != nil || v.ID != tt.want {
+				t.Fatalf("selectVxnet = %+v, %v, want %s", v, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestOverflowAfter(t *testing.T) {
+	vxnets := []string{"vxnet-a", "vxnet-b", "vxnet-c"}
+	tests := []struct {
+		vxnet string
+		want  []string
+	}{
+		{vxnet: "vxnet-a", want: []string{"vxnet-b", "vxnet-c"}},
+		{vxnet: "vxnet-b", want: []string{"vxnet-c"}},
+		{vxnet: "vxnet-c"},
+		{vxnet: "vxnet-d"},
+	}
+
+	for _, tt := range tests {
+		if got := overflowAfter(vxnets, tt.vxnet); len(got)+len(tt.want) > 0 && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("overflowAfter(%s) = %v, want %v", tt.vxnet, got, tt.want)
+		}
+	}
+}
+
+func TestOverflow(t *testing.T) {
+	tests := []struct {
+		name string
+		// full are the vxnets of the network without free addresses.
+		full []string
+		// address is the requested address, if any.
+		address string
+		// want is the allocated address, or the error if it starts with "!".
+		want string
+	}{
+		{name: "free", want: "192.168.0.2/29"},
+		{name: "overflow", full: []string{testVxnet}, want: "10.0.1.2/29"},
+		{name: "overflow twice", full: []string{testVxnet, "vxnet-b"}, want: "10.0.2.2/29"},
+		{name: "all full", full: []string{testVxnet, "vxnet-b", "vxnet-c"}, want: "!no free address"},
+		{name: "requested", full: []string{testVxnet}, address: "192.168.0.3", want: "!in use"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEnv(t, Config{})
+			defer e.close()
+			cidrs := map[string]string{testVxnet: "192.168.0.0/29", "vxnet-b": "10.0.1.0/29", "vxnet-c": "10.0.2.0/29"}
+			full := make(map[string]bool)
+			for _, id := range tt.full {
+				full[id] = true
+			}
+			// The vxnet of the env is replaced with a small one.
+			for id, cidr := range cidrs {
+				if full[id] {
+					e.fillVxnet(id, cidr)
+				} else {
+					e.c.AddVxnet(id, cidr)
+				}
+			}
+
+			resp, err := e.d.RequestPool(&ipam.RequestPoolRequest{
+				Pool:    cidrs[testVxnet],
+				Options: map[string]string{"vxnet": testVxnet + ",vxnet-b,vxnet-c", optReleasePolicy: policyDelete},
+			})
+			if err != nil {
+				t.Fatalf("RequestPool: %v", err)
+			}
+			addr, err := e.d.RequestAddress(&ipam.RequestAddressRequest{PoolID: resp.PoolID, Address: tt.address})
+			if strings.HasPrefix(tt.want, "!") {
+				if err == nil || !strings.Contains(err.Error(), tt.want[1:]) {
+					t.Fatalf("RequestAddress = %+v, %v, want error %q", addr, err, tt.want[1:])
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("RequestAddress: %v", err)
+			}
+			if addr.Address != tt.want {
+				t.Fatalf("address = %s, want %s", addr.Address, tt.want)
+			}
+
+			// The address is released in the pool of its vxnet, which
+			// inherits the release policy of the network.
+			rs := e.reservations(t)
+			if len(rs) != 1 {
+				t.Fatalf("reservations = %+v, want one", rs)
+			}
+			if err := e.d.ReleaseAddress(&ipam.ReleaseAddressRequest{PoolID: resp.PoolID, Address: addr.Address}); err != nil {
+				t.Fatalf("ReleaseAddress: %v", err)
+			}
+			if rs := e.reservations(t); len(rs) != 0 {
+				t.Errorf("reservations = %+v after the release, want none", rs)
+			}
+			if nic := e.c.Nic(rs[0].NicID); nic != nil {
+				t.Errorf("released nic = %+v, want it deleted", nic)
+			}
+		})
+	}
+}
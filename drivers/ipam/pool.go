@@ -0,0 +1,173 @@
+package ipam
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	sdktypes "github.com/nicescale/qcsdk/types"
+	"github.com/nicescale/qingcloud-docker-network/util"
+)
+
+// v6PoolSuffix is appended to the vxnet ID to make the ID of the IPv6 pool.
+const v6PoolSuffix = "-v6"
+
+// addressPool describes the address space of a vxnet as configured on the
+// qingcloud router that the vxnet is joined to.
+type addressPool struct {
+	ID      string
+	Vxnet   string
+	Subnet  *net.IPNet
+	Gateway net.IP
+
+	// AllowMismatch is set if the user deliberately chose a subnet or
+	// gateway that differs from the router settings.
+	AllowMismatch bool
+
+	// ReleasePolicy determines what to do with the nic of a released
+	// address. See nicManager for the possible values.
+	ReleasePolicy string
+
+	// WarmLow and WarmHigh override the default watermarks of the warm
+	// pool if not nil.
+	WarmLow  *int `json:",omitempty"`
+	WarmHigh *int `json:",omitempty"`
+
+	// Takeover allows a requested address to be taken over from another
+	// instance. See driver.takeover.
+	Takeover bool `json:",omitempty"`
+	// Overflow are the vxnets that addresses are allocated from, in order,
+	// once the vxnet of the pool has no free address.
+	Overflow []string `json:",omitempty"`
+	// V6 is set for the IPv6 pool of a dual-stack vxnet. It has no nics of
+	// its own; its addresses are the IPv6 addresses of the nics reserved
+	// in the IPv4 pool of the vxnet.
+	V6 bool `json:",omitempty"`
+}
+
+func (p *addressPool) releasePolicy() string {
+	if p.ReleasePolicy == "" {
+		return policyKeep
+	}
+	return p.ReleasePolicy
+}
+
+// cidr returns ip with the mask length of the pool appended.
+func (p *addressPool) cidr(ip net.IP) string {
+	ones, _ := p.Subnet.Mask.Size()
+	return fmt.Sprintf("%s/%d", ip, ones)
+}
+
+func (d *driver) poolPath(id string) string {
+	return filepath.Join(d.root, "pools", id+".json")
+}
+
+func (d *driver) getPool(id string) (*addressPool, error) {
+	d.poolLock.Lock()
+	p := d.pools[id]
+	d.poolLock.Unlock()
+	if p != nil {
+		return p, nil
+	}
+
+	p = &addressPool{}
+	err := util.ReadJSON(d.poolPath(id), p)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if os.IsNotExist(err) {
+		// Pools created by older versions were not saved. The pool ID is
+		// the vxnet ID so the pool can be rebuilt from the qingcloud API.
+		vxnet := strings.TrimSuffix(id, v6PoolSuffix)
+		v, err := util.DescribeVxnet(d.api, vxnet)
+		if err != nil {
+			return nil, err
+		}
+		if vxnet == id {
+			p = newPool(id, v)
+		} else if p, err = newPool6(v); err != nil {
+			return nil, err
+		}
+	}
+
+	d.poolLock.Lock()
+	d.pools[id] = p
+	d.poolLock.Unlock()
+	return p, nil
+}
+
+// loadPools loads the saved pools so that their warm pools are maintained
+// before any address is requested.
+func (d *driver) loadPools() error {
+	files, err := filepath.Glob(filepath.Join(d.root, "pools", "*.json"))
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		p := &addressPool{}
+		if err := util.ReadJSON(f, p); err != nil {
+			return fmt.Errorf("failed to load pool file %s: %v", f, err)
+		}
+		d.pools[p.ID] = p
+	}
+	return nil
+}
+
+func (d *driver) savePool(p *addressPool) error {
+	if err := util.WriteJSON(filepath.Join(d.root, "tmp"), d.poolPath(p.ID), p); err != nil {
+		return err
+	}
+
+	d.poolLock.Lock()
+	d.pools[p.ID] = p
+	d.poolLock.Unlock()
+	return nil
+}
+
+// releasePool forgets the pool and detaches the idle nics that its warm
+// pool kept attached.
+func (d *driver) releasePool(id string) error {
+	d.poolLock.Lock()
+	p := d.pools[id]
+	delete(d.pools, id)
+	d.poolLock.Unlock()
+
+	err := os.Remove(d.poolPath(id))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if p == nil || p.V6 {
+		return nil
+	}
+	d.nicLock.Lock()
+	defer d.nicLock.Unlock()
+	return d.trim(p, 0)
+}
+
+func newPool(id string, v *sdktypes.Vxnet) *addressPool {
+	router := v.Router
+	subnet := router.IPNetwork.IPNet
+	return &addressPool{
+		ID:      id,
+		Vxnet:   v.ID,
+		Subnet:  &subnet,
+		Gateway: router.ManagerIP,
+	}
+}
+
+// newPool6 returns the IPv6 pool of a dual-stack vxnet.
+func newPool6(v *sdktypes.Vxnet) (*addressPool, error) {
+	subnet, gw, err := util.VxnetIPv6(v)
+	if err != nil {
+		return nil, err
+	}
+	return &addressPool{
+		ID:      v.ID + v6PoolSuffix,
+		Vxnet:   v.ID,
+		Subnet:  subnet,
+		Gateway: gw,
+		V6:      true,
+	}, nil
+}
@@ -0,0 +1,81 @@
+package ipam
+
+import (
+	"github.com/Sirupsen/logrus"
+	sdktypes "github.com/nicescale/qcsdk/types"
+	"github.com/nicescale/qingcloud-docker-network/util"
+)
+
+// boundAddress returns the address bound to the identity if it's in one of
+// the vxnets, or "".
+func (d *driver) boundAddress(id string, vxnets ...string) (vxnet, ip string, err error) {
+	b, err := d.sticky.Get(id)
+	if err != nil || b == nil {
+		return "", "", err
+	}
+	for _, v := range vxnets {
+		if v == b.Vxnet {
+			return b.Vxnet, b.Address, nil
+		}
+	}
+	return "", "", nil
+}
+
+// bind binds the nic to the identity, replacing its previous binding.
+func (d *driver) bind(id string, nic *sdktypes.Nic) error {
+	return d.sticky.Set(&util.StickyBinding{
+		ID:      id,
+		Vxnet:   nic.VxnetID,
+		NicID:   nic.ID,
+		Address: nic.PrivateIP.String(),
+	})
+}
+
+// expireSticky removes the sticky bindings of the vxnet of p whose nics
+// were released more than StickyTTL ago, and releases the nics that are
+// still idle according to the release policy of p.
+func (d *driver) expireSticky(p *addressPool) error {
+	if d.cfg.StickyTTL <= 0 {
+		return nil
+	}
+	d.nicLock.Lock()
+	expired, err := d.sticky.Expire(p.Vxnet, d.cfg.StickyTTL)
+	if err != nil || len(expired) == 0 {
+		d.nicLock.Unlock()
+		return err
+	}
+	bound := make(map[string]bool)
+	for _, b := range expired {
+		bound[b.NicID] = true
+		logrus.WithField("nic", b.NicID).Infof("Sticky binding of %s to %s expired", b.ID, b.Address)
+	}
+	// Reserved nics are released with their addresses.
+	nics, err := d.nics.unreservedNics(p.Vxnet)
+	if err != nil {
+		d.nicLock.Unlock()
+		return err
+	}
+	_, high := d.watermarks(p)
+	released := make(map[*sdktypes.Nic]string)
+	for _, nic := range nics {
+		if !bound[nic.ID] {
+			continue
+		}
+		policy, err := d.nics.plan(nic, p.releasePolicy(), high)
+		if err != nil {
+			logrus.WithField("nic", nic.ID).Errorf("Failed to release the nic of an expired sticky binding: %v", err)
+			continue
+		}
+		if policy != policyKeep {
+			released[nic] = policy
+		}
+	}
+	d.nicLock.Unlock()
+
+	for nic, policy := range released {
+		if err := d.nics.release(nic, policy); err != nil {
+			logrus.WithField("nic", nic.ID).Errorf("Failed to release the nic of an expired sticky binding: %v", err)
+		}
+	}
+	return nil
+}
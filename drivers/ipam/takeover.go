@@ -0,0 +1,205 @@
+package ipam
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/nicescale/qcsdk"
+	sdktypes "github.com/nicescale/qcsdk/types"
+	"github.com/nicescale/qingcloud-docker-network/util"
+)
+
+const (
+	// optTakeover is the IPAM option that allows a requested address to be
+	// taken over from another instance that no longer uses its nic.
+	optTakeover = "takeover"
+
+	// The states published in the leases.
+	leaseInUse  = "in-use"
+	leaseIdle   = "idle"
+	leaseRefuse = "refuse"
+
+	// leaseTTLFactor is the lifetime of a lease in lease intervals.
+	leaseTTLFactor = 3
+
+	takeoverPollInterval = time.Second
+)
+
+// lease is published as the name of each nic of the plugin attached to the
+// instance, in the form of qdn|<instance>|<state>|<expiry>. It tells the
+// plugins on other instances whether the nic may be taken over. The qdn
+// prefix still marks the nic as a nic of the plugin, like util.NicName, once
+// the lease expires. See util.PluginNic.
+type lease struct {
+	Instance string
+	State    string
+	Expiry   time.Time
+}
+
+func (l *lease) String() string {
+	return fmt.Sprintf("%s|%s|%s|%d", util.LeasePrefix, l.Instance, l.State, l.Expiry.Unix())
+}
+
+func parseLease(name string) (*lease, error) {
+	parts := strings.Split(name, "|")
+	if len(parts) != 4 || parts[0] != util.LeasePrefix {
+		return nil, fmt.Errorf("nic name %q is not a lease of the plugin", name)
+	}
+	sec, err := strconv.ParseInt(parts[3], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid lease expiry in nic name %q", name)
+	}
+	return &lease{Instance: parts[1], State: parts[2], Expiry: time.Unix(sec, 0)}, nil
+}
+
+// leaseKeeper renews the leases of the nics of the plugin attached to the
+// instance. Other nics keep their names.
+type leaseKeeper struct {
+	d        *driver
+	interval time.Duration
+	refuse   bool
+	kickCh   chan struct{}
+}
+
+func newLeaseKeeper(d *driver, interval time.Duration, refuse bool) *leaseKeeper {
+	return &leaseKeeper{
+		d:        d,
+		interval: interval,
+		refuse:   refuse,
+		kickCh:   make(chan struct{}, 1),
+	}
+}
+
+// kick schedules a renewal without waiting for it, e.g. when a nic changes
+// between in use and idle. It's a no-op on a nil leaseKeeper.
+func (k *leaseKeeper) kick() {
+	if k == nil {
+		return
+	}
+	select {
+	case k.kickCh <- struct{}{}:
+	default:
+	}
+}
+
+func (k *leaseKeeper) run() {
+	ticker := time.NewTicker(k.interval)
+	defer ticker.Stop()
+	for {
+		if err := k.renew(); err != nil {
+			logrus.Errorf("Failed to renew nic leases: %v", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-k.kickCh:
+		}
+	}
+}
+
+// renew publishes the lease of each nic whose state changed or whose lease
+// is past half of its lifetime.
+func (k *leaseKeeper) renew() error {
+	nics, err := k.d.api.DescribeNics(qcsdk.Params{"instances": util.InstanceID})
+	if err != nil {
+		return err
+	}
+	reserved, err := k.d.rs.Reserved()
+	if err != nil {
+		return err
+	}
+
+	ttl := leaseTTLFactor * k.interval
+	for _, nic := range nics {
+		// Role == 1 means the interface is used by the VM
+		if nic.Role == 1 || !util.PluginNic(nic) {
+			continue
+		}
+		l := &lease{Instance: util.InstanceID, State: leaseIdle, Expiry: time.Now().Add(ttl)}
+		if k.refuse {
+			l.State = leaseRefuse
+		} else if reserved[nic.ID] {
+			l.State = leaseInUse
+		}
+
+		old, err := parseLease(nic.NicName)
+		if err == nil && old.Instance == l.Instance && old.State == l.State && old.Expiry.Sub(time.Now()) > ttl/2 {
+			continue
+		}
+		if err := k.d.api.ModifyNicAttributes(nic.ID, l.String(), "", ""); err != nil {
+			logrus.WithField("nic", nic.ID).Errorf("Failed to renew lease: %v", err)
+			continue
+		}
+		logrus.WithField("nic", nic.ID).Debugf("Lease renewed: %s", l)
+	}
+	return nil
+}
+
+// takeover detaches the nic with the address ip from the instance that it's
+// attached to and returns it once it's available. The lease of the nic must
+// show that it's idle on that instance, or that the plugin there stopped
+// renewing it.
+func (d *driver) takeover(vxnet, ip string) (*sdktypes.Nic, error) {
+	nics, err := d.api.DescribeNics(qcsdk.Params{"vxnets": vxnet, "search_word": ip})
+	if err != nil {
+		return nil, err
+	}
+	var nic *sdktypes.Nic
+	for _, n := range nics {
+		if n.PrivateIP.String() == ip {
+			nic = n
+		}
+	}
+	if nic == nil {
+		return nil, errNoAvailableNic
+	}
+
+	switch {
+	case nic.Status == "available":
+		return nic, nil
+	case nic.InstanceID == util.InstanceID:
+		return nil, fmt.Errorf("address %s is in use on this instance", ip)
+	case nic.Role == 1:
+		return nil, fmt.Errorf("address %s is the primary address of instance %s", ip, nic.InstanceID)
+	}
+
+	l, err := parseLease(nic.NicName)
+	if err != nil {
+		return nil, fmt.Errorf("refuse to take over nic %s of %s: %v", nic.ID, ip, err)
+	}
+	if l.Instance != nic.InstanceID {
+		return nil, fmt.Errorf("refuse to take over nic %s of %s: it's attached to %s but leased by %s",
+			nic.ID, ip, nic.InstanceID, l.Instance)
+	}
+	if l.State == leaseRefuse {
+		return nil, fmt.Errorf("instance %s refuses to give up nic %s of %s", l.Instance, nic.ID, ip)
+	}
+	if l.State != leaseIdle && time.Now().Before(l.Expiry) {
+		return nil, fmt.Errorf("nic %s of %s is in use on instance %s (lease expires at %s)",
+			nic.ID, ip, l.Instance, l.Expiry.Format(time.RFC3339))
+	}
+
+	log := logrus.WithField("nic", nic.ID).WithField("ip", ip)
+	log.Warnf("Taking over the nic from instance %s (lease %s)", nic.InstanceID, l.State)
+	if _, err := d.api.DetachNics([]string{nic.ID}, false); err != nil {
+		return nil, fmt.Errorf("failed to detach nic %s from %s: %v", nic.ID, nic.InstanceID, err)
+	}
+
+	deadline := time.Now().Add(d.cfg.TakeoverTimeout)
+	for {
+		nics, err := d.api.DescribeNics(qcsdk.Params{"nics": nic.ID})
+		if err != nil {
+			return nil, err
+		}
+		if len(nics) == 1 && nics[0].Status == "available" {
+			log.Infof("Nic detached from instance %s", nic.InstanceID)
+			return nics[0], nil
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("nic %s wasn't detached from %s within %s", nic.ID, nic.InstanceID, d.cfg.TakeoverTimeout)
+		}
+		time.Sleep(takeoverPollInterval)
+	}
+}
@@ -0,0 +1,150 @@
+package ipam
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	sdktypes "github.com/nicescale/qcsdk/types"
+	"github.com/nicescale/qingcloud-docker-network/util"
+)
+
+const otherInstance = "i-other"
+
+func TestParseLease(t *testing.T) {
+	expiry := time.Unix(1700000000, 0)
+	tests := []struct {
+		name string
+		want *lease
+	}{
+		{name: (&lease{Instance: otherInstance, State: leaseInUse, Expiry: expiry}).String(), want: &lease{Instance: otherInstance, State: leaseInUse, Expiry: expiry}},
+		{name: util.NicName},
+		{name: "qdn|i-other|idle"},
+		{name: "other|i-other|idle|1700000000"},
+		{name: "qdn|i-other|idle|soon"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, err := parseLease(tt.name)
+			if tt.want == nil {
+				if err == nil {
+					t.Errorf("parseLease = %+v, want an error", l)
+				}
+				return
+			}
+			if err != nil || *l != *tt.want {
+				t.Errorf("parseLease = %+v, %v, want %+v", l, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestTakeover(t *testing.T) {
+	future, past := time.Now().Add(time.Hour), time.Now().Add(-time.Minute)
+	tests := []struct {
+		name     string
+		status   string
+		instance string
+		nicName  string
+		// latency is how long the detach job takes.
+		latency time.Duration
+		// want is the error of takeover, if any.
+		want string
+	}{
+		{name: "available", status: "available"},
+		{name: "idle", nicName: (&lease{Instance: otherInstance, State: leaseIdle, Expiry: future}).String()},
+		{name: "expired", nicName: (&lease{Instance: otherInstance, State: leaseInUse, Expiry: past}).String()},
+		{
+			name:    "in use",
+			nicName: (&lease{Instance: otherInstance, State: leaseInUse, Expiry: future}).String(),
+			want:    "is in use on instance",
+		},
+		{
+			name:    "refuse",
+			nicName: (&lease{Instance: otherInstance, State: leaseRefuse, Expiry: past}).String(),
+			want:    "refuses to give up",
+		},
+		{
+			name:    "leased by another instance",
+			nicName: (&lease{Instance: "i-third", State: leaseIdle, Expiry: future}).String(),
+			want:    "but leased by i-third",
+		},
+		{name: "no lease", nicName: util.NicName, want: "not a lease"},
+		{name: "this instance", instance: testInstance, want: "in use on this instance"},
+		{
+			name:    "timeout",
+			nicName: (&lease{Instance: otherInstance, State: leaseIdle, Expiry: future}).String(),
+			latency: time.Hour,
+			want:    "wasn't detached",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEnv(t, Config{TakeoverTimeout: 10 * time.Millisecond})
+			defer e.close()
+			e.c.JobLatency = tt.latency
+			nic := &sdktypes.Nic{VxnetID: testVxnet, PrivateIP: net.ParseIP("192.168.0.10"), NicName: tt.nicName, Status: tt.status}
+			if nic.Status == "" {
+				nic.Status, nic.InstanceID = "in-use", otherInstance
+			}
+			if tt.instance != "" {
+				nic.InstanceID = tt.instance
+			}
+			nic = e.c.AddNic(nic)
+
+			got, err := e.d.takeover(testVxnet, "192.168.0.10")
+			if tt.want != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.want) {
+					t.Fatalf("takeover error = %v, want %q", err, tt.want)
+				}
+				if tt.latency == 0 && e.c.Calls("DetachNics") != 0 {
+					t.Errorf("nic detached from instance %s", nic.InstanceID)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("takeover: %v", err)
+			}
+			if got.ID != nic.ID || got.Status != "available" {
+				t.Errorf("takeover = %+v, want nic %s available", got, nic.ID)
+			}
+		})
+	}
+}
+
+func TestRenewLeases(t *testing.T) {
+	e := newTestEnv(t, Config{})
+	defer e.close()
+	add := func(name string, role int) *sdktypes.Nic {
+		return e.c.AddNic(&sdktypes.Nic{VxnetID: testVxnet, NicName: name, Role: role, Status: "in-use", InstanceID: testInstance})
+	}
+	created := add(util.NicName, 0)
+	leased := add((&lease{Instance: testInstance, State: leaseIdle, Expiry: time.Now().Add(time.Second)}).String(), 0)
+	reserved := add(util.NicName, 0)
+	if err := e.d.rs.Add(&util.Reservation{PoolID: testVxnet, Address: "192.168.0.12", NicID: reserved.ID}); err != nil {
+		t.Fatal(err)
+	}
+	foreign := add("my-nic", 0)
+	primary := add("", 1)
+
+	if err := newLeaseKeeper(e.d, time.Minute, false).renew(); err != nil {
+		t.Fatalf("renew: %v", err)
+	}
+	for nic, state := range map[*sdktypes.Nic]string{created: leaseIdle, leased: leaseIdle, reserved: leaseInUse} {
+		l, err := parseLease(e.c.Nic(nic.ID).NicName)
+		if err != nil || l.Instance != testInstance || l.State != state || time.Until(l.Expiry) < 2*time.Minute {
+			t.Errorf("lease of nic %s = %+v, %v, want a renewed %s lease", nic.ID, l, err, state)
+		}
+		if !util.PluginNic(e.c.Nic(nic.ID)) {
+			t.Errorf("leased nic %s isn't a nic of the plugin", nic.ID)
+		}
+	}
+	for _, nic := range []*sdktypes.Nic{foreign, primary} {
+		if name := e.c.Nic(nic.ID).NicName; name != nic.NicName {
+			t.Errorf("nic %s renamed to %q, want %q", nic.ID, name, nic.NicName)
+		}
+	}
+}
@@ -0,0 +1,293 @@
+package ipam
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	sdktypes "github.com/nicescale/qcsdk/types"
+	"github.com/nicescale/qingcloud-docker-network/metrics"
+	"github.com/nicescale/qingcloud-docker-network/util"
+)
+
+const (
+	// optWarmLow and optWarmHigh are the IPAM options to override the
+	// watermarks of the warm pool for a network.
+	optWarmLow  = "warm_low"
+	optWarmHigh = "warm_high"
+
+	// DefaultWarmHigh is the default high watermark of the warm pools.
+	DefaultWarmHigh = 2
+)
+
+// savedWatermarks are the default watermarks of the IPAM driver. They are
+// saved in the data dir so that the Allocators sharing it, e.g. of the CNI
+// plugin, keep the same number of idle nics when they release addresses.
+type savedWatermarks struct {
+	WarmLow  int
+	WarmHigh int
+}
+
+func watermarksPath(root string) string {
+	return filepath.Join(root, "watermarks.json")
+}
+
+func saveWatermarks(root string, cfg Config) error {
+	return util.WriteJSON(filepath.Join(root, "tmp"), watermarksPath(root), &savedWatermarks{cfg.WarmLow, cfg.WarmHigh})
+}
+
+// loadWatermarks sets the watermarks of cfg to the ones saved in root if
+// there are any.
+func loadWatermarks(root string, cfg *Config) error {
+	w := &savedWatermarks{}
+	if err := util.ReadJSON(watermarksPath(root), w); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	cfg.WarmLow, cfg.WarmHigh = w.WarmLow, w.WarmHigh
+	return nil
+}
+
+// warmPool keeps idle nics attached to the instance for each pool so that
+// RequestAddress doesn't have to wait for CreateNics and AttachNics.
+// When the idle nics of a pool drop below the low watermark the pool is
+// refilled up to the high watermark. Idle nics beyond the high watermark
+// are detached.
+type warmPool struct {
+	d        *driver
+	interval time.Duration
+	kickCh   chan struct{}
+	// pending are the numbers of nics being attached to the vxnets.
+	// Guarded by nicLock.
+	pending map[string]int
+}
+
+func newWarmPool(d *driver, interval time.Duration) *warmPool {
+	return &warmPool{
+		d:        d,
+		interval: interval,
+		kickCh:   make(chan struct{}, 1),
+		pending:  make(map[string]int),
+	}
+}
+
+// kick schedules a refill without waiting for it.
+// It's a no-op on a nil warmPool.
+func (w *warmPool) kick() {
+	if w == nil {
+		return
+	}
+	select {
+	case w.kickCh <- struct{}{}:
+	default:
+	}
+}
+
+func (w *warmPool) run() {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		w.fillAll()
+		select {
+		case <-ticker.C:
+		case <-w.kickCh:
+		}
+	}
+}
+
+func (w *warmPool) fillAll() {
+	w.d.poolLock.Lock()
+	pools := make([]*addressPool, 0, len(w.d.pools))
+	for _, p := range w.d.pools {
+		// The IPv6 pools share the nics of the IPv4 pools.
+		if !p.V6 {
+			pools = append(pools, p)
+		}
+	}
+	w.d.poolLock.Unlock()
+
+	for _, p := range pools {
+		if err := w.d.expireSticky(p); err != nil {
+			logrus.Errorf("Failed to expire the sticky bindings of vxnet %s: %v", p.Vxnet, err)
+		}
+		if err := w.fill(p); err != nil {
+			logrus.Errorf("Failed to refill warm nics of vxnet %s: %v", p.Vxnet, err)
+		}
+	}
+}
+
+// fill counts the idle nics and picks the nics to attach under nicLock so
+// that RequestAddress and ReleaseAddress don't take or detach them
+// meanwhile. The nics are created, attached and prepared without the lock,
+// counted as pending in the meantime.
+func (w *warmPool) fill(p *addressPool) error {
+	w.d.nicLock.Lock()
+	warm, create, err := w.plan(p)
+	w.d.nicLock.Unlock()
+	if err != nil || len(warm)+create == 0 {
+		return err
+	}
+
+	attached, err := w.attach(p, warm, create)
+
+	w.d.poolLock.Lock()
+	released := w.d.pools[p.ID] == nil
+	w.d.poolLock.Unlock()
+
+	w.d.nicLock.Lock()
+	w.pending[p.Vxnet] -= len(warm) + create
+	for _, nic := range warm {
+		delete(w.d.attaching, nic.ID)
+	}
+	if released && len(attached) > 0 {
+		// The pool was released while its nics were being attached.
+		if err := w.d.detachIdle(p.Vxnet, attached); err != nil {
+			logrus.Errorf("Failed to detach the warm nics of released pool %s: %v", p.ID, err)
+		}
+		attached = nil
+	}
+	w.d.nicLock.Unlock()
+
+	w.prepare(attached)
+	return err
+}
+
+// plan returns the available nics to attach to the instance and the number
+// of nics to create to refill the warm pool of p, and trims the pool if it
+// has too many idle nics. The caller holds nicLock.
+func (w *warmPool) plan(p *addressPool) ([]*sdktypes.Nic, int, error) {
+	low, high := w.d.watermarks(p)
+	idle, err := w.d.nics.idleNics(p.Vxnet)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if len(idle) > high {
+		return nil, 0, w.d.trim(p, high)
+	}
+	have := len(idle) + w.pending[p.Vxnet]
+	if have >= low {
+		return nil, 0, nil
+	}
+
+	need := high - have
+	logrus.WithField("vxnet", p.Vxnet).Debugf("%d idle and %d pending nics, attaching %d more", len(idle), w.pending[p.Vxnet], need)
+	nics, err := w.d.availableNics(p.Vxnet)
+	if err != nil {
+		return nil, 0, err
+	}
+	var warm []*sdktypes.Nic
+	for _, nic := range nics {
+		if len(warm) == need {
+			break
+		}
+		warm = append(warm, nic)
+		w.d.attaching[nic.ID] = true
+	}
+	w.pending[p.Vxnet] += need
+	return warm, need - len(warm), nil
+}
+
+// attach creates the missing nics and attaches them to the instance along
+// with the available ones. It returns the attached nics.
+func (w *warmPool) attach(p *addressPool, warm []*sdktypes.Nic, create int) ([]*sdktypes.Nic, error) {
+	if create > 0 {
+		created, err := w.d.api.CreateNics(p.Vxnet, util.NicName, create, nil)
+		if err != nil {
+			return nil, err
+		}
+		warm = append(warm, created...)
+	}
+
+	var ids []string
+	for _, nic := range warm {
+		ids = append(ids, nic.ID)
+	}
+	if _, err := w.d.api.AttachNics(ids, util.InstanceID, true); err != nil {
+		return nil, err
+	}
+	for range ids {
+		metrics.MoveNic(p.Vxnet, "", metrics.NicIdle)
+	}
+	logrus.WithField("vxnet", p.Vxnet).Infof("Attached %d warm nics: %v", len(ids), ids)
+	return warm, nil
+}
+
+// prepare applies the idle link policy to the links of the warm nics as
+// soon as they show up, before DHCP clients of the host configure them.
+func (w *warmPool) prepare(nics []*sdktypes.Nic) {
+	if w.d.cfg.Host == nil {
+		return
+	}
+	for _, nic := range nics {
+		link, err := w.d.nl.WaitForLink(nic.ID, w.d.cfg.LinkTimeout, false)
+		if err == nil {
+			err = w.d.cfg.Host.PrepareIdle(link, nic.VxnetID, nic.PrivateIP)
+		}
+		if err != nil {
+			logrus.WithField("nic", nic.ID).Errorf("Failed to prepare the link of the warm nic: %v", err)
+		}
+	}
+}
+
+// trim detaches the idle nics of the vxnet of p beyond the high watermark.
+// The caller holds nicLock.
+func (d *driver) trim(p *addressPool, high int) error {
+	idle, err := d.nics.idleNics(p.Vxnet)
+	if err != nil || len(idle) <= high {
+		return err
+	}
+	return d.detachIdle(p.Vxnet, idle[high:])
+}
+
+// detachIdle detaches idle nics of the vxnet without waiting for the job.
+// The caller holds nicLock.
+func (d *driver) detachIdle(vxnet string, nics []*sdktypes.Nic) error {
+	var ids []string
+	for _, nic := range nics {
+		ids = append(ids, nic.ID)
+		if err := d.cfg.Host.Release(nic.PrivateIP); err != nil {
+			logrus.WithField("nic", nic.ID).Errorf("Failed to remove the rules of the nic: %v", err)
+		}
+	}
+	if _, err := d.api.DetachNics(ids, false); err != nil {
+		return err
+	}
+	for range ids {
+		metrics.MoveNic(vxnet, metrics.NicIdle, "")
+	}
+	logrus.WithField("vxnet", vxnet).Infof("Detached %d surplus idle nics: %v", len(ids), ids)
+	return nil
+}
+
+// watermarks returns the low and high watermarks of the warm pool.
+func (d *driver) watermarks(p *addressPool) (low, high int) {
+	low, high = d.cfg.WarmLow, d.cfg.WarmHigh
+	if p.WarmLow != nil {
+		low = *p.WarmLow
+	}
+	if p.WarmHigh != nil {
+		high = *p.WarmHigh
+	}
+	if high < low {
+		high = low
+	}
+	return low, high
+}
+
+func parseWatermark(opts map[string]string, key string) (*int, error) {
+	v, ok := opts[key]
+	if !ok {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("invalid %s %q: must be a non-negative integer", key, v)
+	}
+	return &n, nil
+}
@@ -0,0 +1,303 @@
+package network
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/go-plugins-helpers/network"
+	"github.com/nicescale/qcsdk"
+	"github.com/nicescale/qingcloud-docker-network/metrics"
+	"github.com/nicescale/qingcloud-docker-network/util"
+)
+
+// Admin is the state and the operator actions of the network driver served
+// by the admin API.
+type Admin interface {
+	// Networks returns the networks and their endpoints.
+	Networks() []*NetworkInfo
+	// Reconcile reconciles the attached nics and returns their status.
+	// Nothing is changed if dryRun is true.
+	Reconcile(dryRun bool) ([]*NicStatus, error)
+	// ForceRelease deletes an endpoint that docker failed to delete.
+	ForceRelease(networkID, endpointID string) error
+	// DetachIdleNic detaches an idle nic from the instance.
+	DetachIdleNic(nicID string) error
+	// GC removes the expired reservations and reconciles the nics.
+	GC() (*GCResult, error)
+	// StickyBindings returns the sticky bindings.
+	StickyBindings() ([]*util.StickyBinding, error)
+	// Unbind removes the sticky binding of the identity. Its nic is then
+	// released like any other once no endpoint uses it.
+	Unbind(id string) error
+}
+
+// Driver is the network driver together with its admin operations.
+type Driver interface {
+	network.Driver
+	Admin
+}
+
+var _ Driver = (*driver)(nil)
+
+// NetworkInfo is a network as shown by the admin API.
+type NetworkInfo struct {
+	ID            string
+	Subnets       []*SubnetInfo
+	SecurityGroup string                 `json:",omitempty"`
+	MTU           int                    `json:",omitempty"`
+	TxQueueLen    int                    `json:",omitempty"`
+	Routes        []*network.StaticRoute `json:",omitempty"`
+	NoGateway     bool                   `json:",omitempty"`
+	Endpoints     []*EndpointInfo
+}
+
+// SubnetInfo is a subnet of a network as shown by the admin API.
+type SubnetInfo struct {
+	Vxnet       string
+	Router      string
+	Pool        string
+	Gateway     string
+	PoolIPv6    string `json:",omitempty"`
+	GatewayIPv6 string `json:",omitempty"`
+}
+
+// EndpointInfo is an endpoint as shown by the admin API. The ID of the nic
+// is its MAC address.
+type EndpointInfo struct {
+	NetworkID     string
+	ID            string
+	NicID         string
+	MAC           string
+	IP            string
+	IPv6          string `json:",omitempty"`
+	Vxnet         string
+	SandboxKey    string `json:",omitempty"`
+	EIP           string `json:",omitempty"`
+	SecurityGroup string `json:",omitempty"`
+	LBBackend     string `json:",omitempty"`
+	Stale         bool   `json:",omitempty"`
+}
+
+func (d *driver) Networks() []*NetworkInfo {
+	d.mu.Lock()
+	networks := make([]*netConfig, 0, len(d.networks))
+	for _, n := range d.networks {
+		networks = append(networks, n)
+	}
+	d.mu.Unlock()
+
+	var infos []*NetworkInfo
+	for _, n := range networks {
+		infos = append(infos, n.info())
+	}
+	sort.Sort(networksByID(infos))
+	return infos
+}
+
+func (n *netConfig) info() *NetworkInfo {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	info := &NetworkInfo{
+		ID:            n.ID,
+		SecurityGroup: n.SecurityGroup,
+		MTU:           n.MTU,
+		TxQueueLen:    n.TxQueueLen,
+		Routes:        n.Routes,
+		NoGateway:     n.NoGateway,
+		Endpoints:     []*EndpointInfo{},
+	}
+	for _, s := range n.Subnets {
+		si := &SubnetInfo{Vxnet: s.Vxnet, Router: s.Router, Pool: s.IPAMData.Pool, Gateway: s.IPAMData.Gateway}
+		if s.IPv6Data != nil {
+			si.PoolIPv6, si.GatewayIPv6 = s.IPv6Data.Pool, s.IPv6Data.Gateway
+		}
+		info.Subnets = append(info.Subnets, si)
+	}
+	for _, ep := range n.endpoints {
+		ei := &EndpointInfo{
+			NetworkID:     n.ID,
+			ID:            ep.ID,
+			NicID:         ep.NicID,
+			MAC:           ep.NicID,
+			IP:            ep.IP,
+			IPv6:          ep.IPv6,
+			Vxnet:         ep.Vxnet,
+			SandboxKey:    ep.SandboxKey,
+			EIP:           ep.EIP,
+			SecurityGroup: ep.SecurityGroup,
+			Stale:         ep.Stale,
+		}
+		if ep.LB != nil {
+			ei.LBBackend = ep.LB.ID
+		}
+		info.Endpoints = append(info.Endpoints, ei)
+	}
+	sort.Sort(endpointsByID(info.Endpoints))
+	return info
+}
+
+func (d *driver) Reconcile(dryRun bool) ([]*NicStatus, error) {
+	return d.reconcile(dryRun)
+}
+
+// GCResult is what GC cleaned up.
+type GCResult struct {
+	// Reservations are the expired reservations. Their nics became idle
+	// unless they're leaked.
+	Reservations []*util.Reservation
+	Nics         []*NicStatus
+}
+
+func (d *driver) GC() (*GCResult, error) {
+	expired, err := d.rs.GC()
+	if err != nil {
+		return nil, err
+	}
+	nics, err := d.reconcile(false)
+	if err != nil {
+		return nil, err
+	}
+	return &GCResult{Reservations: expired, Nics: nics}, nil
+}
+
+// ForceRelease deletes the endpoint regardless of its sandbox, e.g. when
+// docker lost track of it. The load balancer backend, the eip and the
+// security group of the endpoint are cleaned up on a best-effort basis, and
+// the nic is released by a reconcile like a leaked nic.
+func (d *driver) ForceRelease(nid, epid string) error {
+	n := d.getNetwork(nid)
+	if n == nil {
+		return fmt.Errorf("network %s not found", nid)
+	}
+	ep := n.getEndpoint(epid)
+	if ep == nil {
+		return fmt.Errorf("endpoint %s not found in network %s", epid, nid)
+	}
+
+	log := logrus.WithField("endpoint", ep.ID)
+	log.Warnf("Force releasing the endpoint with nic %s (sandbox %q)", ep.NicID, ep.SandboxKey)
+	if ep.LB != nil && ep.LB.ID != "" {
+		if err := d.removeBackend(ep); err != nil {
+			log.Errorf("Failed to remove the load balancer backend: %v", err)
+		}
+	}
+	if ep.EIP != "" {
+		if err := d.dissociateEip(ep); err != nil {
+			log.Errorf("Failed to dissociate the eip: %v", err)
+		}
+	}
+	if ep.SecurityGroup != "" {
+		if err := d.restoreSecurityGroup(ep); err != nil {
+			log.Errorf("Failed to restore the security group: %v", err)
+		}
+	}
+
+	n.mu.Lock()
+	delete(n.endpoints, ep.ID)
+	err := os.Remove(d.epConfigPath(n.ID, ep.ID))
+	n.mu.Unlock()
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := d.rs.Remove(ep.Vxnet, strings.Split(ep.IP, "/")[0]); err != nil {
+		return err
+	}
+
+	_, err = d.reconcile(false)
+	return err
+}
+
+// DetachIdleNic detaches the nic if it's attached to the instance and not
+// used, reserved or held by a sticky binding.
+func (d *driver) DetachIdleNic(nicID string) error {
+	nicID = strings.ToLower(nicID)
+	nics, err := d.api.DescribeNics(qcsdk.Params{"nics": nicID})
+	if err != nil {
+		return err
+	}
+	if len(nics) == 0 || nics[0].InstanceID != util.InstanceID {
+		return fmt.Errorf("nic %s is not attached to instance %s", nicID, util.InstanceID)
+	}
+	nic := nics[0]
+	if nic.Role == 1 {
+		return fmt.Errorf("nic %s is the primary nic of the instance", nicID)
+	}
+	if d.owner(nicID) != nil {
+		return fmt.Errorf("nic %s is used by an endpoint", nicID)
+	}
+	reserved, err := d.rs.Reserved()
+	if err != nil {
+		return err
+	}
+	if reserved[nicID] {
+		return fmt.Errorf("nic %s is reserved for an endpoint", nicID)
+	}
+	held, err := d.sticky.Held()
+	if err != nil {
+		return err
+	}
+	if held[nicID] {
+		return fmt.Errorf("nic %s is held by a sticky binding", nicID)
+	}
+
+	if err := d.cfg.Host.Release(nic.PrivateIP); err != nil {
+		logrus.WithField("nic", nicID).Errorf("Failed to remove the rules of the nic: %v", err)
+	}
+	if jobID, err := d.api.DetachNics([]string{nicID}, true); err != nil {
+		return fmt.Errorf("failed to detach nic %s. job_id: %s, err: %v", nicID, jobID, err)
+	}
+	metrics.MoveNic(nic.VxnetID, metrics.NicIdle, "")
+	logrus.WithField("nic", nicID).Info("Idle nic detached by the admin API")
+	return nil
+}
+
+func (d *driver) StickyBindings() ([]*util.StickyBinding, error) {
+	return d.sticky.List()
+}
+
+func (d *driver) Unbind(id string) error {
+	b, err := d.sticky.Get(id)
+	if err != nil {
+		return err
+	}
+	if b == nil {
+		return fmt.Errorf("%s has no sticky binding", id)
+	}
+	if err := d.sticky.Remove(id); err != nil {
+		return err
+	}
+	logrus.WithField("nic", b.NicID).Infof("Sticky binding of %s to %s removed", id, b.Address)
+	return nil
+}
+
+// owner returns the endpoint whose nic is nicID.
+func (d *driver) owner(nicID string) *endpoint {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, n := range d.networks {
+		n.mu.Lock()
+		for _, ep := range n.endpoints {
+			if ep.NicID == nicID {
+				n.mu.Unlock()
+				return ep
+			}
+		}
+		n.mu.Unlock()
+	}
+	return nil
+}
+
+type networksByID []*NetworkInfo
+
+func (n networksByID) Len() int           { return len(n) }
+func (n networksByID) Less(i, j int) bool { return n[i].ID < n[j].ID }
+func (n networksByID) Swap(i, j int)      { n[i], n[j] = n[j], n[i] }
+
+type endpointsByID []*EndpointInfo
+
+func (e endpointsByID) Len() int           { return len(e) }
+func (e endpointsByID) Less(i, j int) bool { return e[i].ID < e[j].ID }
+func (e endpointsByID) Swap(i, j int)      { e[i], e[j] = e[j], e[i] }
@@ -5,34 +5,73 @@ import (
 	"os"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/docker/go-plugins-helpers/network"
-	"github.com/nicescale/qcsdk"
+	sdktypes "github.com/nicescale/qcsdk/types"
+	"github.com/nicescale/qingcloud-docker-network/cloud"
 	"github.com/nicescale/qingcloud-docker-network/util"
 )
 
 var errNotImplemented = fmt.Errorf("not implemented")
 
-const (
-	maxIdleNicsPerInstance = 2
-)
-
 type endpoint struct {
+	Version    int
 	ID         string
 	NicID      string
 	IP         string
 	SandboxKey string
+	// Vxnet is the vxnet of the subnet that the address belongs to.
+	Vxnet string `json:",omitempty"`
+	// IPv6 is the IPv6 address of the nic on a dual-stack network.
+	IPv6 string `json:",omitempty"`
+
+	// EIP is the eip associated with the nic of the endpoint.
+	// ReleaseEIP is set if it was allocated for the endpoint and has to be
+	// released when the endpoint is deleted.
+	EIP        string `json:",omitempty"`
+	ReleaseEIP bool   `json:",omitempty"`
+	// SecurityGroup is the security group applied to the nic of the
+	// endpoint. PrevSecurityGroup is restored when the endpoint is deleted.
+	SecurityGroup     string `json:",omitempty"`
+	PrevSecurityGroup string `json:",omitempty"`
+	// LB is the load balancer backend registered while a container is
+	// joined to the endpoint.
+	LB *lbBackend `json:",omitempty"`
+
+	// Stale is set when the NIC of the endpoint vanished while the plugin
+	// was not running. Stale endpoints can only be deleted.
+	Stale bool
 }
 
 type netConfig struct {
-	ID        string
-	Vxnet     string
-	Router    string
-	IPAMData  *network.IPAMData
+	Version int
+	ID      string
+	// Subnets are the vxnets of the network, in the order that the IPAM
+	// driver allocates addresses from.
+	Subnets   []*subnet
 	endpoints map[string]*endpoint
 	gateway   string
 	mu        sync.Mutex
+
+	// SecurityGroup is applied to the nics of the endpoints that don't
+	// select one.
+	SecurityGroup string `json:",omitempty"`
+	// MTU and TxQueueLen are applied to the links of the endpoints on Join.
+	MTU        int `json:",omitempty"`
+	TxQueueLen int `json:",omitempty"`
+	// Routes are the static routes of the containers. NoGateway stops the
+	// network from providing the default gateway.
+	Routes    []*network.StaticRoute `json:",omitempty"`
+	NoGateway bool                   `json:",omitempty"`
+
+	// Vxnet, Router, IPAMData and IPv6Data are the single subnet of the
+	// networks saved by schema version 1 and earlier.
+	Vxnet    string            `json:",omitempty"`
+	Router   string            `json:",omitempty"`
+	IPAMData *network.IPAMData `json:",omitempty"`
+	IPv6Data *network.IPAMData `json:",omitempty"`
 }
 
 func (n *netConfig) getEndpoint(id string) *endpoint {
@@ -41,20 +80,74 @@ func (n *netConfig) getEndpoint(id string) *endpoint {
 	return n.endpoints[id]
 }
 
+// Config holds the tunables of the network driver.
+type Config struct {
+	// ReconcileInterval is how often the attached nics are reconciled
+	// with the endpoints. Zero means only reconcile at startup.
+	ReconcileInterval time.Duration
+	// ReconcileDryRun makes the reconciler only log what it would do.
+	ReconcileDryRun bool
+	// LeakedPolicy is LeakedRequeue or LeakedDetach.
+	LeakedPolicy string
+	// Host guards the routing of the host against the links of the idle
+	// nics. The links are left alone if it's nil.
+	Host *util.HostGuard
+	// DefaultSecurityGroup is applied to the nics that had no security
+	// group when the security group of their endpoint is restored.
+	DefaultSecurityGroup string
+}
+
 type driver struct {
-	api        *qcsdk.Api
+	api        cloud.API
+	nl         util.Netlink
 	root       string // The root path to store network files.
+	rs         *util.ReservationStore
+	sticky     *util.StickyStore
+	cfg        Config
 	mu         sync.Mutex
 	lockedNics map[string]bool
 	networks   map[string]*netConfig
+	// creating is the IDs of the endpoints being created, whose nics are
+	// claimed but not yet owned by the endpoints of their networks.
+	creating      map[string]bool
+	reconcileLock sync.Mutex
+}
+
+func New(api cloud.API, nl util.Netlink, root string, rs *util.ReservationStore, cfg Config) (Driver, error) {
+	driver, err := load(api, nl, root, rs, cfg)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := driver.reconcile(cfg.ReconcileDryRun); err != nil {
+		logrus.Errorf("Failed to reconcile nics: %v", err)
+	}
+	if cfg.ReconcileInterval > 0 {
+		go driver.runReconciler(cfg.ReconcileInterval)
+	}
+	return driver, nil
+}
+
+// Load loads the networks from root without reconciling the nics, e.g. for
+// inspecting the state of the plugin from the command line.
+func Load(api cloud.API, nl util.Netlink, root string, rs *util.ReservationStore, cfg Config) (Admin, error) {
+	return load(api, nl, root, rs, cfg)
 }
 
-func New(api *qcsdk.Api, root string) (network.Driver, error) {
+func load(api cloud.API, nl util.Netlink, root string, rs *util.ReservationStore, cfg Config) (*driver, error) {
+	if cfg.LeakedPolicy != LeakedRequeue && cfg.LeakedPolicy != LeakedDetach {
+		return nil, fmt.Errorf("invalid leaked nic policy %q", cfg.LeakedPolicy)
+	}
+
 	driver := &driver{
 		api:        api,
+		nl:         nl,
 		root:       root,
+		rs:         rs,
+		sticky:     util.NewStickyStore(root),
+		cfg:        cfg,
 		lockedNics: make(map[string]bool),
 		networks:   make(map[string]*netConfig),
+		creating:   make(map[string]bool),
 	}
 	if err := driver.loadNetworks(); err != nil {
 		return nil, err
@@ -74,18 +167,57 @@ func (d *driver) CreateNetwork(req *network.CreateNetworkRequest) error {
 	if !ok {
 		return fmt.Errorf(`must provide "-o vxnet=xxx" option`)
 	}
-	vxnet, ok := opts["vxnet"].(string)
-	if !ok || vxnet == "" {
+	vxnet, _ := opts["vxnet"].(string)
+	vxnets := util.SplitVxnets(vxnet)
+	if len(vxnets) == 0 {
 		return fmt.Errorf(`must provide "-o vxnet=xxx" option`)
 	}
+	if len(req.IPv4Data) == 0 {
+		return fmt.Errorf("no IPv4 pool is assigned to the network")
+	}
+	sopts := stringOpts(opts)
+
+	var vs []*sdktypes.Vxnet
+	mtu, qlen := 0, 0
+	for _, id := range vxnets {
+		v, err := util.DescribeVxnet(d.api, id)
+		if err != nil {
+			return err
+		}
+		vs = append(vs, v)
+		// The links of all the vxnets share the MTU of the network.
+		m, q, err := parseLinkOpts(sopts, v)
+		if err != nil {
+			return err
+		}
+		if mtu == 0 || m > 0 && m < mtu {
+			mtu = m
+		}
+		qlen = q
+	}
+	subnets, err := newSubnets(vs, req.IPv4Data, req.IPv6Data, func(err error) error {
+		if !util.BoolOpt(sopts, util.OptAllowSubnetMismatch) {
+			return fmt.Errorf(`%v. Use "-o %s=true" to override`, err, util.OptAllowSubnetMismatch)
+		}
+		logrus.Warnf("network.CreateNetwork: %v", err)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
 
 	n := &netConfig{
+		Version:   stateVersion,
 		ID:        req.NetworkID,
-		Router:    "",
-		Vxnet:     vxnet,
-		IPAMData:  req.IPv4Data[0],
+		Subnets:   subnets,
 		endpoints: make(map[string]*endpoint),
 	}
+	if n.Routes, err = parseRoutes(sopts[optRoutes], n.pools()); err != nil {
+		return err
+	}
+	n.SecurityGroup = sopts[optSecurityGroup]
+	n.MTU, n.TxQueueLen = mtu, qlen
+	n.NoGateway = util.BoolOpt(sopts, optNoGateway)
 	if err := d.writeFile(d.netConfigPath(n.ID), n); err != nil {
 		return err
 	}
@@ -109,13 +241,23 @@ func (d *driver) DeleteNetwork(req *network.DeleteNetworkRequest) error {
 	}
 	n.mu.Lock()
 	defer n.mu.Unlock()
-	if len(n.endpoints) > 1 {
-		return fmt.Errorf("can't delete the network because there are %d active endpoints within the network.", len(n.endpoints))
+	active := 0
+	for _, ep := range n.endpoints {
+		if !ep.Stale {
+			active++
+		}
+	}
+	if active > 0 {
+		return fmt.Errorf("can't delete the network because there are %d active endpoints within the network.", active)
 	}
 
 	d.mu.Lock()
 	defer d.mu.Unlock()
-	return os.RemoveAll(d.netConfigDir(n.ID))
+	if err := os.RemoveAll(d.netConfigDir(n.ID)); err != nil {
+		return err
+	}
+	delete(d.networks, n.ID)
+	return nil
 }
 
 func (d *driver) FreeNetwork(req *network.FreeNetworkRequest) error {
@@ -125,21 +267,60 @@ func (d *driver) FreeNetwork(req *network.FreeNetworkRequest) error {
 
 func (d *driver) CreateEndpoint(req *network.CreateEndpointRequest) (*network.CreateEndpointResponse, error) {
 	logrus.WithField("req", req).Debug("network.CreateEndpoint")
-	ip := ""
+	ip, ip6 := "", ""
 	if req.Interface != nil {
-		ip = req.Interface.Address
+		ip, ip6 = req.Interface.Address, req.Interface.AddressIPv6
 	}
 	n := d.getNetwork(req.NetworkID)
 	if n == nil {
 		return nil, fmt.Errorf("network %s not found", req.NetworkID)
 	}
 
-	ep, err := d.findAvailableNic(req.EndpointID, n.Vxnet, ip)
+	opts := stringOpts(req.Options)
+	eip, err := parseEipOpts(opts)
+	if err != nil {
+		return nil, err
+	}
+	lb, err := parseLBOpts(opts)
 	if err != nil {
 		return nil, err
 	}
+	if lb != nil {
+		if err := d.describeListener(lb); err != nil {
+			return nil, err
+		}
+	}
+	// The address selects the vxnet of the endpoint.
+	s := n.subnetOf(ip)
+	if s == nil {
+		return nil, fmt.Errorf("address %s is not in any subnet of network %s: %s", ip, n.ID, strings.Join(n.pools(), ","))
+	}
+	stickyID := opts[util.OptStickyID]
+	if stickyID != "" {
+		if err := d.checkSticky(stickyID, s.Vxnet, ip); err != nil {
+			return nil, err
+		}
+	}
 
-	if err := d.saveEndpoint(n.ID, ep); err != nil {
+	d.mu.Lock()
+	d.creating[req.EndpointID] = true
+	d.mu.Unlock()
+	defer func() {
+		d.mu.Lock()
+		delete(d.creating, req.EndpointID)
+		d.mu.Unlock()
+	}()
+
+	ep, err := d.findAvailableNic(req.EndpointID, s.Vxnet, ip)
+	if err != nil {
+		return nil, err
+	}
+	sg := n.SecurityGroup
+	if v := opts[optSecurityGroup]; v != "" {
+		sg = v
+	}
+	ep.LB = lb
+	if err := d.setupEndpoint(n, s, ep, ip6, stickyID, sg, eip); err != nil {
 		return nil, err
 	}
 
@@ -151,6 +332,9 @@ func (d *driver) CreateEndpoint(req *network.CreateEndpointRequest) (*network.Cr
 	if req.Interface == nil || req.Interface.Address == "" {
 		iface.Address = ep.IP
 	}
+	if ip6 == "" {
+		iface.AddressIPv6 = ep.IPv6
+	}
 
 	resp := &network.CreateEndpointResponse{
 		Interface: iface,
@@ -158,6 +342,78 @@ func (d *driver) CreateEndpoint(req *network.CreateEndpointRequest) (*network.Cr
 	return resp, nil
 }
 
+// setupEndpoint sets up the endpoint whose nic has been claimed and saves
+// it. On failure the steps done so far are reverted in reverse order and
+// the nic is unclaimed.
+func (d *driver) setupEndpoint(n *netConfig, s *subnet, ep *endpoint, ip6, stickyID, sg string, eip *eipOpts) (err error) {
+	var undo []func()
+	defer func() {
+		if err == nil {
+			return
+		}
+		for i := len(undo) - 1; i >= 0; i-- {
+			undo[i]()
+		}
+	}()
+	log := logrus.WithField("endpoint", ep.ID)
+
+	undo = append(undo, func() { d.unclaimNic(ep) })
+	if s.IPv6Data != nil {
+		if err := setIPv6(s, ep, ip6); err != nil {
+			return err
+		}
+	}
+	if stickyID != "" {
+		prev, err := d.sticky.Get(stickyID)
+		if err != nil {
+			return err
+		}
+		err = d.sticky.Set(&util.StickyBinding{
+			ID:      stickyID,
+			Vxnet:   s.Vxnet,
+			NicID:   ep.NicID,
+			Address: strings.Split(ep.IP, "/")[0],
+		})
+		if err != nil {
+			return err
+		}
+		undo = append(undo, func() {
+			var err error
+			if prev != nil {
+				err = d.sticky.Set(prev)
+			} else {
+				err = d.sticky.Remove(stickyID)
+			}
+			if err != nil {
+				log.Errorf("Failed to restore the sticky binding of %s: %v", stickyID, err)
+			}
+		})
+	}
+	if sg != "" {
+		if err := d.applySecurityGroup(ep, sg); err != nil {
+			return err
+		}
+		undo = append(undo, func() {
+			if err := d.restoreSecurityGroup(ep); err != nil {
+				log.Errorf("Failed to restore the security group of nic %s: %v", ep.NicID, err)
+			}
+		})
+	}
+	if eip != nil {
+		if err := d.associateEip(ep, eip); err != nil {
+			return err
+		}
+		undo = append(undo, func() {
+			// The eip was allocated for the endpoint, which never existed.
+			ep.ReleaseEIP = eip.ID == eipAuto
+			if err := d.dissociateEip(ep); err != nil {
+				log.Errorf("Failed to dissociate eip %s: %v", ep.EIP, err)
+			}
+		})
+	}
+	return d.saveEndpoint(n.ID, ep)
+}
+
 func (d *driver) DeleteEndpoint(req *network.DeleteEndpointRequest) error {
 	logrus.WithField("req", req).Debug("network.DeleteEndpoint")
 	n := d.getNetwork(req.NetworkID)
@@ -169,25 +425,32 @@ func (d *driver) DeleteEndpoint(req *network.DeleteEndpointRequest) error {
 		return nil
 	}
 
-	if ep.SandboxKey != "" {
+	if ep.SandboxKey != "" && !ep.Stale {
 		return fmt.Errorf("endpoint %s is used by another container", ep.ID)
 	}
-
-	links, err := util.LinkList()
-	if err != nil {
-		logrus.Errorf("Failed to get link list in DeleteEndpoint: %v", err)
-	} else {
-		for mac, l := range links {
-			if l.Type() != "device" || l.Attrs().Name == "lo" {
-				delete(links, mac)
-				continue
-			}
+	// The nic of a stale endpoint may be gone along with its backend, eip
+	// and security group, so failing to undo them must not leave the
+	// endpoint behind forever.
+	undo := func(what string, err error) error {
+		if err != nil && ep.Stale {
+			logrus.Warnf("Failed to %s of stale endpoint %s: %v", what, ep.ID, err)
+			return nil
 		}
-		// -1 means exclude the main nic of the VM
-		if len(links)-1 > maxIdleNicsPerInstance {
-			if jobID, err := d.api.DetachNics([]string{ep.NicID}, false); err != nil {
-				logrus.Errorf("failed to detach nic %s. job_id: %s, err: %v", ep.NicID, jobID, err)
-			}
+		return err
+	}
+	if ep.LB != nil && ep.LB.ID != "" {
+		if err := undo("remove the load balancer backend", d.removeBackend(ep)); err != nil {
+			return err
+		}
+	}
+	if ep.EIP != "" {
+		if err := undo("dissociate the eip", d.dissociateEip(ep)); err != nil {
+			return err
+		}
+	}
+	if ep.SecurityGroup != "" {
+		if err := undo("restore the security group", d.restoreSecurityGroup(ep)); err != nil {
+			return err
 		}
 	}
 
@@ -216,13 +479,37 @@ func (d *driver) Join(req *network.JoinRequest) (*network.JoinResponse, error) {
 	if ep == nil {
 		return nil, fmt.Errorf("no such endpoint")
 	}
+	if ep.Stale {
+		return nil, fmt.Errorf("endpoint %s is stale because its nic %s has gone", ep.ID, ep.NicID)
+	}
 
 	if ep.SandboxKey != "" {
 		return nil, fmt.Errorf("endpoint %s is used by another container", ep.ID)
 	}
+	s := n.subnet(ep.Vxnet)
+	if s == nil {
+		return nil, fmt.Errorf("vxnet %s of endpoint %s is not a subnet of network %s", ep.Vxnet, ep.ID, n.ID)
+	}
+
+	if err := d.configureLink(n, ep); err != nil {
+		return nil, err
+	}
+
+	// The load balancer jobs and the health check are awaited without
+	// holding the lock of the network.
+	backend := ""
+	if ep.LB != nil && ep.LB.ID == "" {
+		var err error
+		if backend, err = d.addBackend(ep); err != nil {
+			return nil, err
+		}
+	}
 
 	n.mu.Lock()
 	defer n.mu.Unlock()
+	if backend != "" {
+		ep.LB.ID = backend
+	}
 	ep.SandboxKey = req.SandboxKey
 	if err := d.saveEndpoint(n.ID, ep); err != nil {
 		return nil, err
@@ -233,7 +520,17 @@ func (d *driver) Join(req *network.JoinRequest) (*network.JoinResponse, error) {
 			SrcName:   genNicName(req.EndpointID),
 			DstPrefix: "eth",
 		},
-		Gateway: strings.Split(n.IPAMData.Gateway, "/")[0],
+		StaticRoutes: routesFor(n.Routes, s),
+	}
+	if n.NoGateway {
+		// Also keep docker from connecting the container to the
+		// docker_gwbridge network for external connectivity.
+		resp.DisableGatewayService = true
+	} else {
+		resp.Gateway = strings.Split(s.IPAMData.Gateway, "/")[0]
+		if s.IPv6Data != nil {
+			resp.GatewayIPv6 = strings.Split(s.IPv6Data.Gateway, "/")[0]
+		}
 	}
 	return resp, nil
 }
@@ -253,6 +550,13 @@ func (d *driver) Leave(req *network.LeaveRequest) error {
 		return nil
 	}
 
+	if ep.LB != nil && ep.LB.ID != "" {
+		// DeleteEndpoint retries if the backend can't be removed now.
+		if err := d.removeBackend(ep); err != nil {
+			logrus.Errorf("Failed to remove the load balancer backend of endpoint %s: %v", ep.ID, err)
+		}
+	}
+
 	n.mu.Lock()
 	defer n.mu.Unlock()
 	ep.SandboxKey = ""
@@ -0,0 +1,654 @@
+package network
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	dipam "github.com/docker/go-plugins-helpers/ipam"
+	"github.com/docker/go-plugins-helpers/network"
+	"github.com/nicescale/qcsdk"
+	sdktypes "github.com/nicescale/qcsdk/types"
+	"github.com/nicescale/qingcloud-docker-network/cloud/fake"
+	"github.com/nicescale/qingcloud-docker-network/drivers/ipam"
+	"github.com/nicescale/qingcloud-docker-network/util"
+	"github.com/nicescale/qingcloud-docker-network/util/nltest"
+)
+
+const (
+	testInstance = "i-test"
+	testVxnet    = "vxnet-a"
+	testPool     = "192.168.0.0/24"
+	testNetwork  = "net-0123456789abcdef"
+	testEndpoint = "ep-0123456789abcdef"
+)
+
+// testEnv is a network driver and an IPAM driver sharing an in-memory cloud
+// and host like the drivers of the plugin.
+type testEnv struct {
+	d      *driver
+	ipam   dipam.Ipam
+	c      *fake.Cloud
+	nl     *nltest.Memory // Unless the host is a nltest.Harness.
+	dir    string
+	poolID string
+}
+
+func newTestEnv(t *testing.T) *testEnv {
+	nl := nltest.NewMemory()
+	e := newTestEnvOn(t, nl, nl.AttachHook(), nl.DetachHook(), "")
+	e.nl = nl
+	return e
+}
+
+// newTestEnvOn creates the drivers on the host nl, where the hooks plug and
+// unplug the links of the nics. The idle links are guarded with the
+// idlePolicy if it's not empty.
+func newTestEnvOn(t *testing.T, nl util.Netlink, attach, detach func(*sdktypes.Nic), idlePolicy string) *testEnv {
+	util.InstanceID = testInstance
+	dir, err := ioutil.TempDir("", "network-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := fake.New()
+	c.AddVxnet(testVxnet, testPool)
+	c.AddSecurityGroup("sg-default")
+	c.AddSecurityGroup("sg-web")
+	c.OnAttach, c.OnDetach = attach, detach
+	rs := util.NewReservationStore(dir, time.Minute)
+	var host *util.HostGuard
+	if idlePolicy != "" {
+		if host, err = util.NewHostGuard(c, nl, idlePolicy); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	e := &testEnv{c: c, dir: dir}
+	e.ipam, err = ipam.New(c, nl, dir, rs, ipam.Config{LinkTimeout: time.Second, WarmInterval: time.Hour, Host: host})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.d, err = load(c, nl, dir, rs, Config{LeakedPolicy: LeakedRequeue, Host: host, DefaultSecurityGroup: "sg-default"}); err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+func (e *testEnv) close() {
+	os.RemoveAll(e.dir)
+}
+
+// createNetwork creates a network on the vxnet like docker network create.
+func (e *testEnv) createNetwork(t *testing.T, opts map[string]interface{}) {
+	resp, err := e.ipam.RequestPool(&dipam.RequestPoolRequest{Pool: testPool, Options: map[string]string{"vxnet": testVxnet}})
+	if err != nil {
+		t.Fatalf("RequestPool: %v", err)
+	}
+	e.poolID = resp.PoolID
+	gw, err := e.ipam.RequestAddress(&dipam.RequestAddressRequest{
+		PoolID:  e.poolID,
+		Options: map[string]string{"RequestAddressType": "com.docker.network.gateway"},
+	})
+	if err != nil {
+		t.Fatalf("RequestAddress of the gateway: %v", err)
+	}
+
+	generic := map[string]interface{}{"vxnet": testVxnet}
+	for k, v := range opts {
+		generic[k] = v
+	}
+	err = e.d.CreateNetwork(&network.CreateNetworkRequest{
+		NetworkID: testNetwork,
+		Options:   map[string]interface{}{"com.docker.network.generic": generic},
+		IPv4Data:  []*network.IPAMData{{AddressSpace: "QingCloud", Pool: resp.Pool, Gateway: gw.Address}},
+	})
+	if err != nil {
+		t.Fatalf("CreateNetwork: %v", err)
+	}
+}
+
+// createNetwork6 creates a dual-stack network on the vxnet with the IPv6
+// network like docker network create --ipv6, and returns the ID of the
+// IPv6 pool.
+func (e *testEnv) createNetwork6(t *testing.T, cidr6 string) string {
+	e.c.EnableIPv6(testVxnet, cidr6)
+	var data []*network.IPAMData
+	var pool6 string
+	for _, v6 := range []bool{false, true} {
+		pool := testPool
+		if v6 {
+			pool = cidr6
+		}
+		resp, err := e.ipam.RequestPool(&dipam.RequestPoolRequest{Pool: pool, V6: v6, Options: map[string]string{"vxnet": testVxnet}})
+		if err != nil {
+			t.Fatalf("RequestPool of %s: %v", pool, err)
+		}
+		if v6 {
+			pool6 = resp.PoolID
+		} else {
+			e.poolID = resp.PoolID
+		}
+		data = append(data, &network.IPAMData{AddressSpace: "QingCloud", Pool: resp.Pool, Gateway: resp.Data["com.docker.network.gateway"]})
+	}
+
+	err := e.d.CreateNetwork(&network.CreateNetworkRequest{
+		NetworkID: testNetwork,
+		Options:   map[string]interface{}{"com.docker.network.generic": map[string]interface{}{"vxnet": testVxnet}},
+		IPv4Data:  data[:1],
+		IPv6Data:  data[1:],
+	})
+	if err != nil {
+		t.Fatalf("CreateNetwork: %v", err)
+	}
+	return pool6
+}
+
+func (e *testEnv) reservation(t *testing.T, address string) *util.Reservation {
+	rs, err := e.d.rs.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range rs {
+		if r.Address == strings.Split(address, "/")[0] {
+			return r
+		}
+	}
+	return nil
+}
+
+func TestEndpointFlow(t *testing.T) {
+	tests := []struct {
+		name    string
+		netOpts map[string]interface{}
+		epOpts  map[string]interface{}
+		check   func(t *testing.T, e *testEnv, nic *sdktypes.Nic)
+	}{
+		{
+			name: "plain",
+		},
+		{
+			name:    "link settings",
+			netOpts: map[string]interface{}{optMTU: "1400", optTxQueueLen: "500"},
+			check: func(t *testing.T, e *testEnv, nic *sdktypes.Nic) {
+				link := e.nl.Link(nic.ID)
+				if link.Attrs().MTU != 1400 || link.Attrs().TxQLen != 500 {
+					t.Errorf("link has MTU %d and txqueuelen %d, want 1400 and 500", link.Attrs().MTU, link.Attrs().TxQLen)
+				}
+			},
+		},
+		{
+			name:    "security group",
+			netOpts: map[string]interface{}{optSecurityGroup: "sg-default"},
+			epOpts:  map[string]interface{}{optSecurityGroup: "sg-web"},
+			check: func(t *testing.T, e *testEnv, nic *sdktypes.Nic) {
+				if sg := e.c.Nic(nic.ID).SecurityGroup; sg != "sg-web" {
+					t.Errorf("nic has security group %q, want sg-web", sg)
+				}
+			},
+		},
+		{
+			name:   "eip",
+			epOpts: map[string]interface{}{optEip: eipAuto},
+			check: func(t *testing.T, e *testEnv, nic *sdktypes.Nic) {
+				ep := e.d.getNetwork(testNetwork).getEndpoint(testEndpoint)
+				if eip := e.c.Eip(ep.EIP); eip == nil || eip.Resource.ID != nic.ID {
+					t.Errorf("eip %+v is not associated with nic %s", eip, nic.ID)
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEnv(t)
+			defer e.close()
+			e.createNetwork(t, tt.netOpts)
+
+			addr, err := e.ipam.RequestAddress(&dipam.RequestAddressRequest{PoolID: e.poolID})
+			if err != nil {
+				t.Fatalf("RequestAddress: %v", err)
+			}
+			resp, err := e.d.CreateEndpoint(&network.CreateEndpointRequest{
+				NetworkID:  testNetwork,
+				EndpointID: testEndpoint,
+				Interface:  &network.EndpointInterface{Address: addr.Address},
+				Options:    tt.epOpts,
+			})
+			if err != nil {
+				t.Fatalf("CreateEndpoint: %v", err)
+			}
+			nic := e.c.Nic(resp.Interface.MacAddress)
+			if nic == nil || nic.PrivateIP.String() != strings.Split(addr.Address, "/")[0] {
+				t.Fatalf("nic %+v doesn't have address %s", nic, addr.Address)
+			}
+			if r := e.reservation(t, addr.Address); r == nil || r.EndpointID != testEndpoint {
+				t.Fatalf("reservation %+v is not claimed by the endpoint", r)
+			}
+			if link := e.nl.Link(nic.ID); link == nil || link.Attrs().Name != genNicName(testEndpoint) {
+				t.Fatalf("link %+v is not renamed for the endpoint", link)
+			}
+
+			join, err := e.d.Join(&network.JoinRequest{NetworkID: testNetwork, EndpointID: testEndpoint, SandboxKey: "/var/run/docker/netns/test"})
+			if err != nil {
+				t.Fatalf("Join: %v", err)
+			}
+			if join.InterfaceName.SrcName != genNicName(testEndpoint) || join.Gateway != "192.168.0.1" {
+				t.Errorf("Join = %+v, want link %s and gateway 192.168.0.1", join, genNicName(testEndpoint))
+			}
+			if tt.check != nil {
+				tt.check(t, e, nic)
+			}
+
+			if err := e.d.Leave(&network.LeaveRequest{NetworkID: testNetwork, EndpointID: testEndpoint}); err != nil {
+				t.Fatalf("Leave: %v", err)
+			}
+			if err := e.d.DeleteEndpoint(&network.DeleteEndpointRequest{NetworkID: testNetwork, EndpointID: testEndpoint}); err != nil {
+				t.Fatalf("DeleteEndpoint: %v", err)
+			}
+			if err := e.ipam.ReleaseAddress(&dipam.ReleaseAddressRequest{PoolID: e.poolID, Address: addr.Address}); err != nil {
+				t.Fatalf("ReleaseAddress: %v", err)
+			}
+
+			if r := e.reservation(t, addr.Address); r != nil {
+				t.Errorf("reservation %+v left after the address is released", r)
+			}
+			if n := e.c.Calls("AssociateEip"); n != e.c.Calls("DissociateEips") {
+				t.Errorf("%d eips associated but %d dissociated", n, e.c.Calls("DissociateEips"))
+			}
+		})
+	}
+}
+
+func TestDualStackEndpoint(t *testing.T) {
+	tests := []struct {
+		name string
+		// ip6 is the IPv6 address that docker passes to CreateEndpoint:
+		// "ipam" for the one assigned by the IPAM driver, or "" for none.
+		ip6 string
+		// want is the error of CreateEndpoint, if any.
+		want string
+	}{
+		{name: "assigned", ip6: "ipam"},
+		{name: "not assigned"},
+		{name: "address of no nic", ip6: "fd00:1::99/64", want: "doesn't belong to nic"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEnv(t)
+			defer e.close()
+			pool6 := e.createNetwork6(t, "fd00:1::/64")
+
+			addr, err := e.ipam.RequestAddress(&dipam.RequestAddressRequest{PoolID: e.poolID})
+			if err != nil {
+				t.Fatalf("RequestAddress: %v", err)
+			}
+			ip6 := tt.ip6
+			if ip6 == "ipam" {
+				addr6, err := e.ipam.RequestAddress(&dipam.RequestAddressRequest{PoolID: pool6})
+				if err != nil {
+					t.Fatalf("RequestAddress of IPv6: %v", err)
+				}
+				ip6 = addr6.Address
+			}
+			resp, err := e.d.CreateEndpoint(&network.CreateEndpointRequest{
+				NetworkID:  testNetwork,
+				EndpointID: testEndpoint,
+				Interface:  &network.EndpointInterface{Address: addr.Address, AddressIPv6: ip6},
+			})
+			if tt.want != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.want) {
+					t.Fatalf("CreateEndpoint error = %v, want %q", err, tt.want)
+				}
+				if r := e.reservation(t, addr.Address); r == nil || r.EndpointID != "" {
+					t.Errorf("reservation %+v is claimed after the failure", r)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("CreateEndpoint: %v", err)
+			}
+
+			nic := e.c.Nic(resp.Interface.MacAddress)
+			want6 := nic.PrivateIPv6.String() + "/64"
+			ep := e.d.getNetwork(testNetwork).getEndpoint(testEndpoint)
+			if ep.IPv6 != want6 {
+				t.Errorf("endpoint IPv6 = %s, want %s of the nic", ep.IPv6, want6)
+			}
+			// The address is returned only if docker didn't assign it.
+			if ip6 != "" {
+				want6 = ""
+			}
+			if resp.Interface.AddressIPv6 != want6 {
+				t.Errorf("CreateEndpoint returned IPv6 address %q, want %q", resp.Interface.AddressIPv6, want6)
+			}
+			join, err := e.d.Join(&network.JoinRequest{NetworkID: testNetwork, EndpointID: testEndpoint, SandboxKey: "/var/run/docker/netns/test"})
+			if err != nil {
+				t.Fatalf("Join: %v", err)
+			}
+			if join.Gateway != "192.168.0.1" || join.GatewayIPv6 != "fd00:1::1" {
+				t.Errorf("Join = %+v, want gateways 192.168.0.1 and fd00:1::1", join)
+			}
+
+			if err := e.d.Leave(&network.LeaveRequest{NetworkID: testNetwork, EndpointID: testEndpoint}); err != nil {
+				t.Fatalf("Leave: %v", err)
+			}
+			if err := e.d.DeleteEndpoint(&network.DeleteEndpointRequest{NetworkID: testNetwork, EndpointID: testEndpoint}); err != nil {
+				t.Fatalf("DeleteEndpoint: %v", err)
+			}
+			if ip6 != "" {
+				if err := e.ipam.ReleaseAddress(&dipam.ReleaseAddressRequest{PoolID: pool6, Address: ip6}); err != nil {
+					t.Fatalf("ReleaseAddress of IPv6: %v", err)
+				}
+			}
+			if err := e.ipam.ReleaseAddress(&dipam.ReleaseAddressRequest{PoolID: e.poolID, Address: addr.Address}); err != nil {
+				t.Fatalf("ReleaseAddress: %v", err)
+			}
+			if r := e.reservation(t, addr.Address); r != nil {
+				t.Errorf("reservation %+v left after the addresses are released", r)
+			}
+		})
+	}
+}
+
+func TestCreateEndpointFailure(t *testing.T) {
+	tests := []struct {
+		name   string
+		opts   map[string]interface{}
+		inject func(e *testEnv)
+		want   string
+	}{
+		{
+			name:   "rename failure",
+			inject: func(e *testEnv) { e.nl.InjectError("RenameLink", fmt.Errorf("device or resource busy")) },
+			want:   "device or resource busy",
+		},
+		{
+			name:   "unknown security group",
+			opts:   map[string]interface{}{optSecurityGroup: "sg-unknown"},
+			inject: func(e *testEnv) {},
+			want:   "sg-unknown",
+		},
+		{
+			name: "security group job timeout",
+			opts: map[string]interface{}{optSecurityGroup: "sg-web"},
+			inject: func(e *testEnv) {
+				e.c.JobLatency = 200 * time.Millisecond
+				e.c.WaitTimeout = 20 * time.Millisecond
+			},
+			want: sdktypes.ErrJobTimeout.Error(),
+		},
+		{
+			name: "eip failure",
+			opts: map[string]interface{}{optSecurityGroup: "sg-web", util.OptStickyID: "web-1", optEip: eipAuto},
+			inject: func(e *testEnv) {
+				e.c.InjectError("AssociateEip", sdktypes.ResponseStatus{Code: fake.CodeInternalError, Message: "internal error"})
+			},
+			want: "internal error",
+		},
+		{
+			name: "save failure",
+			opts: map[string]interface{}{optSecurityGroup: "sg-web", util.OptStickyID: "web-1", optEip: eipAuto, optEipRelease: "false"},
+			inject: func(e *testEnv) {
+				// The endpoint file can't be written into a regular file.
+				if err := ioutil.WriteFile(e.d.netConfigDir(testNetwork)+"/endpoints", nil, 0600); err != nil {
+					panic(err)
+				}
+			},
+			want: "endpoints",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEnv(t)
+			defer e.close()
+			e.createNetwork(t, nil)
+			addr, err := e.ipam.RequestAddress(&dipam.RequestAddressRequest{PoolID: e.poolID})
+			if err != nil {
+				t.Fatalf("RequestAddress: %v", err)
+			}
+			r := e.reservation(t, addr.Address)
+			if _, err := e.c.ApplySecurityGroup("sg-default", []string{r.NicID}, true); err != nil {
+				t.Fatal(err)
+			}
+
+			tt.inject(e)
+			_, err = e.d.CreateEndpoint(&network.CreateEndpointRequest{
+				NetworkID:  testNetwork,
+				EndpointID: testEndpoint,
+				Interface:  &network.EndpointInterface{Address: addr.Address},
+				Options:    tt.opts,
+			})
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("CreateEndpoint error = %v, want %q", err, tt.want)
+			}
+
+			if ep := e.d.getNetwork(testNetwork).getEndpoint(testEndpoint); ep != nil {
+				t.Errorf("endpoint %+v is created", ep)
+			}
+			if r := e.reservation(t, addr.Address); r == nil || r.EndpointID != "" {
+				t.Errorf("reservation %+v is not left unclaimed", r)
+			}
+			if link := e.nl.Link(r.NicID); link == nil || link.Attrs().Name != util.CanonicalNicName(r.NicID) {
+				t.Errorf("link %+v doesn't have its canonical name", link)
+			}
+			if got := e.c.Nic(r.NicID).SecurityGroup; got != "sg-default" {
+				t.Errorf("nic has security group %q after the failure, want sg-default", got)
+			}
+			if b, err := e.d.sticky.Get("web-1"); err != nil || b != nil {
+				t.Errorf("sticky binding %+v, %v left after the failure", b, err)
+			}
+			if n := e.c.Calls("AllocateEips"); n != e.c.Calls("ReleaseEips") {
+				t.Errorf("%d eips allocated but %d released", n, e.c.Calls("ReleaseEips"))
+			}
+		})
+	}
+}
+
+func TestStickyEndpoints(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	e.createNetwork(t, nil)
+	endpoints := map[string]string{"web-0": "ep0-0123456789abcdef", "web-1": "ep1-0123456789abcdef"}
+
+	// create creates the endpoint of the container with the address, or
+	// any address if it's empty, and returns its nic.
+	create := func(id, address string) (string, error) {
+		addr, err := e.ipam.RequestAddress(&dipam.RequestAddressRequest{PoolID: e.poolID, Address: address})
+		if err != nil {
+			t.Fatalf("RequestAddress: %v", err)
+		}
+		resp, err := e.d.CreateEndpoint(&network.CreateEndpointRequest{
+			NetworkID:  testNetwork,
+			EndpointID: endpoints[id],
+			Interface:  &network.EndpointInterface{Address: addr.Address},
+			Options:    map[string]interface{}{util.OptStickyID: id},
+		})
+		if err != nil {
+			e.ipam.ReleaseAddress(&dipam.ReleaseAddressRequest{PoolID: e.poolID, Address: addr.Address})
+			return "", err
+		}
+		return resp.Interface.MacAddress, nil
+	}
+	remove := func(id, nicID string) {
+		if err := e.d.DeleteEndpoint(&network.DeleteEndpointRequest{NetworkID: testNetwork, EndpointID: endpoints[id]}); err != nil {
+			t.Fatalf("DeleteEndpoint: %v", err)
+		}
+		address := e.c.Nic(nicID).PrivateIP.String() + "/24"
+		if err := e.ipam.ReleaseAddress(&dipam.ReleaseAddressRequest{PoolID: e.poolID, Address: address}); err != nil {
+			t.Fatalf("ReleaseAddress: %v", err)
+		}
+	}
+
+	bound := make(map[string]string)
+	for id := range endpoints {
+		nicID, err := create(id, "")
+		if err != nil {
+			t.Fatalf("CreateEndpoint for %s: %v", id, err)
+		}
+		bound[id] = nicID
+	}
+	if bound["web-0"] == bound["web-1"] {
+		t.Fatalf("both containers got nic %s", bound["web-0"])
+	}
+	for id, nicID := range bound {
+		if b, err := e.d.sticky.Get(id); err != nil || b == nil || b.NicID != nicID {
+			t.Errorf("binding of %s = %+v, %v, want nic %s", id, b, err, nicID)
+		}
+		remove(id, nicID)
+	}
+
+	// A container is refused any address but its bound one.
+	if _, err := create("web-0", e.c.Nic(bound["web-1"]).PrivateIP.String()); err == nil || !strings.Contains(err.Error(), "is bound to") {
+		t.Errorf("CreateEndpoint for web-0 with the address of web-1: %v, want the bound address error", err)
+	}
+	for id, nicID := range bound {
+		got, err := create(id, e.c.Nic(nicID).PrivateIP.String())
+		if err != nil {
+			t.Fatalf("CreateEndpoint for %s with its address: %v", id, err)
+		}
+		if got != nicID {
+			t.Errorf("%s got nic %s, want the bound %s", id, got, nicID)
+		}
+	}
+}
+
+func TestSecurityGroupWithoutPrevious(t *testing.T) {
+	tests := []struct {
+		name string
+		def  string
+		// want is the error of CreateEndpoint, if any.
+		want string
+	}{
+		{name: "default restored", def: "sg-default"},
+		{name: "no default", want: "no security group to restore"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEnv(t)
+			defer e.close()
+			e.d.cfg.DefaultSecurityGroup = tt.def
+			e.createNetwork(t, nil)
+			addr, err := e.ipam.RequestAddress(&dipam.RequestAddressRequest{PoolID: e.poolID})
+			if err != nil {
+				t.Fatalf("RequestAddress: %v", err)
+			}
+			r := e.reservation(t, addr.Address)
+
+			_, err = e.d.CreateEndpoint(&network.CreateEndpointRequest{
+				NetworkID:  testNetwork,
+				EndpointID: testEndpoint,
+				Interface:  &network.EndpointInterface{Address: addr.Address},
+				Options:    map[string]interface{}{optSecurityGroup: "sg-web"},
+			})
+			if tt.want != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.want) {
+					t.Fatalf("CreateEndpoint error = %v, want %q", err, tt.want)
+				}
+				if sg := e.c.Nic(r.NicID).SecurityGroup; sg != "" {
+					t.Errorf("nic has security group %q after the failure, want none", sg)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("CreateEndpoint: %v", err)
+			}
+			if err := e.d.DeleteEndpoint(&network.DeleteEndpointRequest{NetworkID: testNetwork, EndpointID: testEndpoint}); err != nil {
+				t.Fatalf("DeleteEndpoint: %v", err)
+			}
+			if sg := e.c.Nic(r.NicID).SecurityGroup; sg != tt.def {
+				t.Errorf("nic has security group %q after the endpoint is deleted, want %s", sg, tt.def)
+			}
+		})
+	}
+}
+
+func TestJoinLoadBalancer(t *testing.T) {
+	tests := []struct {
+		name    string
+		timeout string
+		healthy bool
+		// want is the error of Join, if any.
+		want string
+	}{
+		{name: "no health timeout"},
+		{name: "healthy", timeout: "1s", healthy: true},
+		{name: "health timeout", timeout: "50ms", want: "isn't healthy"},
+	}
+
+	defer func(d time.Duration) { lbPollInterval = d }(lbPollInterval)
+	lbPollInterval = 10 * time.Millisecond
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEnv(t)
+			defer e.close()
+			e.createNetwork(t, nil)
+			l := e.c.AddLoadBalancerListener("lb-test", 80)
+			opts := map[string]interface{}{optLBListener: l.ID, optLBPort: "8080"}
+			if tt.timeout != "" {
+				opts[optLBHealthTimeout] = tt.timeout
+			}
+			addr, err := e.ipam.RequestAddress(&dipam.RequestAddressRequest{PoolID: e.poolID})
+			if err != nil {
+				t.Fatalf("RequestAddress: %v", err)
+			}
+			if _, err := e.d.CreateEndpoint(&network.CreateEndpointRequest{
+				NetworkID:  testNetwork,
+				EndpointID: testEndpoint,
+				Interface:  &network.EndpointInterface{Address: addr.Address},
+				Options:    opts,
+			}); err != nil {
+				t.Fatalf("CreateEndpoint: %v", err)
+			}
+
+			if tt.healthy {
+				// The health check passes once the backend is added.
+				go func() {
+					for i := 0; i < 100; i++ {
+						bs, _ := e.c.DescribeLoadBalancerBackends(qcsdk.Params{"loadbalancer_listener": l.ID})
+						if len(bs) > 0 {
+							e.c.SetBackendStatus(bs[0].ID, lbBackendUp)
+							return
+						}
+						time.Sleep(5 * time.Millisecond)
+					}
+				}()
+			}
+
+			_, err = e.d.Join(&network.JoinRequest{NetworkID: testNetwork, EndpointID: testEndpoint, SandboxKey: "/var/run/docker/netns/test"})
+			ep := e.d.getNetwork(testNetwork).getEndpoint(testEndpoint)
+			bs, derr := e.c.DescribeLoadBalancerBackends(qcsdk.Params{"loadbalancer_listener": l.ID})
+			if derr != nil {
+				t.Fatal(derr)
+			}
+			if tt.want != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.want) {
+					t.Fatalf("Join error = %v, want %q", err, tt.want)
+				}
+				if len(bs) != 0 || ep.LB.ID != "" || ep.SandboxKey != "" {
+					t.Errorf("backends %+v and endpoint %+v left after the failure", bs, ep)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Join: %v", err)
+			}
+			if len(bs) != 1 || ep.LB.ID != bs[0].ID {
+				t.Fatalf("endpoint has backend %q, want the only one of %+v", ep.LB.ID, bs)
+			}
+
+			if err := e.d.Leave(&network.LeaveRequest{NetworkID: testNetwork, EndpointID: testEndpoint}); err != nil {
+				t.Fatalf("Leave: %v", err)
+			}
+			if b := e.c.LoadBalancerBackend(bs[0].ID); b != nil || ep.LB.ID != "" {
+				t.Errorf("backend %+v left after Leave", b)
+			}
+		})
+	}
+}
@@ -0,0 +1,124 @@
+package network
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/nicescale/qcsdk"
+	"github.com/nicescale/qingcloud-docker-network/util"
+)
+
+// The endpoint options to associate an eip with the nic of the endpoint.
+const (
+	// optEip is the ID of an available eip, or eipAuto to allocate one.
+	optEip = "eip"
+	// optEipBandwidth is the bandwidth in Mbps of an allocated eip.
+	optEipBandwidth = "eip_bandwidth"
+	// optEipBillingMode is "bandwidth" or "traffic".
+	optEipBillingMode = "eip_billing_mode"
+	// optEipRelease selects whether an allocated eip is released when the
+	// endpoint is deleted. It defaults to true.
+	optEipRelease = "eip_release"
+
+	eipAuto = "auto"
+	// eipName is the name of the eips allocated by the plugin.
+	eipName = "qingcloud-docker-network"
+)
+
+type eipOpts struct {
+	ID          string
+	Bandwidth   int
+	BillingMode string
+	Release     bool
+}
+
+// parseEipOpts returns nil if no eip is requested.
+func parseEipOpts(opts map[string]string) (*eipOpts, error) {
+	id := opts[optEip]
+	if id == "" {
+		return nil, nil
+	}
+
+	o := &eipOpts{ID: id, Bandwidth: 1, BillingMode: "bandwidth", Release: true}
+	if v := opts[optEipBandwidth]; v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid %s %q: must be a positive integer", optEipBandwidth, v)
+		}
+		o.Bandwidth = n
+	}
+	if v := opts[optEipBillingMode]; v != "" {
+		if v != "bandwidth" && v != "traffic" {
+			return nil, fmt.Errorf("invalid %s %q. Valid values are bandwidth and traffic", optEipBillingMode, v)
+		}
+		o.BillingMode = v
+	}
+	if v := opts[optEipRelease]; v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %q", optEipRelease, v)
+		}
+		o.Release = b
+	}
+	return o, nil
+}
+
+// associateEip associates the eip with the nic of the endpoint, allocating
+// one first if requested. An allocated eip is released again on failure.
+func (d *driver) associateEip(ep *endpoint, o *eipOpts) error {
+	id := o.ID
+	if id == eipAuto {
+		ids, err := d.api.AllocateEips(o.Bandwidth, o.BillingMode, 1, eipName)
+		if err != nil {
+			return fmt.Errorf("failed to allocate eip: %v", err)
+		}
+		id = ids[0]
+		logrus.WithField("eip", id).Infof("Eip allocated for endpoint %s", ep.ID)
+	}
+
+	if jobID, err := d.api.AssociateEip(id, util.InstanceID, ep.NicID, true); err != nil {
+		if o.ID == eipAuto {
+			if err := d.api.ReleaseEips([]string{id}); err != nil {
+				logrus.WithField("eip", id).Errorf("Failed to release eip: %v", err)
+			}
+		}
+		return fmt.Errorf("failed to associate eip %s with nic %s. job_id: %s, err: %v", id, ep.NicID, jobID, err)
+	}
+	logrus.WithField("eip", id).Infof("Eip associated with nic %s", ep.NicID)
+
+	ep.EIP = id
+	ep.ReleaseEIP = o.ID == eipAuto && o.Release
+	return nil
+}
+
+// dissociateEip dissociates the eip of the endpoint from its nic and
+// releases it if it was allocated for the endpoint.
+// It can be retried after a failure.
+func (d *driver) dissociateEip(ep *endpoint) error {
+	eips, err := d.api.DescribeEips(qcsdk.Params{"eips": ep.EIP})
+	if err != nil {
+		return err
+	}
+	if len(eips) == 0 {
+		logrus.WithField("eip", ep.EIP).Warnf("Eip of endpoint %s no longer exists", ep.ID)
+		return nil
+	}
+
+	eip := eips[0]
+	if eip.Status == "associated" && eip.Resource.ID == ep.NicID {
+		if jobID, err := d.api.DissociateEips([]string{ep.EIP}, true); err != nil {
+			return fmt.Errorf("failed to dissociate eip %s from nic %s. job_id: %s, err: %v", ep.EIP, ep.NicID, jobID, err)
+		}
+		logrus.WithField("eip", ep.EIP).Infof("Eip dissociated from nic %s", ep.NicID)
+	}
+
+	if !ep.ReleaseEIP {
+		return nil
+	}
+	if err := d.api.ReleaseEips([]string{ep.EIP}); err != nil {
+		return fmt.Errorf("failed to release eip %s: %v", ep.EIP, err)
+	}
+	logrus.WithField("eip", ep.EIP).Info("Eip released")
+	return nil
+}
@@ -0,0 +1,161 @@
+package network
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	dipam "github.com/docker/go-plugins-helpers/ipam"
+	"github.com/docker/go-plugins-helpers/network"
+	"github.com/nicescale/qingcloud-docker-network/util"
+	"github.com/nicescale/qingcloud-docker-network/util/nltest"
+	"github.com/vishvananda/netlink"
+)
+
+// The tests below run the drivers against dummy links in a private network
+// namespace. They are skipped without CAP_NET_ADMIN.
+
+// idleRules returns the rules installed by the HostGuard for ip.
+func idleRules(t *testing.T, nl util.Netlink, ip string) []netlink.Rule {
+	all, err := nl.RuleList(netlink.FAMILY_V4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rules []netlink.Rule
+	for _, r := range all {
+		if r.Src != nil && r.Src.IP.Equal(net.ParseIP(ip)) {
+			rules = append(rules, r)
+		}
+	}
+	return rules
+}
+
+func TestIdleHandoff(t *testing.T) {
+	tests := []struct {
+		policy string
+		up     bool
+		rules  int
+	}{
+		{policy: util.IdleLinkDown},
+		{policy: util.IdleLinkUp, up: true, rules: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			h := nltest.NewForTest(t)
+			defer h.Close()
+			e := newTestEnvOn(t, h.Netlink, h.AttachHook(), h.DetachHook(), tt.policy)
+			defer e.close()
+			e.createNetwork(t, nil)
+
+			addr, err := e.ipam.RequestAddress(&dipam.RequestAddressRequest{PoolID: e.poolID})
+			if err != nil {
+				t.Fatalf("RequestAddress: %v", err)
+			}
+			ip := strings.Split(addr.Address, "/")[0]
+			r := e.reservation(t, ip)
+			link, err := h.Netlink.LinkByName(util.CanonicalNicName(r.NicID))
+			if err != nil {
+				t.Fatalf("idle link not found: %v", err)
+			}
+			if up := link.Attrs().Flags&net.FlagUp != 0; up != tt.up {
+				t.Errorf("idle link is up: %v, want %v", up, tt.up)
+			}
+			if rules := idleRules(t, h.Netlink, ip); len(rules) != tt.rules {
+				t.Errorf("%d rules from %s for the idle link, want %d", len(rules), ip, tt.rules)
+			}
+
+			_, err = e.d.CreateEndpoint(&network.CreateEndpointRequest{
+				NetworkID:  testNetwork,
+				EndpointID: testEndpoint,
+				Interface:  &network.EndpointInterface{Address: addr.Address},
+			})
+			if err != nil {
+				t.Fatalf("CreateEndpoint: %v", err)
+			}
+			link, err = h.Netlink.LinkByName(genNicName(testEndpoint))
+			if err != nil {
+				t.Fatalf("link of the endpoint not found: %v", err)
+			}
+			if link.Attrs().HardwareAddr.String() != r.NicID {
+				t.Errorf("link of the endpoint has address %s, want %s", link.Attrs().HardwareAddr, r.NicID)
+			}
+			if rules := idleRules(t, h.Netlink, ip); len(rules) != 0 {
+				t.Errorf("rules %v left for the claimed link", rules)
+			}
+		})
+	}
+}
+
+func TestRenameConflict(t *testing.T) {
+	h := nltest.NewForTest(t)
+	defer h.Close()
+	e := newTestEnvOn(t, h.Netlink, h.AttachHook(), h.DetachHook(), util.IdleLinkUp)
+	defer e.close()
+	e.createNetwork(t, nil)
+
+	addr, err := e.ipam.RequestAddress(&dipam.RequestAddressRequest{PoolID: e.poolID})
+	if err != nil {
+		t.Fatalf("RequestAddress: %v", err)
+	}
+	ip := strings.Split(addr.Address, "/")[0]
+	r := e.reservation(t, ip)
+
+	// A leftover link with the name of the endpoint makes the rename fail.
+	other, err := h.AddLink("02:00:00:00:00:02")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Netlink.RenameLink(other, genNicName(testEndpoint)); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = e.d.CreateEndpoint(&network.CreateEndpointRequest{
+		NetworkID:  testNetwork,
+		EndpointID: testEndpoint,
+		Interface:  &network.EndpointInterface{Address: addr.Address},
+	})
+	if err == nil {
+		t.Fatal("CreateEndpoint succeeded with a conflicting link name")
+	}
+	if r := e.reservation(t, ip); r == nil || r.EndpointID != "" {
+		t.Errorf("reservation %+v is not left unclaimed", r)
+	}
+	if _, err := h.Netlink.LinkByName(util.CanonicalNicName(r.NicID)); err != nil {
+		t.Errorf("link of nic %s doesn't have its canonical name: %v", r.NicID, err)
+	}
+	if rules := idleRules(t, h.Netlink, ip); len(rules) != 1 {
+		t.Errorf("%d rules from %s for the idle link, want 1", len(rules), ip)
+	}
+}
+
+func TestLinkSettings(t *testing.T) {
+	h := nltest.NewForTest(t)
+	defer h.Close()
+	e := newTestEnvOn(t, h.Netlink, h.AttachHook(), h.DetachHook(), util.IdleLinkDown)
+	defer e.close()
+	e.createNetwork(t, map[string]interface{}{optMTU: "1400", optTxQueueLen: "500"})
+
+	addr, err := e.ipam.RequestAddress(&dipam.RequestAddressRequest{PoolID: e.poolID})
+	if err != nil {
+		t.Fatalf("RequestAddress: %v", err)
+	}
+	if _, err := e.d.CreateEndpoint(&network.CreateEndpointRequest{
+		NetworkID:  testNetwork,
+		EndpointID: testEndpoint,
+		Interface:  &network.EndpointInterface{Address: addr.Address},
+	}); err != nil {
+		t.Fatalf("CreateEndpoint: %v", err)
+	}
+	if _, err := e.d.Join(&network.JoinRequest{NetworkID: testNetwork, EndpointID: testEndpoint, SandboxKey: "/var/run/docker/netns/test"}); err != nil {
+		t.Fatalf("Join: %v", err)
+	}
+
+	link, err := h.Netlink.LinkByName(genNicName(testEndpoint))
+	if err != nil {
+		t.Fatalf("link of the endpoint not found: %v", err)
+	}
+	if link.Attrs().MTU != 1400 || link.Attrs().TxQLen != 500 {
+		t.Errorf("link has MTU %d and txqueuelen %d, want 1400 and 500", link.Attrs().MTU, link.Attrs().TxQLen)
+	}
+}
@@ -0,0 +1,175 @@
+package network
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/nicescale/qcsdk"
+	sdktypes "github.com/nicescale/qcsdk/types"
+	"github.com/nicescale/qingcloud-docker-network/util"
+)
+
+// The endpoint options to register the nic of the endpoint as a backend of
+// a load balancer listener while a container is joined to the endpoint.
+const (
+	// optLBListener is the ID of the listener.
+	optLBListener = "lb_listener"
+	// optLBPort is the port of the container that the listener forwards to.
+	optLBPort = "lb_port"
+	// optLBWeight is the weight of the backend, 1 to 100. It defaults to 5.
+	optLBWeight = "lb_weight"
+	// optLBHealthTimeout is how long Join waits for a new backend to pass
+	// the health check, e.g. 60s. Join fails if it doesn't. The health
+	// isn't awaited if it's not set.
+	optLBHealthTimeout = "lb_health_timeout"
+
+	// lbBackendUp is the status of a backend that passes the health check.
+	lbBackendUp = "up"
+)
+
+// lbPollInterval is how often the health of a new backend is checked.
+var lbPollInterval = 2 * time.Second
+
+// lbBackend is the load balancer backend of an endpoint.
+type lbBackend struct {
+	Listener      string
+	LoadBalancer  string
+	Port          int
+	Weight        int
+	HealthTimeout time.Duration `json:",omitempty"`
+	// ID is the ID of the backend while a container is joined.
+	ID string `json:",omitempty"`
+}
+
+// parseLBOpts returns nil if no listener is requested.
+func parseLBOpts(opts map[string]string) (*lbBackend, error) {
+	listener := opts[optLBListener]
+	if listener == "" {
+		return nil, nil
+	}
+
+	b := &lbBackend{Listener: listener, Weight: 5}
+	port, err := strconv.Atoi(opts[optLBPort])
+	if err != nil || port < 1 || port > 65535 {
+		return nil, fmt.Errorf(`must provide a valid "%s" option with "%s"`, optLBPort, optLBListener)
+	}
+	b.Port = port
+	if v := opts[optLBWeight]; v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 100 {
+			return nil, fmt.Errorf("invalid %s %q: must be an integer from 1 to 100", optLBWeight, v)
+		}
+		b.Weight = n
+	}
+	if v := opts[optLBHealthTimeout]; v != "" {
+		t, err := time.ParseDuration(v)
+		if err != nil || t < 0 {
+			return nil, fmt.Errorf("invalid %s %q", optLBHealthTimeout, v)
+		}
+		b.HealthTimeout = t
+	}
+	return b, nil
+}
+
+// describeListener fills in the load balancer of the listener, which has
+// to be updated when its backends change.
+func (d *driver) describeListener(b *lbBackend) error {
+	ls, err := d.api.DescribeLoadBalancerListeners(qcsdk.Params{"loadbalancer_listeners": b.Listener})
+	if err != nil {
+		return err
+	}
+	if len(ls) == 0 {
+		return fmt.Errorf("load balancer listener %s not found", b.Listener)
+	}
+	b.LoadBalancer = ls[0].LoadBalancerID
+	return nil
+}
+
+// addBackend registers the nic of the endpoint with the listener, applies
+// the change to the load balancer and waits for the backend to be healthy
+// if the endpoint has a health timeout. The backend is deleted again on
+// failure. The ID of the backend is returned for the caller to record.
+func (d *driver) addBackend(ep *endpoint) (string, error) {
+	b := ep.LB
+	ids, err := d.api.AddLoadBalancerBackends(b.Listener, []*sdktypes.LoadBalancerBackend{{
+		Name:       "qdn-" + genNicName(ep.ID),
+		ResourceID: util.InstanceID,
+		NicID:      ep.NicID,
+		Port:       b.Port,
+		Weight:     b.Weight,
+	}})
+	if err != nil {
+		return "", fmt.Errorf("failed to add backend to load balancer listener %s: %v", b.Listener, err)
+	}
+	id := ids[0]
+
+	if jobID, err := d.api.UpdateLoadBalancers([]string{b.LoadBalancer}, true); err != nil {
+		if err := d.api.DeleteLoadBalancerBackends([]string{id}); err != nil {
+			logrus.WithField("backend", id).Errorf("Failed to delete backend: %v", err)
+		}
+		return "", fmt.Errorf("failed to update load balancer %s. job_id: %s, err: %v", b.LoadBalancer, jobID, err)
+	}
+	logrus.WithField("backend", id).Infof("Nic %s added to load balancer listener %s", ep.NicID, b.Listener)
+
+	if b.HealthTimeout > 0 {
+		if err := d.waitHealthy(id, b.HealthTimeout); err != nil {
+			if err := d.api.DeleteLoadBalancerBackends([]string{id}); err != nil {
+				logrus.WithField("backend", id).Errorf("Failed to delete backend: %v", err)
+			} else if _, err := d.api.UpdateLoadBalancers([]string{b.LoadBalancer}, true); err != nil {
+				logrus.WithField("backend", id).Errorf("Failed to update load balancer %s: %v", b.LoadBalancer, err)
+			}
+			return "", err
+		}
+	}
+	return id, nil
+}
+
+// removeBackend deletes the backend of the endpoint and waits for the load
+// balancer to stop forwarding to it. It can be retried after a failure.
+func (d *driver) removeBackend(ep *endpoint) error {
+	b := ep.LB
+	bs, err := d.api.DescribeLoadBalancerBackends(qcsdk.Params{"loadbalancer_backends": b.ID})
+	if err != nil {
+		return err
+	}
+	if len(bs) > 0 {
+		if err := d.api.DeleteLoadBalancerBackends([]string{b.ID}); err != nil {
+			return fmt.Errorf("failed to delete load balancer backend %s: %v", b.ID, err)
+		}
+	} else {
+		logrus.WithField("backend", b.ID).Warnf("Load balancer backend of endpoint %s no longer exists", ep.ID)
+	}
+
+	if jobID, err := d.api.UpdateLoadBalancers([]string{b.LoadBalancer}, true); err != nil {
+		return fmt.Errorf("failed to update load balancer %s. job_id: %s, err: %v", b.LoadBalancer, jobID, err)
+	}
+	logrus.WithField("backend", b.ID).Infof("Nic %s removed from load balancer listener %s", ep.NicID, b.Listener)
+
+	b.ID = ""
+	return nil
+}
+
+// waitHealthy waits for the backend to pass the health check within
+// timeout.
+func (d *driver) waitHealthy(id string, timeout time.Duration) error {
+	log := logrus.WithField("backend", id)
+	deadline := time.Now().Add(timeout)
+	for {
+		bs, err := d.api.DescribeLoadBalancerBackends(qcsdk.Params{"loadbalancer_backends": id})
+		switch {
+		case err != nil:
+			log.Warnf("Failed to describe load balancer backend: %v", err)
+		case len(bs) == 0:
+			return fmt.Errorf("load balancer backend %s no longer exists", id)
+		case bs[0].Status == lbBackendUp:
+			log.Info("Load balancer backend is healthy")
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("load balancer backend %s isn't healthy after %s", id, timeout)
+		}
+		time.Sleep(lbPollInterval)
+	}
+}
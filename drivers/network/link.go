@@ -0,0 +1,75 @@
+package network
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/Sirupsen/logrus"
+	sdktypes "github.com/nicescale/qcsdk/types"
+)
+
+// The network options for the links of the endpoints.
+const (
+	optMTU = "mtu"
+	// optDockerMTU is the generic MTU option of docker networks. optMTU
+	// takes precedence over it.
+	optDockerMTU  = "com.docker.network.driver.mtu"
+	optTxQueueLen = "txqueuelen"
+
+	minMTU = 68
+)
+
+// parseLinkOpts returns the MTU and the transmit queue length of the links.
+// The MTU defaults to, and is capped at, the MTU of the vxnet if the API
+// reports one. Zero leaves a setting of the links unchanged.
+func parseLinkOpts(opts map[string]string, v *sdktypes.Vxnet) (mtu, qlen int, err error) {
+	s := opts[optMTU]
+	if s == "" {
+		s = opts[optDockerMTU]
+	}
+	if s != "" {
+		mtu, err = strconv.Atoi(s)
+		if err != nil || mtu < minMTU {
+			return 0, 0, fmt.Errorf("invalid %s %q: must be an integer no less than %d", optMTU, s, minMTU)
+		}
+	}
+	if v.MTU > 0 {
+		if mtu == 0 {
+			mtu = v.MTU
+		} else if mtu > v.MTU {
+			logrus.Warnf("MTU %d is capped at the MTU %d of vxnet %s", mtu, v.MTU, v.ID)
+			mtu = v.MTU
+		}
+	}
+
+	if s := opts[optTxQueueLen]; s != "" {
+		qlen, err = strconv.Atoi(s)
+		if err != nil || qlen < 1 {
+			return 0, 0, fmt.Errorf("invalid %s %q: must be a positive integer", optTxQueueLen, s)
+		}
+	}
+	return mtu, qlen, nil
+}
+
+// configureLink applies the link settings of the network to the link of
+// the endpoint, which must still be in the host namespace.
+func (d *driver) configureLink(n *netConfig, ep *endpoint) error {
+	if n.MTU == 0 && n.TxQueueLen == 0 {
+		return nil
+	}
+	link, err := d.nl.LinkByName(genNicName(ep.ID))
+	if err != nil {
+		return fmt.Errorf("failed to find the link of endpoint %s: %v", ep.ID, err)
+	}
+	if n.MTU > 0 && link.Attrs().MTU != n.MTU {
+		if err := d.nl.LinkSetMTU(link, n.MTU); err != nil {
+			return fmt.Errorf("failed to set the MTU of link %s to %d: %v", link.Attrs().Name, n.MTU, err)
+		}
+	}
+	if n.TxQueueLen > 0 && link.Attrs().TxQLen != n.TxQueueLen {
+		if err := d.nl.LinkSetTxQLen(link, n.TxQueueLen); err != nil {
+			return fmt.Errorf("failed to set the txqueuelen of link %s to %d: %v", link.Attrs().Name, n.TxQueueLen, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,311 @@
+package network
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/nicescale/qcsdk"
+	"github.com/nicescale/qingcloud-docker-network/metrics"
+	"github.com/nicescale/qingcloud-docker-network/util"
+	"github.com/vishvananda/netlink"
+)
+
+// The states of the nics attached to the instance as seen by the reconciler.
+const (
+	nicInUse   = metrics.NicInUse
+	nicIdle    = metrics.NicIdle
+	nicLeaked  = "leaked"
+	nicMissing = "missing"
+)
+
+// The actions applied to leaked nics.
+const (
+	// LeakedRequeue renames the link of a leaked nic back to its canonical
+	// name so that it's reused as an idle nic.
+	LeakedRequeue = "requeue"
+	// LeakedDetach detaches leaked nics from the instance.
+	LeakedDetach = "detach"
+)
+
+// endpointLinkName matches the link names generated by genNicName.
+var endpointLinkName = regexp.MustCompile("^[0-9a-f]{12}$")
+
+// NicStatus is the classification of an attached nic.
+type NicStatus struct {
+	NicID      string
+	IP         string
+	Vxnet      string
+	State      string
+	Link       string `json:",omitempty"`
+	NetworkID  string `json:",omitempty"`
+	EndpointID string `json:",omitempty"`
+	Reason     string `json:",omitempty"`
+}
+
+// runReconciler reconciles the nics every interval.
+func (d *driver) runReconciler(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if _, err := d.reconcile(d.cfg.ReconcileDryRun); err != nil {
+			logrus.Errorf("Failed to reconcile nics: %v", err)
+		}
+	}
+}
+
+// reconcile compares the nics attached to the instance with the links in
+// the host network namespace and the saved endpoints. Only the nics in the
+// vxnets of the networks and reservations, or created by the plugin, are
+// reconciled; the other nics of the host are left alone.
+// Idle links are renamed back to their canonical name, leaked nics are
+// requeued or detached according to the LeakedPolicy, and endpoints whose
+// nic has gone are marked as stale. Nothing is changed if dryRun is true.
+func (d *driver) reconcile(dryRun bool) ([]*NicStatus, error) {
+	d.reconcileLock.Lock()
+	defer d.reconcileLock.Unlock()
+
+	// The reservations are listed before the nics, so that the nics of
+	// all the listed reservations were attached before DescribeNics and the
+	// reservations of the nics attached meanwhile aren't seen as missing.
+	rs, err := d.rs.List()
+	if err != nil {
+		return nil, err
+	}
+	nics, err := d.api.DescribeNics(qcsdk.Params{"instances": util.InstanceID})
+	if err != nil {
+		return nil, err
+	}
+	links, err := d.nl.LinkList()
+	if err != nil {
+		return nil, err
+	}
+	reservations := make(map[string]*util.Reservation, len(rs))
+	for _, r := range rs {
+		reservations[r.NicID] = r
+	}
+
+	type owner struct {
+		n  *netConfig
+		ep *endpoint
+	}
+	owners := make(map[string]owner)
+	creating := make(map[string]bool)
+	// vxnets are the vxnets of the networks and reservations. The other
+	// nics of the instance are left alone unless the plugin created them.
+	vxnets := make(map[string]bool)
+	for _, r := range rs {
+		// The reservations are made in the IPv4 pools, named after their
+		// vxnets.
+		vxnets[r.PoolID] = true
+	}
+	d.mu.Lock()
+	for id := range d.creating {
+		creating[id] = true
+		// The reservation of an endpoint being created may have been
+		// claimed and its link renamed after the reservations were listed.
+		creating[genNicName(id)] = true
+	}
+	for _, n := range d.networks {
+		for _, s := range n.Subnets {
+			vxnets[s.Vxnet] = true
+		}
+		n.mu.Lock()
+		for _, ep := range n.endpoints {
+			if !ep.Stale {
+				owners[ep.NicID] = owner{n, ep}
+			}
+		}
+		n.mu.Unlock()
+	}
+	d.mu.Unlock()
+
+	act := func(st *NicStatus, format string, args ...interface{}) bool {
+		msg := fmt.Sprintf(format, args...)
+		log := logrus.WithField("nic", st.NicID).WithField("state", st.State)
+		if dryRun {
+			log.Infof("Reconcile (dry run): would %s", msg)
+			return false
+		}
+		log.Infof("Reconcile: %s", msg)
+		return true
+	}
+
+	var result []*NicStatus
+	attached := make(map[string]bool, len(nics))
+	idle := make(map[string]bool)
+	for _, nic := range nics {
+		if nic.Role == 1 {
+			continue
+		}
+		nicID := strings.ToLower(nic.ID)
+		attached[nicID] = true
+		if _, ok := owners[nicID]; !ok && reservations[nicID] == nil && !vxnets[nic.VxnetID] && !util.PluginNic(nic) {
+			continue
+		}
+
+		st := &NicStatus{
+			NicID: nicID,
+			IP:    nic.PrivateIP.String(),
+			Vxnet: nic.VxnetID,
+		}
+		link := links[nicID]
+		if link != nil {
+			st.Link = link.Attrs().Name
+		}
+		result = append(result, st)
+
+		if o, ok := owners[nicID]; ok {
+			st.NetworkID, st.EndpointID = o.n.ID, o.ep.ID
+			d.classifyOwned(st, o.ep, link)
+			// The nic is released by docker when the stale endpoint is
+			// deleted, so it's not requeued here.
+			if st.State == nicLeaked && act(st, "mark endpoint %s as stale", o.ep.ID) {
+				d.markStale(o.n, o.ep)
+			}
+			continue
+		}
+
+		if r := reservations[nicID]; r != nil {
+			st.EndpointID = r.EndpointID
+			st.State, st.Reason = nicInUse, "reserved"
+			// The endpoints being created claim and rename the link
+			// before they are added to the network.
+			if creating[r.EndpointID] {
+				st.Reason = "endpoint being created"
+			} else if r.EndpointID != "" && link != nil && st.Link == genNicName(r.EndpointID) {
+				st.State, st.Reason = nicLeaked, fmt.Sprintf("endpoint %s no longer exists", r.EndpointID)
+			}
+		} else if link == nil {
+			st.State, st.Reason = nicMissing, "link not found in the host"
+		} else if creating[st.Link] {
+			st.State, st.Reason = nicInUse, "endpoint being created"
+		} else if endpointLinkName.MatchString(st.Link) {
+			st.State, st.Reason = nicLeaked, fmt.Sprintf("link %s belongs to a deleted endpoint", st.Link)
+		} else {
+			st.State = nicIdle
+		}
+
+		switch st.State {
+		case nicIdle:
+			d.requeueLink(st, link, act)
+			idle[st.IP] = true
+			if !dryRun {
+				if err := d.cfg.Host.PrepareIdle(link, nic.VxnetID, nic.PrivateIP); err != nil {
+					logrus.WithField("nic", nicID).Errorf("Failed to prepare the idle link: %v", err)
+				}
+			}
+		case nicLeaked:
+			d.fixLeaked(st, link, reservations[nicID], act)
+		case nicMissing:
+			logrus.WithField("nic", nicID).Warnf("Reconcile: %s", st.Reason)
+		}
+	}
+
+	// Endpoints and reservations of the nics that are no longer attached.
+	for nicID, o := range owners {
+		if !attached[nicID] && act(&NicStatus{NicID: nicID, State: nicMissing}, "mark endpoint %s as stale", o.ep.ID) {
+			d.markStale(o.n, o.ep)
+		}
+	}
+	for nicID, r := range reservations {
+		if attached[nicID] {
+			continue
+		}
+		if act(&NicStatus{NicID: nicID, State: nicMissing}, "remove the reservation of %s", r.Address) {
+			if err := d.rs.Remove(r.PoolID, r.Address); err != nil {
+				logrus.Errorf("Failed to remove reservation of %s: %v", r.Address, err)
+			}
+		}
+	}
+
+	counts := make(map[[2]string]int)
+	for _, st := range result {
+		counts[[2]string{st.Vxnet, st.State}]++
+	}
+	metrics.Nics.Reset()
+	for k, n := range counts {
+		metrics.Nics.Set(float64(n), k[0], k[1])
+	}
+
+	// The rules of the nics that are no longer idle in the host, e.g. taken
+	// over by other instances.
+	if !dryRun {
+		if err := d.cfg.Host.Sweep(idle); err != nil {
+			logrus.Errorf("Failed to remove stale rules: %v", err)
+		}
+	}
+
+	return result, nil
+}
+
+func (d *driver) classifyOwned(st *NicStatus, ep *endpoint, link netlink.Link) {
+	switch {
+	case ep.SandboxKey == "" && link == nil:
+		st.State, st.Reason = nicMissing, "link of the endpoint not found in the host"
+	case ep.SandboxKey == "":
+		st.State = nicInUse
+	case !sandboxExists(ep.SandboxKey) && link != nil:
+		st.State, st.Reason = nicLeaked, fmt.Sprintf("sandbox %s no longer exists", ep.SandboxKey)
+	case !sandboxExists(ep.SandboxKey):
+		st.State, st.Reason = nicMissing, fmt.Sprintf("sandbox %s no longer exists and link not found in the host", ep.SandboxKey)
+	default:
+		st.State = nicInUse
+	}
+}
+
+// requeueLink renames the link of an idle nic to its canonical name.
+func (d *driver) requeueLink(st *NicStatus, link netlink.Link, act func(*NicStatus, string, ...interface{}) bool) {
+	name := util.CanonicalNicName(st.NicID)
+	if link == nil || st.Link == name {
+		return
+	}
+	if act(st, "rename link %s to %s", st.Link, name) {
+		if err := d.nl.RenameLink(link, name); err != nil {
+			logrus.Errorf("Failed to rename link %s: %v", st.Link, err)
+			return
+		}
+		st.Link = name
+	}
+}
+
+func (d *driver) fixLeaked(st *NicStatus, link netlink.Link, r *util.Reservation, act func(*NicStatus, string, ...interface{}) bool) {
+	if d.cfg.LeakedPolicy == LeakedDetach {
+		if !act(st, "detach the nic: %s", st.Reason) {
+			return
+		}
+		if err := d.cfg.Host.Release(net.ParseIP(st.IP)); err != nil {
+			logrus.Errorf("Failed to remove the rules of nic %s: %v", st.NicID, err)
+		}
+		if jobID, err := d.api.DetachNics([]string{st.NicID}, false); err != nil {
+			logrus.Errorf("Failed to detach nic %s. job_id: %s, err: %v", st.NicID, jobID, err)
+			return
+		}
+	} else {
+		d.requeueLink(st, link, act)
+	}
+
+	if r != nil && act(st, "remove the reservation of %s", r.Address) {
+		if err := d.rs.Remove(r.PoolID, r.Address); err != nil {
+			logrus.Errorf("Failed to remove reservation of %s: %v", r.Address, err)
+		}
+	}
+}
+
+func (d *driver) markStale(n *netConfig, ep *endpoint) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	ep.Stale = true
+	if err := d.saveEndpoint(n.ID, ep); err != nil {
+		logrus.Errorf("Failed to save endpoint %s: %v", ep.ID, err)
+	}
+}
+
+func sandboxExists(key string) bool {
+	_, err := os.Stat(key)
+	return err == nil
+}
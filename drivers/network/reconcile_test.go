@@ -0,0 +1,245 @@
+package network
+
+import (
+	"net"
+	"testing"
+
+	dipam "github.com/docker/go-plugins-helpers/ipam"
+	"github.com/docker/go-plugins-helpers/network"
+	sdktypes "github.com/nicescale/qcsdk/types"
+	"github.com/nicescale/qingcloud-docker-network/util"
+)
+
+// deletedEndpoint is the ID of a docker endpoint that no longer exists.
+const deletedEndpoint = "0123456789abcdef0123456789abcdef"
+
+// addNic adds a nic attached to the instance whose link is named name in
+// the host, or has no link if name is empty.
+func (e *testEnv) addNic(t *testing.T, nic *sdktypes.Nic, name string) string {
+	nic.Status, nic.InstanceID = "in-use", testInstance
+	nic = e.c.AddNic(nic)
+	if name == "" {
+		return nic.ID
+	}
+	link, err := e.nl.AddLink(nic.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.nl.RenameLink(link, name); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.nl.LinkSetUp(link); err != nil {
+		t.Fatal(err)
+	}
+	return nic.ID
+}
+
+func TestReconcile(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy string
+		// setup adds the nic to reconcile and returns its ID.
+		setup func(t *testing.T, e *testEnv) string
+		// state is the state of the nic, or "" if it's left alone.
+		state string
+		// link is the name of the link of the nic after the reconcile.
+		link string
+		// status is the status of the nic after the reconcile.
+		status string
+		// stale is set if the endpoint of the nic is marked as stale.
+		stale bool
+	}{
+		{
+			name: "foreign nic",
+			setup: func(t *testing.T, e *testEnv) string {
+				e.c.AddVxnet("vxnet-host", "10.0.0.0/24")
+				return e.addNic(t, &sdktypes.Nic{VxnetID: "vxnet-host", PrivateIP: net.ParseIP("10.0.0.10")}, "eth1")
+			},
+			link:   "eth1",
+			status: "in-use",
+		},
+		{
+			name:   "foreign nic named like an endpoint",
+			policy: LeakedDetach,
+			setup: func(t *testing.T, e *testEnv) string {
+				e.c.AddVxnet("vxnet-host", "10.0.0.0/24")
+				return e.addNic(t, &sdktypes.Nic{VxnetID: "vxnet-host", PrivateIP: net.ParseIP("10.0.0.10")}, genNicName(deletedEndpoint))
+			},
+			link:   genNicName(deletedEndpoint),
+			status: "in-use",
+		},
+		{
+			name: "plugin nic in another vxnet",
+			setup: func(t *testing.T, e *testEnv) string {
+				e.c.AddVxnet("vxnet-b", "10.0.0.0/24")
+				return e.addNic(t, &sdktypes.Nic{VxnetID: "vxnet-b", PrivateIP: net.ParseIP("10.0.0.10"), NicName: util.NicName}, "eth1")
+			},
+			state:  nicIdle,
+			link:   "qc",
+			status: "in-use",
+		},
+		{
+			name: "idle nic",
+			setup: func(t *testing.T, e *testEnv) string {
+				return e.addNic(t, &sdktypes.Nic{VxnetID: testVxnet, PrivateIP: net.ParseIP("192.168.0.10")}, "eth1")
+			},
+			state:  nicIdle,
+			link:   "qc",
+			status: "in-use",
+		},
+		{
+			name: "idle nic without link",
+			setup: func(t *testing.T, e *testEnv) string {
+				return e.addNic(t, &sdktypes.Nic{VxnetID: testVxnet, PrivateIP: net.ParseIP("192.168.0.10")}, "")
+			},
+			state:  nicMissing,
+			status: "in-use",
+		},
+		{
+			name: "leaked link requeued",
+			setup: func(t *testing.T, e *testEnv) string {
+				return e.addNic(t, &sdktypes.Nic{VxnetID: testVxnet, PrivateIP: net.ParseIP("192.168.0.10")}, genNicName(deletedEndpoint))
+			},
+			state:  nicLeaked,
+			link:   "qc",
+			status: "in-use",
+		},
+		{
+			name:   "leaked link detached",
+			policy: LeakedDetach,
+			setup: func(t *testing.T, e *testEnv) string {
+				return e.addNic(t, &sdktypes.Nic{VxnetID: testVxnet, PrivateIP: net.ParseIP("192.168.0.10")}, genNicName(deletedEndpoint))
+			},
+			state:  nicLeaked,
+			status: "available",
+		},
+		{
+			name: "leaked reservation",
+			setup: func(t *testing.T, e *testEnv) string {
+				id := e.addNic(t, &sdktypes.Nic{VxnetID: testVxnet, PrivateIP: net.ParseIP("192.168.0.10")}, genNicName(deletedEndpoint))
+				e.reserve(t, id, "192.168.0.10", deletedEndpoint)
+				return id
+			},
+			state:  nicLeaked,
+			link:   "qc",
+			status: "in-use",
+		},
+		{
+			name: "endpoint being created",
+			setup: func(t *testing.T, e *testEnv) string {
+				// The reservation was claimed after the reconciler listed
+				// the reservations, so only the link shows the endpoint.
+				e.d.creating[deletedEndpoint] = true
+				return e.addNic(t, &sdktypes.Nic{VxnetID: testVxnet, PrivateIP: net.ParseIP("192.168.0.10")}, genNicName(deletedEndpoint))
+			},
+			state:  nicInUse,
+			link:   genNicName(deletedEndpoint),
+			status: "in-use",
+		},
+		{
+			name: "reserved for an endpoint being created",
+			setup: func(t *testing.T, e *testEnv) string {
+				e.d.creating[deletedEndpoint] = true
+				id := e.addNic(t, &sdktypes.Nic{VxnetID: testVxnet, PrivateIP: net.ParseIP("192.168.0.10")}, genNicName(deletedEndpoint))
+				e.reserve(t, id, "192.168.0.10", deletedEndpoint)
+				return id
+			},
+			state:  nicInUse,
+			link:   genNicName(deletedEndpoint),
+			status: "in-use",
+		},
+		{
+			name: "endpoint",
+			setup: func(t *testing.T, e *testEnv) string {
+				return e.createEndpoint(t, "")
+			},
+			state:  nicInUse,
+			link:   genNicName(testEndpoint),
+			status: "in-use",
+		},
+		{
+			name: "endpoint of a removed sandbox",
+			setup: func(t *testing.T, e *testEnv) string {
+				return e.createEndpoint(t, "/var/run/docker/netns/removed")
+			},
+			state:  nicLeaked,
+			link:   genNicName(testEndpoint),
+			status: "in-use",
+			stale:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEnv(t)
+			defer e.close()
+			e.createNetwork(t, nil)
+			if tt.policy != "" {
+				e.d.cfg.LeakedPolicy = tt.policy
+			}
+			nicID := tt.setup(t, e)
+			link := tt.link
+			if link == "qc" {
+				link = util.CanonicalNicName(nicID)
+			}
+
+			result, err := e.d.reconcile(false)
+			if err != nil {
+				t.Fatalf("reconcile: %v", err)
+			}
+			var st *NicStatus
+			for _, s := range result {
+				if s.NicID == nicID {
+					st = s
+				}
+			}
+			switch {
+			case tt.state == "" && st != nil:
+				t.Errorf("foreign nic is reconciled: %+v", st)
+			case tt.state != "" && (st == nil || st.State != tt.state):
+				t.Errorf("nic status = %+v, want state %s", st, tt.state)
+			}
+
+			if l := e.nl.Link(nicID); link != "" && (l == nil || l.Attrs().Name != link) {
+				t.Errorf("link = %+v, want %s", l, link)
+			}
+			if nic := e.c.Nic(nicID); nic.Status != tt.status {
+				t.Errorf("nic is %s, want %s", nic.Status, tt.status)
+			}
+			if ep := e.d.getNetwork(testNetwork).getEndpoint(testEndpoint); ep != nil && ep.Stale != tt.stale {
+				t.Errorf("endpoint stale = %v, want %v", ep.Stale, tt.stale)
+			}
+		})
+	}
+}
+
+func (e *testEnv) reserve(t *testing.T, nicID, address, endpointID string) {
+	if err := e.d.rs.Add(&util.Reservation{PoolID: testVxnet, Address: address, NicID: nicID}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.d.rs.Claim(testVxnet, address, endpointID); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// createEndpoint creates the test endpoint with the sandbox, or none if it's
+// empty, and returns the ID of its nic.
+func (e *testEnv) createEndpoint(t *testing.T, sandbox string) string {
+	addr, err := e.ipam.RequestAddress(&dipam.RequestAddressRequest{PoolID: e.poolID})
+	if err != nil {
+		t.Fatalf("RequestAddress: %v", err)
+	}
+	resp, err := e.d.CreateEndpoint(&network.CreateEndpointRequest{
+		NetworkID:  testNetwork,
+		EndpointID: testEndpoint,
+		Interface:  &network.EndpointInterface{Address: addr.Address},
+	})
+	if err != nil {
+		t.Fatalf("CreateEndpoint: %v", err)
+	}
+	if sandbox != "" {
+		ep := e.d.getNetwork(testNetwork).getEndpoint(testEndpoint)
+		ep.SandboxKey = sandbox
+	}
+	return resp.Interface.MacAddress
+}
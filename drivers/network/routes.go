@@ -0,0 +1,91 @@
+package network
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/docker/go-plugins-helpers/network"
+)
+
+// The network options for the routes of the containers.
+const (
+	// optRoutes is a comma separated list of static routes in the form of
+	// "<cidr> via <next hop>", or "<cidr>" for on-link routes.
+	optRoutes = "routes"
+	// optNoGateway stops the network from providing the default gateway
+	// of the containers, e.g. for management networks.
+	optNoGateway = "no_gateway"
+)
+
+// The route types of libnetwork.
+const (
+	routeNextHop   = 0
+	routeConnected = 1
+)
+
+// parseRoutes parses the optRoutes option. The next hops must be in one of
+// the subnets of the network.
+func parseRoutes(s string, subnets []string) ([]*network.StaticRoute, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	var ipnets []*net.IPNet
+	for _, subnet := range subnets {
+		_, ipnet, err := net.ParseCIDR(subnet)
+		if err != nil {
+			return nil, fmt.Errorf("invalid subnet %s: %v", subnet, err)
+		}
+		ipnets = append(ipnets, ipnet)
+	}
+
+	var routes []*network.StaticRoute
+	for _, r := range strings.Split(s, ",") {
+		fields := strings.Fields(r)
+		if len(fields) != 1 && (len(fields) != 3 || fields[1] != "via") {
+			return nil, fmt.Errorf(`invalid route %q: must be "<cidr> via <next hop>" or "<cidr>"`, strings.TrimSpace(r))
+		}
+		_, dst, err := net.ParseCIDR(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid route destination %s: %v", fields[0], err)
+		}
+		if len(fields) == 1 {
+			routes = append(routes, &network.StaticRoute{Destination: dst.String(), RouteType: routeConnected})
+			continue
+		}
+		hop := net.ParseIP(fields[2])
+		if hop == nil {
+			return nil, fmt.Errorf("invalid next hop %s of route %s", fields[2], dst)
+		}
+		if !containsIP(ipnets, hop) {
+			return nil, fmt.Errorf("next hop %s of route %s is not in subnet %s", hop, dst, strings.Join(subnets, ","))
+		}
+		routes = append(routes, &network.StaticRoute{Destination: dst.String(), RouteType: routeNextHop, NextHop: hop.String()})
+	}
+	return routes, nil
+}
+
+// routesFor returns the routes of the containers on the subnet. The routes
+// via the next hops of the other subnets are left out.
+func routesFor(routes []*network.StaticRoute, s *subnet) []*network.StaticRoute {
+	_, ipnet, err := net.ParseCIDR(s.IPAMData.Pool)
+	if err != nil {
+		return routes
+	}
+	var ret []*network.StaticRoute
+	for _, r := range routes {
+		if r.RouteType == routeConnected || ipnet.Contains(net.ParseIP(r.NextHop)) {
+			ret = append(ret, r)
+		}
+	}
+	return ret
+}
+
+func containsIP(ipnets []*net.IPNet, ip net.IP) bool {
+	for _, ipnet := range ipnets {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
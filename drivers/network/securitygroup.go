@@ -0,0 +1,83 @@
+package network
+
+import (
+	"fmt"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/nicescale/qcsdk"
+)
+
+// optSecurityGroup is the network or endpoint option that applies a
+// security group to the nics of the endpoints. The endpoint option takes
+// precedence over the network option.
+const optSecurityGroup = "security_group"
+
+// applySecurityGroup applies sg to the nic of the endpoint and records the
+// security group that the nic had before. A nic without a security group
+// gets the default security group back, since the API can't remove one.
+func (d *driver) applySecurityGroup(ep *endpoint, sg string) error {
+	nics, err := d.api.DescribeNics(qcsdk.Params{"nics": ep.NicID})
+	if err != nil {
+		return err
+	}
+	if len(nics) == 0 {
+		return fmt.Errorf("nic %s not found", ep.NicID)
+	}
+
+	prev := nics[0].SecurityGroup
+	if prev == "" && sg != "" {
+		if d.cfg.DefaultSecurityGroup == "" {
+			return fmt.Errorf("nic %s has no security group to restore after %s, set a default security group", ep.NicID, sg)
+		}
+		prev = d.cfg.DefaultSecurityGroup
+	}
+	if nics[0].SecurityGroup != sg {
+		if jobID, err := d.api.ApplySecurityGroup(sg, []string{ep.NicID}, true); err != nil {
+			return fmt.Errorf("failed to apply security group %s to nic %s. job_id: %s, err: %v", sg, ep.NicID, jobID, err)
+		}
+		logrus.WithField("nic", ep.NicID).Infof("Security group %s applied, previous %q", sg, nics[0].SecurityGroup)
+	}
+
+	ep.SecurityGroup = sg
+	ep.PrevSecurityGroup = prev
+	return nil
+}
+
+// restoreSecurityGroup applies the previous security group to the nic of
+// the endpoint before the nic goes back to the idle pool. A nic whose
+// security group was changed by others is left alone.
+// It can be retried after a failure.
+func (d *driver) restoreSecurityGroup(ep *endpoint) error {
+	log := logrus.WithField("nic", ep.NicID)
+	prev := ep.PrevSecurityGroup
+	if prev == "" {
+		// Endpoints created by older versions recorded no security group.
+		prev = d.cfg.DefaultSecurityGroup
+	}
+	if prev == ep.SecurityGroup {
+		return nil
+	}
+	if prev == "" {
+		log.Warnf("Nic had no security group and no default security group is set, keeping %s", ep.SecurityGroup)
+		return nil
+	}
+
+	nics, err := d.api.DescribeNics(qcsdk.Params{"nics": ep.NicID})
+	if err != nil {
+		return err
+	}
+	if len(nics) == 0 {
+		return nil
+	}
+	if sg := nics[0].SecurityGroup; sg != ep.SecurityGroup {
+		log.Warnf("Security group of the nic changed to %s, not restoring %s", sg, prev)
+		return nil
+	}
+
+	if jobID, err := d.api.ApplySecurityGroup(prev, []string{ep.NicID}, true); err != nil {
+		return fmt.Errorf("failed to restore security group %s of nic %s. job_id: %s, err: %v",
+			prev, ep.NicID, jobID, err)
+	}
+	log.Infof("Security group %s restored", prev)
+	return nil
+}
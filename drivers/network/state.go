@@ -0,0 +1,187 @@
+package network
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/nicescale/qcsdk"
+	"github.com/nicescale/qingcloud-docker-network/util"
+	"github.com/vishvananda/netlink"
+)
+
+// stateVersion is the version of the on-disk network and endpoint files.
+// Files written before the schema was versioned are treated as version 0.
+const stateVersion = 2
+
+// migrations[i] upgrades the state of a network from version i to i+1.
+var migrations = []func(n *netConfig, eps []*endpoint) error{
+	migrateV0,
+	migrateV1,
+}
+
+// migrateV0 normalizes the endpoints written by version 0.
+// The IP was stored as passed by docker which may lack the prefix length,
+// and the NIC ID was not guaranteed to be lower case.
+func migrateV0(n *netConfig, eps []*endpoint) error {
+	ones := 0
+	if n.IPAMData != nil {
+		if _, subnet, err := net.ParseCIDR(n.IPAMData.Pool); err == nil {
+			ones, _ = subnet.Mask.Size()
+		}
+	}
+	for _, ep := range eps {
+		ep.NicID = strings.ToLower(ep.NicID)
+		if ep.IP != "" && !strings.Contains(ep.IP, "/") && ones > 0 {
+			ep.IP = fmt.Sprintf("%s/%d", ep.IP, ones)
+		}
+	}
+	return nil
+}
+
+// migrateV1 moves the single vxnet of version 1 into the subnets of the
+// network, and records it as the vxnet of the endpoints.
+func migrateV1(n *netConfig, eps []*endpoint) error {
+	n.Subnets = []*subnet{{Vxnet: n.Vxnet, Router: n.Router, IPAMData: n.IPAMData, IPv6Data: n.IPv6Data}}
+	n.Vxnet, n.Router, n.IPAMData, n.IPv6Data = "", "", nil, nil
+	for _, ep := range eps {
+		ep.Vxnet = n.Subnets[0].Vxnet
+	}
+	return nil
+}
+
+// loadNetworks restores the networks and endpoints saved in the data dir.
+// Old files are migrated to the current schema, and endpoints whose NIC
+// no longer exists are marked as stale.
+func (d *driver) loadNetworks() error {
+	cfgDir := d.configDir()
+	if err := os.MkdirAll(cfgDir, 0700); err != nil {
+		return err
+	}
+
+	networks, err := filepath.Glob(filepath.Join(cfgDir, "*", "*.json"))
+	if err != nil {
+		return err
+	}
+	for _, f := range networks {
+		n := &netConfig{}
+		if err := util.ReadJSON(f, n); err != nil {
+			return fmt.Errorf("failed to load network file %s: %v", f, err)
+		}
+		n.endpoints = make(map[string]*endpoint)
+
+		eps, err := d.loadEndpoints(n.ID)
+		if err != nil {
+			return err
+		}
+		if err := d.migrate(n, eps); err != nil {
+			return err
+		}
+		for _, ep := range eps {
+			n.endpoints[ep.ID] = ep
+		}
+		d.networks[n.ID] = n
+	}
+
+	d.markStaleEndpoints()
+	return nil
+}
+
+func (d *driver) loadEndpoints(nid string) ([]*endpoint, error) {
+	files, err := filepath.Glob(filepath.Join(d.epConfigDir(nid), "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	var eps []*endpoint
+	for _, f := range files {
+		ep := &endpoint{}
+		if err := util.ReadJSON(f, ep); err != nil {
+			return nil, fmt.Errorf("failed to load endpoint file %s: %v", f, err)
+		}
+		eps = append(eps, ep)
+	}
+	return eps, nil
+}
+
+// migrate upgrades the network and its endpoints to stateVersion
+// and writes them back if anything changed.
+func (d *driver) migrate(n *netConfig, eps []*endpoint) error {
+	if n.Version > stateVersion {
+		return fmt.Errorf("network %s was saved by a newer version of the plugin (schema version %d)", n.ID, n.Version)
+	}
+	if n.Version == stateVersion {
+		return nil
+	}
+
+	from := n.Version
+	for v := n.Version; v < stateVersion; v++ {
+		if err := migrations[v](n, eps); err != nil {
+			return fmt.Errorf("failed to migrate network %s from schema version %d: %v", n.ID, v, err)
+		}
+	}
+
+	n.Version = stateVersion
+	if err := d.writeFile(d.netConfigPath(n.ID), n); err != nil {
+		return err
+	}
+	for _, ep := range eps {
+		ep.Version = stateVersion
+		if err := d.saveEndpoint(n.ID, ep); err != nil {
+			return err
+		}
+	}
+	logrus.Infof("Migrated network %s from schema version %d to %d", n.ID, from, stateVersion)
+	return nil
+}
+
+// markStaleEndpoints checks the loaded endpoints against the NICs attached
+// to the instance and the links in the host network namespace.
+// An endpoint is stale if its NIC is no longer attached to the instance,
+// or if it isn't joined to a sandbox and its link has disappeared.
+func (d *driver) markStaleEndpoints() {
+	nics, err := d.api.DescribeNics(qcsdk.Params{"instances": util.InstanceID})
+	if err != nil {
+		logrus.Warnf("Failed to describe nics, skip verifying endpoints: %v", err)
+		return
+	}
+	attached := make(map[string]bool, len(nics))
+	for _, nic := range nics {
+		attached[strings.ToLower(nic.ID)] = true
+	}
+
+	links, err := d.nl.LinkList()
+	if err != nil {
+		logrus.Warnf("Failed to list links, skip verifying endpoints: %v", err)
+		return
+	}
+
+	for _, n := range d.networks {
+		for _, ep := range n.endpoints {
+			stale := staleReason(ep, attached, links)
+			if stale == "" || ep.Stale {
+				continue
+			}
+
+			logrus.Warnf("Endpoint %s of network %s is stale: %s", ep.ID, n.ID, stale)
+			ep.Stale = true
+			if err := d.saveEndpoint(n.ID, ep); err != nil {
+				logrus.Errorf("Failed to save endpoint %s: %v", ep.ID, err)
+			}
+		}
+	}
+}
+
+func staleReason(ep *endpoint, attached map[string]bool, links map[string]netlink.Link) string {
+	if !attached[ep.NicID] {
+		return fmt.Sprintf("nic %s is not attached to instance %s", ep.NicID, util.InstanceID)
+	}
+	// Links of joined endpoints live in the sandbox namespace.
+	if ep.SandboxKey == "" && links[ep.NicID] == nil {
+		return fmt.Sprintf("link of nic %s not found", ep.NicID)
+	}
+	return ""
+}
@@ -0,0 +1,231 @@
+package network
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/network"
+	sdktypes "github.com/nicescale/qcsdk/types"
+	"github.com/nicescale/qingcloud-docker-network/cloud/fake"
+	"github.com/nicescale/qingcloud-docker-network/util"
+	"github.com/nicescale/qingcloud-docker-network/util/nltest"
+)
+
+// stateEnv is a data dir with state files written by older versions of the
+// plugin, and the cloud and host that the driver loads them on.
+type stateEnv struct {
+	c   *fake.Cloud
+	nl  *nltest.Memory
+	dir string
+}
+
+func newStateEnv(t *testing.T) *stateEnv {
+	util.InstanceID = testInstance
+	dir, err := ioutil.TempDir("", "network-state-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := fake.New()
+	c.AddVxnet(testVxnet, testPool)
+	return &stateEnv{c: c, nl: nltest.NewMemory(), dir: dir}
+}
+
+func (e *stateEnv) close() {
+	os.RemoveAll(e.dir)
+}
+
+// addNic adds a nic attached to the instance, with its link in the host if
+// link is true.
+func (e *stateEnv) addNic(t *testing.T, link bool) string {
+	nic := e.c.AddNic(&sdktypes.Nic{VxnetID: testVxnet, Status: "in-use", InstanceID: testInstance})
+	if link {
+		if _, err := e.nl.AddLink(nic.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return nic.ID
+}
+
+// write writes the JSON file under the networks dir.
+func (e *stateEnv) write(t *testing.T, path, data string) {
+	f := filepath.Join(e.dir, "networks", testNetwork, path)
+	if err := os.MkdirAll(filepath.Dir(f), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(f, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (e *stateEnv) load() (*driver, error) {
+	rs := util.NewReservationStore(e.dir, time.Minute)
+	return load(e.c, e.nl, e.dir, rs, Config{LeakedPolicy: LeakedRequeue, DefaultSecurityGroup: "sg-default"})
+}
+
+func TestLoadNetworks(t *testing.T) {
+	tests := []struct {
+		name    string
+		network string
+		// endpoint is formatted with the ID of an attached nic.
+		endpoint string
+		upper    bool
+		// wantIP is the IP of the loaded endpoint, or the error of load.
+		wantIP  string
+		wantErr string
+	}{
+		{
+			name:     "v0",
+			network:  `{"ID":"%s","Vxnet":"%s","Router":"rtr-a","IPAMData":{"Pool":"192.168.0.0/24","Gateway":"192.168.0.1/24"}}`,
+			endpoint: `{"ID":"%s","NicID":"%s","IP":"192.168.0.10"}`,
+			upper:    true,
+			wantIP:   "192.168.0.10/24",
+		},
+		{
+			name:     "v1",
+			network:  `{"Version":1,"ID":"%s","Vxnet":"%s","Router":"rtr-a","IPAMData":{"Pool":"192.168.0.0/24","Gateway":"192.168.0.1/24"}}`,
+			endpoint: `{"Version":1,"ID":"%s","NicID":"%s","IP":"192.168.0.10/24"}`,
+			wantIP:   "192.168.0.10/24",
+		},
+		{
+			name:     "current",
+			network:  `{"Version":2,"ID":"%s","Subnets":[{"Vxnet":"%s","Router":"rtr-a","IPAMData":{"Pool":"192.168.0.0/24","Gateway":"192.168.0.1/24"}}]}`,
+			endpoint: `{"Version":2,"ID":"%s","NicID":"%s","IP":"192.168.0.10/24","Vxnet":"vxnet-a"}`,
+			wantIP:   "192.168.0.10/24",
+		},
+		{
+			name:     "newer",
+			network:  `{"Version":3,"ID":"%s","Subnets":[{"Vxnet":"%s"}]}`,
+			endpoint: `{"Version":3,"ID":"%s","NicID":"%s"}`,
+			wantErr:  "newer version",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newStateEnv(t)
+			defer e.close()
+			nicID := e.addNic(t, true)
+			savedID := nicID
+			if tt.upper {
+				savedID = strings.ToUpper(nicID)
+			}
+			e.write(t, testNetwork+".json", fmt.Sprintf(tt.network, testNetwork, testVxnet))
+			e.write(t, "endpoints/"+testEndpoint+".json", fmt.Sprintf(tt.endpoint, testEndpoint, savedID))
+
+			d, err := e.load()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("load error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("load: %v", err)
+			}
+
+			n := d.getNetwork(testNetwork)
+			if n == nil || len(n.Subnets) != 1 || n.Subnets[0].Vxnet != testVxnet || n.Subnets[0].IPAMData.Pool != testPool {
+				t.Fatalf("network %+v doesn't have the single subnet of %s", n, testVxnet)
+			}
+			if n.Vxnet != "" || n.IPAMData != nil {
+				t.Errorf("network %+v keeps the fields of schema version 1", n)
+			}
+			ep := n.getEndpoint(testEndpoint)
+			if ep == nil || ep.NicID != nicID || ep.IP != tt.wantIP || ep.Vxnet != testVxnet || ep.Stale {
+				t.Fatalf("endpoint = %+v, want nic %s, IP %s and vxnet %s", ep, nicID, tt.wantIP, testVxnet)
+			}
+
+			// The migrated files are loaded again as they are.
+			saved := &netConfig{}
+			if err := util.ReadJSON(d.netConfigPath(testNetwork), saved); err != nil || saved.Version != stateVersion {
+				t.Errorf("saved network %+v, %v, want schema version %d", saved, err, stateVersion)
+			}
+			savedEp := &endpoint{}
+			if err := util.ReadJSON(d.epConfigPath(testNetwork, testEndpoint), savedEp); err != nil || *savedEp != *ep {
+				t.Errorf("saved endpoint %+v, %v, want %+v", savedEp, err, ep)
+			}
+		})
+	}
+}
+
+func TestMarkStaleEndpoints(t *testing.T) {
+	tests := []struct {
+		name     string
+		attached bool
+		link     bool
+		sandbox  string
+		stale    bool
+	}{
+		{name: "idle", attached: true, link: true},
+		{name: "joined", attached: true, sandbox: "/var/run/docker/netns/test"},
+		{name: "link gone", attached: true, stale: true},
+		{name: "nic detached", link: true, stale: true},
+		{name: "joined nic detached", sandbox: "/var/run/docker/netns/test", stale: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newStateEnv(t)
+			defer e.close()
+			nicID := e.addNic(t, tt.link)
+			if !tt.attached {
+				if _, err := e.c.DetachNics([]string{nicID}, true); err != nil {
+					t.Fatal(err)
+				}
+			}
+			e.write(t, testNetwork+".json", fmt.Sprintf(`{"Version":2,"ID":"%s","Subnets":[{"Vxnet":"%s"}]}`, testNetwork, testVxnet))
+			e.write(t, "endpoints/"+testEndpoint+".json", fmt.Sprintf(`{"Version":2,"ID":"%s","NicID":"%s","SandboxKey":"%s"}`, testEndpoint, nicID, tt.sandbox))
+
+			d, err := e.load()
+			if err != nil {
+				t.Fatalf("load: %v", err)
+			}
+			ep := d.getNetwork(testNetwork).getEndpoint(testEndpoint)
+			if ep.Stale != tt.stale {
+				t.Errorf("endpoint stale = %v, want %v", ep.Stale, tt.stale)
+			}
+			saved := &endpoint{}
+			if err := util.ReadJSON(d.epConfigPath(testNetwork, testEndpoint), saved); err != nil || saved.Stale != tt.stale {
+				t.Errorf("saved endpoint %+v, %v, want stale %v", saved, err, tt.stale)
+			}
+		})
+	}
+}
+
+func TestDeleteStaleEndpoint(t *testing.T) {
+	tests := []struct {
+		name  string
+		stale bool
+	}{
+		{name: "stale", stale: true},
+		{name: "not stale"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newStateEnv(t)
+			defer e.close()
+			nicID := e.addNic(t, true)
+			e.write(t, testNetwork+".json", fmt.Sprintf(`{"Version":2,"ID":"%s","Subnets":[{"Vxnet":"%s"}]}`, testNetwork, testVxnet))
+			e.write(t, "endpoints/"+testEndpoint+".json", fmt.Sprintf(`{"Version":2,"ID":"%s","NicID":"%s","EIP":"eip-gone","Stale":%v}`, testEndpoint, nicID, tt.stale))
+			d, err := e.load()
+			if err != nil {
+				t.Fatalf("load: %v", err)
+			}
+
+			e.c.InjectError("DescribeEips", sdktypes.ResponseStatus{Code: fake.CodeInternalError, Message: "internal error"})
+			err = d.DeleteEndpoint(&network.DeleteEndpointRequest{NetworkID: testNetwork, EndpointID: testEndpoint})
+			if (err != nil) == tt.stale {
+				t.Fatalf("DeleteEndpoint error = %v, want error %v", err, !tt.stale)
+			}
+			if deleted := d.getNetwork(testNetwork).getEndpoint(testEndpoint) == nil; deleted != tt.stale {
+				t.Errorf("endpoint deleted = %v, want %v", deleted, tt.stale)
+			}
+		})
+	}
+}
@@ -0,0 +1,122 @@
+package network
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/docker/go-plugins-helpers/network"
+	sdktypes "github.com/nicescale/qcsdk/types"
+	"github.com/nicescale/qingcloud-docker-network/util"
+)
+
+// subnet is a vxnet that the endpoints of a network are created in.
+type subnet struct {
+	Vxnet    string
+	Router   string
+	IPAMData *network.IPAMData
+	// IPv6Data is set on networks created with --ipv6.
+	IPv6Data *network.IPAMData `json:",omitempty"`
+}
+
+// newSubnets returns the subnets of a network on the vxnets. Each pool
+// assigned by docker must be the network of one of the vxnets. The vxnets
+// without a pool, which only receive the addresses that overflow from the
+// other vxnets in the IPAM driver, get the network of their router.
+// A network on a single vxnet takes the first pool, whose mismatch with the
+// vxnet is passed to mismatch.
+func newSubnets(vs []*sdktypes.Vxnet, v4, v6 []*network.IPAMData, mismatch func(error) error) ([]*subnet, error) {
+	used := make(map[*network.IPAMData]bool)
+	var subnets []*subnet
+	for _, v := range vs {
+		s := &subnet{Vxnet: v.ID, Router: v.Router.ID}
+
+		s.IPAMData = findPool(v4, func(pool string) error { return util.CheckVxnetNetwork(v, pool, "") })
+		if s.IPAMData == nil && len(vs) == 1 {
+			s.IPAMData = v4[0]
+		}
+		if s.IPAMData == nil {
+			ipnet := v.Router.IPNetwork.IPNet
+			s.IPAMData = &network.IPAMData{Pool: ipnet.String(), Gateway: cidr(v.Router.ManagerIP, &ipnet)}
+		}
+		if err := util.CheckVxnetNetwork(v, s.IPAMData.Pool, s.IPAMData.Gateway); err != nil {
+			if err := mismatch(err); err != nil {
+				return nil, err
+			}
+		}
+		used[s.IPAMData] = true
+
+		if len(v6) > 0 {
+			s.IPv6Data = findPool(v6, func(pool string) error { return util.CheckVxnetIPv6(v, pool, "") })
+			if s.IPv6Data == nil && len(vs) == 1 {
+				s.IPv6Data = v6[0]
+			}
+			if s.IPv6Data == nil {
+				ipnet, gw, err := util.VxnetIPv6(v)
+				if err != nil {
+					return nil, err
+				}
+				s.IPv6Data = &network.IPAMData{Pool: ipnet.String(), Gateway: cidr(gw, ipnet)}
+			}
+			if err := util.CheckVxnetIPv6(v, s.IPv6Data.Pool, s.IPv6Data.Gateway); err != nil {
+				if err := mismatch(err); err != nil {
+					return nil, err
+				}
+			}
+			used[s.IPv6Data] = true
+		}
+		subnets = append(subnets, s)
+	}
+
+	for _, data := range append(v4, v6...) {
+		if !used[data] {
+			return nil, fmt.Errorf("pool %s doesn't match the network of any of the vxnets", data.Pool)
+		}
+	}
+	return subnets, nil
+}
+
+func findPool(pools []*network.IPAMData, check func(pool string) error) *network.IPAMData {
+	for _, data := range pools {
+		if check(data.Pool) == nil {
+			return data
+		}
+	}
+	return nil
+}
+
+func cidr(ip net.IP, ipnet *net.IPNet) string {
+	ones, _ := ipnet.Mask.Size()
+	return fmt.Sprintf("%s/%d", ip, ones)
+}
+
+// subnetOf returns the subnet whose pool contains ip, or nil if there is
+// none. ip may be in CIDR notation.
+func (n *netConfig) subnetOf(ip string) *subnet {
+	addr := net.ParseIP(strings.Split(ip, "/")[0])
+	for _, s := range n.Subnets {
+		if _, pool, err := net.ParseCIDR(s.IPAMData.Pool); err == nil && pool.Contains(addr) {
+			return s
+		}
+	}
+	return nil
+}
+
+// subnet returns the subnet of the vxnet, or nil if the network isn't on it.
+func (n *netConfig) subnet(vxnet string) *subnet {
+	for _, s := range n.Subnets {
+		if s.Vxnet == vxnet {
+			return s
+		}
+	}
+	return nil
+}
+
+// pools returns the IPv4 pools of the subnets.
+func (n *netConfig) pools() []string {
+	pools := make([]string, 0, len(n.Subnets))
+	for _, s := range n.Subnets {
+		pools = append(pools, s.IPAMData.Pool)
+	}
+	return pools
+}
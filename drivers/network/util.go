@@ -1,46 +1,25 @@
 package network
 
 import (
-	"encoding/json"
 	"fmt"
-	"io/ioutil"
+	"net"
 	"net/http"
 	"os"
 	"path/filepath"
 	"strings"
 	"time"
 
+	"github.com/Sirupsen/logrus"
 	"github.com/nicescale/qingcloud-docker-network/util"
+	"github.com/vishvananda/netlink"
 )
 
 var (
-	httpClient        = &http.Client{Timeout: time.Second * 5}
-	errNoAvailableNic = fmt.Errorf("no available nic")
+	httpClient = &http.Client{Timeout: time.Second * 5}
 )
 
 func (d *driver) writeFile(name string, data interface{}) error {
-	tmpPath := filepath.Join(d.root, "tmp")
-	if err := os.MkdirAll(tmpPath, 0700); err != nil {
-		return err
-	}
-
-	if err := os.MkdirAll(filepath.Dir(name), 0700); err != nil {
-		return err
-	}
-
-	tmp, err := ioutil.TempFile(tmpPath, "")
-	if err != nil {
-		return err
-	}
-	err = json.NewEncoder(tmp).Encode(data)
-	if err != nil {
-		tmp.Close()
-		os.Remove(tmp.Name())
-		return err
-	}
-	tmp.Sync()
-	tmp.Close()
-	return os.Rename(tmp.Name(), name)
+	return util.WriteJSON(filepath.Join(d.root, "tmp"), name, data)
 }
 
 func (d *driver) configDir() string {
@@ -63,68 +42,137 @@ func (d *driver) epConfigPath(networkID, endpointID string) string {
 	return filepath.Join(d.epConfigDir(networkID), endpointID+".json")
 }
 
-func (d *driver) loadNetworks() error {
-	cfgDir := d.configDir()
-	if err := os.MkdirAll(cfgDir, 0700); err != nil {
-		return err
-	}
+func (d *driver) getNetwork(nid string) *netConfig {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.networks[nid]
+}
 
-	networks, err := filepath.Glob(filepath.Join(d.configDir(), "*", "*.json"))
+// ClaimLink claims the nic reserved for ip in the vxnet for the owner and
+// returns the link of the nic in the network namespace of nl. The rules
+// installed by g for the idle nic are removed.
+// ip may be in CIDR notation.
+func ClaimLink(nl util.Netlink, rs *util.ReservationStore, g *util.HostGuard, vxnet, ip, owner string) (*util.Reservation, netlink.Link, error) {
+	// The pool ID of the IPAM driver is the vxnet ID.
+	r, err := rs.Claim(vxnet, strings.Split(ip, "/")[0], owner)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
-	for _, f := range networks {
-		n := &netConfig{}
-		if err := util.ReadJSON(f, n); err != nil {
-			return err
-		}
-
-		if n.endpoints == nil {
-			n.endpoints = make(map[string]*endpoint)
-		}
-
-		eps, err := filepath.Glob(filepath.Join(d.epConfigDir(n.ID), "*", "*.json"))
-		if err != nil && !os.IsNotExist(err) {
-			return err
-		}
-		for _, e := range eps {
-			ep := &endpoint{}
-			if err := util.ReadJSON(e, ep); err != nil {
-				return err
-			}
-			n.endpoints[ep.ID] = ep
+	link, err := claimedLink(nl, g, r)
+	if err != nil {
+		if err := rs.Unclaim(r.PoolID, r.Address, owner); err != nil {
+			logrus.Errorf("Failed to unclaim the reservation of %s: %v", r.Address, err)
 		}
-
-		d.networks[n.ID] = n
+		return nil, nil, err
 	}
+	return r, link, nil
+}
 
-	return nil
+func claimedLink(nl util.Netlink, g *util.HostGuard, r *util.Reservation) (netlink.Link, error) {
+	if err := g.Release(net.ParseIP(r.Address)); err != nil {
+		return nil, err
+	}
+	links, err := nl.LinkList()
+	if err != nil {
+		return nil, err
+	}
+	link := links[r.NicID]
+	if link == nil {
+		return nil, fmt.Errorf("link of nic %s reserved for %s not found", r.NicID, r.Address)
+	}
+	return link, nil
 }
 
-func (d *driver) getNetwork(nid string) *netConfig {
-	d.mu.Lock()
-	defer d.mu.Unlock()
-	return d.networks[nid]
+// UnclaimLink reverts ClaimLink for an owner that failed to be created.
+// The link gets its canonical name back and is prepared as an idle link
+// again, and the reservation is left for the IPAM driver to release.
+func UnclaimLink(nl util.Netlink, rs *util.ReservationStore, g *util.HostGuard, r *util.Reservation, link netlink.Link, owner string) {
+	log := logrus.WithField("nic", r.NicID)
+	if name := util.CanonicalNicName(r.NicID); link.Attrs().Name != name {
+		if err := nl.RenameLink(link, name); err != nil {
+			log.Errorf("Failed to rename link %s back to %s: %v", link.Attrs().Name, name, err)
+		}
+	}
+	if err := g.PrepareIdle(link, r.PoolID, net.ParseIP(r.Address)); err != nil {
+		log.Errorf("Failed to prepare the idle link: %v", err)
+	}
+	if err := rs.Unclaim(r.PoolID, r.Address, owner); err != nil {
+		log.Errorf("Failed to unclaim the reservation of %s: %v", r.Address, err)
+	}
 }
 
 func (d *driver) findAvailableNic(epid, vxnet, ip string) (*endpoint, error) {
-	link := util.NicStore.Delete(strings.Split(ip, "/")[0])
-	if link == nil {
-		return nil, errNoAvailableNic
+	r, link, err := ClaimLink(d.nl, d.rs, d.cfg.Host, vxnet, ip, epid)
+	if err != nil {
+		return nil, err
 	}
 	nicName := genNicName(epid)
-	if err := util.RenameLink(link, nicName); err != nil {
+	if err := d.nl.RenameLink(link, nicName); err != nil {
+		UnclaimLink(d.nl, d.rs, d.cfg.Host, r, link, epid)
 		return nil, err
 	}
 
 	ep := &endpoint{
-		ID:    epid,
-		NicID: link.Attrs().HardwareAddr.String(),
-		IP:    ip,
+		Version: stateVersion,
+		ID:      epid,
+		NicID:   link.Attrs().HardwareAddr.String(),
+		IP:      ip,
+		Vxnet:   vxnet,
+		IPv6:    r.AddressIPv6,
 	}
 	return ep, nil
 }
 
+// unclaimNic reverts findAvailableNic for an endpoint that failed to be
+// created.
+func (d *driver) unclaimNic(ep *endpoint) {
+	r := &util.Reservation{PoolID: ep.Vxnet, Address: strings.Split(ep.IP, "/")[0], NicID: ep.NicID}
+	link, err := d.nl.LinkByName(genNicName(ep.ID))
+	if err != nil {
+		logrus.WithField("nic", ep.NicID).Errorf("Failed to find the link of endpoint %s: %v", ep.ID, err)
+		if err := d.rs.Unclaim(r.PoolID, r.Address, ep.ID); err != nil {
+			logrus.WithField("nic", ep.NicID).Errorf("Failed to unclaim the reservation of %s: %v", r.Address, err)
+		}
+		return
+	}
+	UnclaimLink(d.nl, d.rs, d.cfg.Host, r, link, ep.ID)
+}
+
+// setIPv6 sets the IPv6 address of the endpoint on a dual-stack subnet to
+// the IPv6 address of its nic in CIDR notation. ip6 is the IPv6 address
+// assigned by the IPAM driver, which must be the address of the nic.
+func setIPv6(s *subnet, ep *endpoint, ip6 string) error {
+	if ep.IPv6 == "" {
+		return fmt.Errorf("nic %s has no IPv6 address", ep.NicID)
+	}
+	if ip6 != "" && !net.ParseIP(strings.Split(ip6, "/")[0]).Equal(net.ParseIP(ep.IPv6)) {
+		return fmt.Errorf("IPv6 address %s doesn't belong to nic %s with %s", ip6, ep.NicID, ep.IPv6)
+	}
+	_, pool, err := net.ParseCIDR(s.IPv6Data.Pool)
+	if err != nil {
+		return fmt.Errorf("invalid IPv6 pool %s: %v", s.IPv6Data.Pool, err)
+	}
+	ones, _ := pool.Mask.Size()
+	ep.IPv6 = fmt.Sprintf("%s/%d", ep.IPv6, ones)
+	return nil
+}
+
+// checkSticky verifies that the address assigned by the IPAM driver is the
+// address bound to the sticky identity. Docker doesn't pass the endpoint
+// options to the IPAM driver, so the bound address must be requested with
+// --ip.
+func (d *driver) checkSticky(id, vxnet, ip string) error {
+	b, err := d.sticky.Get(id)
+	if err != nil || b == nil || b.Vxnet != vxnet {
+		return err
+	}
+	if addr := strings.Split(ip, "/")[0]; addr != b.Address {
+		return fmt.Errorf("%s %s is bound to address %s of nic %s. Create the container with --ip %s",
+			util.OptStickyID, id, b.Address, b.NicID, b.Address)
+	}
+	return nil
+}
+
 func (d *driver) saveEndpoint(nid string, ep *endpoint) error {
 	if err := os.MkdirAll(d.epConfigDir(nid), 0700); err != nil {
 		return err
@@ -133,6 +181,22 @@ func (d *driver) saveEndpoint(nid string, ep *endpoint) error {
 	return d.writeFile(d.epConfigPath(nid, ep.ID), ep)
 }
 
+// stringOpts converts the generic options passed by docker to string options.
+func stringOpts(opts map[string]interface{}) map[string]string {
+	m := make(map[string]string, len(opts))
+	for k, v := range opts {
+		if s, ok := v.(string); ok {
+			m[k] = s
+		}
+	}
+	return m
+}
+
 func genNicName(epid string) string {
+	// Reservations may also be claimed by the CNI plugin, whose owner IDs
+	// aren't docker endpoint IDs.
+	if len(epid) < 12 {
+		return epid
+	}
 	return epid[:12]
 }
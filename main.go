@@ -1,25 +1,33 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
 	"os/user"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	ipamapi "github.com/docker/go-plugins-helpers/ipam"
 	netapi "github.com/docker/go-plugins-helpers/network"
 	"github.com/docker/go-plugins-helpers/sdk"
 	"github.com/nicescale/qcsdk"
+	"github.com/nicescale/qingcloud-docker-network/admin"
+	"github.com/nicescale/qingcloud-docker-network/cloud"
 	"github.com/nicescale/qingcloud-docker-network/drivers/ipam"
 	"github.com/nicescale/qingcloud-docker-network/drivers/network"
+	"github.com/nicescale/qingcloud-docker-network/metrics"
+	"github.com/nicescale/qingcloud-docker-network/plugin"
 	"github.com/nicescale/qingcloud-docker-network/util"
 	"github.com/urfave/cli"
 )
 
 const (
-	sockPath = "/var/run/docker/plugins/qingcloud.sock"
+	defaultSockPath = "/var/run/docker/plugins/qingcloud.sock"
+	defaultDataDir  = "/var/lib/docker/qingcloud-network"
 )
 
 var (
@@ -54,11 +62,113 @@ func main() {
 			Usage:  "The zone that the instance lies in.",
 			EnvVar: "ZONE",
 		},
+		cli.StringFlag{
+			Name:   "instance-id",
+			Usage:  "The ID of the instance. Detected from /etc/qingcloud/instance-id if empty.",
+			EnvVar: "INSTANCE_ID",
+		},
 		cli.StringFlag{
 			Name:   "data-dir,d",
 			Usage:  "The directory to store network related files.",
 			EnvVar: "DATA_DIR",
-			Value:  "/var/lib/docker/qingcloud-network",
+			Value:  defaultDataDir,
+		},
+		cli.StringFlag{
+			Name:   "sock",
+			Usage:  "The unix socket that the plugin serves from.",
+			EnvVar: "SOCK_PATH",
+			Value:  defaultSockPath,
+		},
+		cli.DurationFlag{
+			Name:   "reservation-ttl",
+			Usage:  "How long a nic attached by the IPAM driver is reserved for the endpoint.",
+			EnvVar: "RESERVATION_TTL",
+			Value:  5 * time.Minute,
+		},
+		cli.DurationFlag{
+			Name:   "link-timeout",
+			Usage:  "How long to wait for the link of an attached nic to come up.",
+			EnvVar: "LINK_TIMEOUT",
+			Value:  30 * time.Second,
+		},
+		cli.IntFlag{
+			Name:   "warm-low",
+			Usage:  "Attach more idle nics for a vxnet when there are fewer than this many.",
+			EnvVar: "WARM_LOW",
+			Value:  0,
+		},
+		cli.IntFlag{
+			Name:   "warm-high",
+			Usage:  "The maximum number of idle nics kept attached for a vxnet.",
+			EnvVar: "WARM_HIGH",
+			Value:  ipam.DefaultWarmHigh,
+		},
+		cli.DurationFlag{
+			Name:   "warm-interval",
+			Usage:  "How often to check the idle nics of each vxnet.",
+			EnvVar: "WARM_INTERVAL",
+			Value:  time.Minute,
+		},
+		cli.DurationFlag{
+			Name:   "sticky-ttl",
+			Usage:  "How long a sticky binding holds the nic of a removed container. 0 holds the nics until the bindings are removed.",
+			EnvVar: "STICKY_TTL",
+			Value:  24 * time.Hour,
+		},
+		cli.DurationFlag{
+			Name:   "lease-interval",
+			Usage:  "How often to renew the leases of the attached nics. 0 disables the leases, so the nics can't be taken over.",
+			EnvVar: "LEASE_INTERVAL",
+			Value:  time.Minute,
+		},
+		cli.BoolFlag{
+			Name:   "refuse-takeover",
+			Usage:  "Refuse to give up the attached nics to other instances.",
+			EnvVar: "REFUSE_TAKEOVER",
+		},
+		cli.DurationFlag{
+			Name:   "takeover-timeout",
+			Usage:  "How long to wait for a nic taken over from another instance to be detached.",
+			EnvVar: "TAKEOVER_TIMEOUT",
+			Value:  2 * time.Minute,
+		},
+		cli.DurationFlag{
+			Name:   "reconcile-interval",
+			Usage:  "How often to reconcile the attached nics with the endpoints. 0 means only at startup.",
+			EnvVar: "RECONCILE_INTERVAL",
+			Value:  10 * time.Minute,
+		},
+		cli.BoolFlag{
+			Name:   "reconcile-dry-run",
+			Usage:  "Only log what the reconciler would do.",
+			EnvVar: "RECONCILE_DRY_RUN",
+		},
+		cli.StringFlag{
+			Name:   "leaked-nic-policy",
+			Usage:  "What to do with leaked nics: requeue or detach.",
+			EnvVar: "LEAKED_NIC_POLICY",
+			Value:  network.LeakedRequeue,
+		},
+		cli.StringFlag{
+			Name:   "default-security-group",
+			Usage:  "The security group to restore to the nics that had none before an endpoint applied one.",
+			EnvVar: "DEFAULT_SECURITY_GROUP",
+		},
+		cli.StringFlag{
+			Name:   "idle-link",
+			Usage:  "What to do with the links of the idle nics in the host: down, or up with source-based policy routing.",
+			EnvVar: "IDLE_LINK",
+			Value:  util.IdleLinkDown,
+		},
+		cli.StringFlag{
+			Name:   "metrics-addr",
+			Usage:  "The address to serve Prometheus metrics at /metrics on, e.g. :9276. Disabled if empty.",
+			EnvVar: "METRICS_ADDR",
+		},
+		cli.StringFlag{
+			Name:   "admin-sock",
+			Usage:  "The unix socket that the admin API serves from. Defaults to admin.sock in the data dir.",
+			EnvVar: "ADMIN_SOCK",
 		},
 		cli.BoolFlag{
 			Name:   "debug",
@@ -66,24 +176,30 @@ func main() {
 			EnvVar: "DEBUG",
 		},
 	}
+	app.Commands = append(commands, cli.Command{
+		Name:   "plugin-config",
+		Usage:  "Print the config.json of the managed docker plugin.",
+		Hidden: true,
+		Action: printPluginConfig,
+	})
 	app.Run(os.Args)
 }
 
 // Run initializes the driver
 func Run(c *cli.Context) {
-	util.Init()
-	debug := c.Bool("debug")
-	if debug {
-		logrus.SetLevel(logrus.DebugLevel)
+	errLog := cloud.NewErrorLog(100)
+	var o cloud.Observer = errLog
+	if addr := c.GlobalString("metrics-addr"); addr != "" {
+		o = cloud.Observers(errLog, metrics.APIObserver{})
+		go func() {
+			if err := metrics.Serve(addr); err != nil {
+				logrus.Errorf("Failed to serve metrics on %s: %v", addr, err)
+			}
+		}()
 	}
-
-	ak := mustGetStringVar(c, "access-key-id")
-	sk := mustGetStringVar(c, "secret-key")
-	zone := mustGetStringVar(c, "zone")
-	dir := mustGetStringVar(c, "data-dir")
-	api := qcsdk.NewApi(ak, sk, zone)
-	api.SetDebug(debug)
-	dn, err := network.New(api, dir)
+	e := setup(c, o)
+	go e.rs.RunGC(time.Minute, nil)
+	nd, err := network.New(e.api, e.nl, e.dir, e.rs, e.networkConfig(c))
 	if err != nil {
 		errExit(1, err.Error())
 	}
@@ -93,24 +209,158 @@ func Run(c *cli.Context) {
 		gid, _ = strconv.Atoi(group.Gid)
 	}
 
-	di := ipam.New(api)
+	di, err := ipam.New(e.api, e.nl, e.dir, e.rs, ipam.Config{
+		LinkTimeout:  c.GlobalDuration("link-timeout"),
+		WarmLow:      c.GlobalInt("warm-low"),
+		WarmHigh:     c.GlobalInt("warm-high"),
+		WarmInterval: c.GlobalDuration("warm-interval"),
+		StickyTTL:    c.GlobalDuration("sticky-ttl"),
+
+		LeaseInterval:   c.GlobalDuration("lease-interval"),
+		RefuseTakeover:  c.GlobalBool("refuse-takeover"),
+		TakeoverTimeout: c.GlobalDuration("takeover-timeout"),
+
+		Host: e.host,
+	})
+	if err != nil {
+		errExit(1, err.Error())
+	}
+	sock := adminSock(c)
+	go func() {
+		if err := admin.Serve(sock, admin.Handler(nd, errLog)); err != nil {
+			logrus.Errorf("Failed to serve the admin API on %s: %v", sock, err)
+		}
+	}()
+
+	var dn netapi.Driver = nd
+	if c.GlobalString("metrics-addr") != "" {
+		dn, di = metrics.NetworkDriver(dn), metrics.IpamDriver(di)
+	}
 	h := sdk.NewHandler()
 	netapi.RegisterDriver(dn, h)
 	ipamapi.RegisterDriver(di, h)
-	if err = h.ServeUnix(sockPath, gid); err != nil {
+	if err = h.ServeUnix(c.GlobalString("sock"), gid); err != nil {
 		errExit(2, err.Error())
 	}
 }
 
+// env is what the plugin and the operator commands share.
+type env struct {
+	api  cloud.API
+	nl   util.Netlink
+	dir  string
+	rs   *util.ReservationStore
+	host *util.HostGuard
+}
+
+// setup creates the env from the global flags. The requests of the
+// qingcloud API are reported to o if it's not nil.
+func setup(c *cli.Context, o cloud.Observer) *env {
+	if err := util.Init(c.GlobalString("instance-id")); err != nil {
+		errExit(1, err.Error())
+	}
+	nl, err := util.NewNetlink()
+	if err != nil {
+		errExit(1, err.Error())
+	}
+	debug := c.GlobalBool("debug")
+	if debug {
+		logrus.SetLevel(logrus.DebugLevel)
+	}
+
+	ak := mustGetStringVar(c, "access-key-id")
+	sk := mustGetStringVar(c, "secret-key")
+	zone := mustGetStringVar(c, "zone")
+	dir := mustGetStringVar(c, "data-dir")
+	qc := qcsdk.NewApi(ak, sk, zone)
+	qc.SetDebug(debug)
+	var api cloud.API = qc
+	if o != nil {
+		api = cloud.Observe(api, o)
+	}
+	host, err := util.NewHostGuard(api, nl, c.GlobalString("idle-link"))
+	if err != nil {
+		errExit(1, err.Error())
+	}
+	return &env{
+		api:  api,
+		nl:   nl,
+		dir:  dir,
+		rs:   util.NewReservationStore(dir, c.GlobalDuration("reservation-ttl")),
+		host: host,
+	}
+}
+
+func (e *env) networkConfig(c *cli.Context) network.Config {
+	return network.Config{
+		ReconcileInterval:    c.GlobalDuration("reconcile-interval"),
+		ReconcileDryRun:      c.GlobalBool("reconcile-dry-run"),
+		LeakedPolicy:         c.GlobalString("leaked-nic-policy"),
+		Host:                 e.host,
+		DefaultSecurityGroup: c.GlobalString("default-security-group"),
+	}
+}
+
+// adminSock returns the path of the admin API socket.
+func adminSock(c *cli.Context) string {
+	if sock := c.GlobalString("admin-sock"); sock != "" {
+		return sock
+	}
+	return filepath.Join(strings.TrimSpace(c.GlobalString("data-dir")), "admin.sock")
+}
+
 func errExit(code int, format string, val ...interface{}) {
 	fmt.Fprintf(os.Stderr, format+"\n", val...)
 	os.Exit(code)
 }
 
 func mustGetStringVar(c *cli.Context, key string) string {
-	v := strings.TrimSpace(c.String(key))
+	v := strings.TrimSpace(c.GlobalString(key))
 	if v == "" {
 		errExit(1, "%s must be provided", key)
 	}
 	return v
 }
+
+// printPluginConfig prints the config.json of the managed plugin.
+// The settings of the plugin are generated from the flags of the app.
+func printPluginConfig(c *cli.Context) error {
+	var env []plugin.Env
+	for _, f := range c.App.Flags {
+		e := pluginEnv(f)
+		if e == nil {
+			continue
+		}
+		switch e.Name {
+		case "DATA_DIR":
+			// Change the source of the data-dir mount instead.
+		case "SOCK_PATH":
+			e.Value = plugin.SocketPath
+		default:
+			e.Settable = []string{"value"}
+		}
+		env = append(env, *e)
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(plugin.New("/bin/"+c.App.Name, defaultDataDir, env))
+}
+
+func pluginEnv(f cli.Flag) *plugin.Env {
+	var e plugin.Env
+	switch f := f.(type) {
+	case cli.StringFlag:
+		e = plugin.Env{Name: f.EnvVar, Description: f.Usage, Value: f.Value}
+	case cli.IntFlag:
+		e = plugin.Env{Name: f.EnvVar, Description: f.Usage, Value: strconv.Itoa(f.Value)}
+	case cli.DurationFlag:
+		e = plugin.Env{Name: f.EnvVar, Description: f.Usage, Value: f.Value.String()}
+	case cli.BoolFlag:
+		e = plugin.Env{Name: f.EnvVar, Description: f.Usage, Value: "false"}
+	}
+	if e.Name == "" {
+		return nil
+	}
+	return &e
+}
@@ -0,0 +1,126 @@
+package metrics
+
+import (
+	"time"
+
+	"github.com/docker/go-plugins-helpers/ipam"
+	"github.com/docker/go-plugins-helpers/network"
+)
+
+// NetworkDriver returns a network driver that records the calls to d.
+func NetworkDriver(d network.Driver) network.Driver {
+	return &networkDriver{d}
+}
+
+type networkDriver struct {
+	d network.Driver
+}
+
+func (m *networkDriver) GetCapabilities() (resp *network.CapabilitiesResponse, err error) {
+	defer observeCall("NetworkDriver.GetCapabilities", time.Now(), &err)
+	return m.d.GetCapabilities()
+}
+
+func (m *networkDriver) CreateNetwork(req *network.CreateNetworkRequest) (err error) {
+	defer observeCall("NetworkDriver.CreateNetwork", time.Now(), &err)
+	return m.d.CreateNetwork(req)
+}
+
+func (m *networkDriver) AllocateNetwork(req *network.AllocateNetworkRequest) (resp *network.AllocateNetworkResponse, err error) {
+	defer observeCall("NetworkDriver.AllocateNetwork", time.Now(), &err)
+	return m.d.AllocateNetwork(req)
+}
+
+func (m *networkDriver) DeleteNetwork(req *network.DeleteNetworkRequest) (err error) {
+	defer observeCall("NetworkDriver.DeleteNetwork", time.Now(), &err)
+	return m.d.DeleteNetwork(req)
+}
+
+func (m *networkDriver) FreeNetwork(req *network.FreeNetworkRequest) (err error) {
+	defer observeCall("NetworkDriver.FreeNetwork", time.Now(), &err)
+	return m.d.FreeNetwork(req)
+}
+
+func (m *networkDriver) CreateEndpoint(req *network.CreateEndpointRequest) (resp *network.CreateEndpointResponse, err error) {
+	defer observeCall("NetworkDriver.CreateEndpoint", time.Now(), &err)
+	return m.d.CreateEndpoint(req)
+}
+
+func (m *networkDriver) DeleteEndpoint(req *network.DeleteEndpointRequest) (err error) {
+	defer observeCall("NetworkDriver.DeleteEndpoint", time.Now(), &err)
+	return m.d.DeleteEndpoint(req)
+}
+
+func (m *networkDriver) EndpointInfo(req *network.InfoRequest) (resp *network.InfoResponse, err error) {
+	defer observeCall("NetworkDriver.EndpointInfo", time.Now(), &err)
+	return m.d.EndpointInfo(req)
+}
+
+func (m *networkDriver) Join(req *network.JoinRequest) (resp *network.JoinResponse, err error) {
+	defer observeCall("NetworkDriver.Join", time.Now(), &err)
+	return m.d.Join(req)
+}
+
+func (m *networkDriver) Leave(req *network.LeaveRequest) (err error) {
+	defer observeCall("NetworkDriver.Leave", time.Now(), &err)
+	return m.d.Leave(req)
+}
+
+func (m *networkDriver) DiscoverNew(req *network.DiscoveryNotification) (err error) {
+	defer observeCall("NetworkDriver.DiscoverNew", time.Now(), &err)
+	return m.d.DiscoverNew(req)
+}
+
+func (m *networkDriver) DiscoverDelete(req *network.DiscoveryNotification) (err error) {
+	defer observeCall("NetworkDriver.DiscoverDelete", time.Now(), &err)
+	return m.d.DiscoverDelete(req)
+}
+
+func (m *networkDriver) ProgramExternalConnectivity(req *network.ProgramExternalConnectivityRequest) (err error) {
+	defer observeCall("NetworkDriver.ProgramExternalConnectivity", time.Now(), &err)
+	return m.d.ProgramExternalConnectivity(req)
+}
+
+func (m *networkDriver) RevokeExternalConnectivity(req *network.RevokeExternalConnectivityRequest) (err error) {
+	defer observeCall("NetworkDriver.RevokeExternalConnectivity", time.Now(), &err)
+	return m.d.RevokeExternalConnectivity(req)
+}
+
+// IpamDriver returns an IPAM driver that records the calls to d.
+func IpamDriver(d ipam.Ipam) ipam.Ipam {
+	return &ipamDriver{d}
+}
+
+type ipamDriver struct {
+	d ipam.Ipam
+}
+
+func (m *ipamDriver) GetCapabilities() (resp *ipam.CapabilitiesResponse, err error) {
+	defer observeCall("IpamDriver.GetCapabilities", time.Now(), &err)
+	return m.d.GetCapabilities()
+}
+
+func (m *ipamDriver) GetDefaultAddressSpaces() (resp *ipam.AddressSpacesResponse, err error) {
+	defer observeCall("IpamDriver.GetDefaultAddressSpaces", time.Now(), &err)
+	return m.d.GetDefaultAddressSpaces()
+}
+
+func (m *ipamDriver) RequestPool(req *ipam.RequestPoolRequest) (resp *ipam.RequestPoolResponse, err error) {
+	defer observeCall("IpamDriver.RequestPool", time.Now(), &err)
+	return m.d.RequestPool(req)
+}
+
+func (m *ipamDriver) ReleasePool(req *ipam.ReleasePoolRequest) (err error) {
+	defer observeCall("IpamDriver.ReleasePool", time.Now(), &err)
+	return m.d.ReleasePool(req)
+}
+
+func (m *ipamDriver) RequestAddress(req *ipam.RequestAddressRequest) (resp *ipam.RequestAddressResponse, err error) {
+	defer observeCall("IpamDriver.RequestAddress", time.Now(), &err)
+	return m.d.RequestAddress(req)
+}
+
+func (m *ipamDriver) ReleaseAddress(req *ipam.ReleaseAddressRequest) (err error) {
+	defer observeCall("IpamDriver.ReleaseAddress", time.Now(), &err)
+	return m.d.ReleaseAddress(req)
+}
@@ -0,0 +1,102 @@
+package metrics
+
+import (
+	"strconv"
+	"time"
+
+	sdktypes "github.com/nicescale/qcsdk/types"
+	"github.com/nicescale/qingcloud-docker-network/cloud"
+)
+
+// The metrics of the plugin.
+var (
+	PluginCalls = NewCounterVec("qdn_plugin_calls_total",
+		"The docker plugin calls by result.", "call", "result")
+	PluginCallDuration = NewHistogramVec("qdn_plugin_call_duration_seconds",
+		"The latency of the docker plugin calls.", DefaultBuckets, "call")
+
+	APIRequests = NewCounterVec("qdn_api_requests_total",
+		"The qingcloud API requests by action.", "action")
+	APIErrors = NewCounterVec("qdn_api_errors_total",
+		`The failed qingcloud API requests by action and ret_code. The ret_code of transport and decoding errors is "none".`,
+		"action", "ret_code")
+	APIRequestDuration = NewHistogramVec("qdn_api_request_duration_seconds",
+		"The latency of the qingcloud API requests.", DefaultBuckets, "action")
+	JobWaitDuration = NewHistogramVec("qdn_job_wait_duration_seconds",
+		`How long the waits for qingcloud jobs took, by the last status of the job, or "timeout" or "error".`,
+		DefaultBuckets, "status")
+
+	Nics = NewGaugeVec("qdn_nics",
+		"The nics attached to the instance by vxnet and state. The nics are counted by the reconciler and moved between the states as they are allocated and released.",
+		"vxnet", "state")
+	NicAllocations = NewCounterVec("qdn_nic_allocations_total",
+		"The nics allocated for addresses by source: an idle nic attached to the instance, an available nic of the vxnet, a nic taken over from another instance, or a created nic.",
+		"source")
+)
+
+// The sources of NicAllocations.
+const (
+	SourceIdle      = "idle"
+	SourceAvailable = "available"
+	SourceTakeover  = "takeover"
+	SourceCreated   = "created"
+)
+
+// The states of Nics that change between the reconciles.
+const (
+	NicInUse = "in-use"
+	NicIdle  = "idle"
+)
+
+// MoveNic moves a nic of the vxnet from the state from to the state to in
+// Nics. An empty state means not attached to the instance.
+func MoveNic(vxnet, from, to string) {
+	if from != "" {
+		Nics.Add(-1, vxnet, from)
+	}
+	if to != "" {
+		Nics.Add(1, vxnet, to)
+	}
+}
+
+// APIObserver collects the metrics of a cloud.API wrapped by
+// cloud.Observe.
+type APIObserver struct{}
+
+var _ cloud.Observer = APIObserver{}
+
+// ObserveRequest implements cloud.Observer.
+func (APIObserver) ObserveRequest(action string, d time.Duration, err error) {
+	APIRequests.Inc(action)
+	APIRequestDuration.Observe(d.Seconds(), action)
+	if err == nil {
+		return
+	}
+	code := "none"
+	if e, ok := err.(sdktypes.ResponseStatus); ok {
+		code = strconv.Itoa(e.Code)
+	}
+	APIErrors.Inc(action, code)
+}
+
+// ObserveJobWait implements cloud.Observer.
+func (APIObserver) ObserveJobWait(status string, d time.Duration, err error) {
+	switch {
+	case err == sdktypes.ErrJobTimeout:
+		status = "timeout"
+	case err != nil:
+		status = "error"
+	}
+	JobWaitDuration.Observe(d.Seconds(), status)
+}
+
+// observeCall records a plugin call that started at start and returned
+// *err.
+func observeCall(call string, start time.Time, err *error) {
+	result := "ok"
+	if *err != nil {
+		result = "error"
+	}
+	PluginCalls.Inc(call, result)
+	PluginCallDuration.Since(start, call)
+}
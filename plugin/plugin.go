@@ -0,0 +1,102 @@
+// Package plugin describes the configuration of the managed (v2) docker
+// plugin, i.e. the config.json that is packed together with the rootfs
+// by `docker plugin create`.
+package plugin
+
+// The socket that the managed plugin serves from.
+// Docker looks for it in /run/docker/plugins of the plugin rootfs.
+const (
+	SocketName = "qingcloud.sock"
+	SocketPath = "/run/docker/plugins/" + SocketName
+)
+
+// Config is the subset of the docker plugin config that the plugin uses.
+// See https://docs.docker.com/engine/extend/config/ for the format.
+type Config struct {
+	Description   string    `json:"description"`
+	Documentation string    `json:"documentation"`
+	Entrypoint    []string  `json:"entrypoint"`
+	Interface     Interface `json:"interface"`
+	Network       Network   `json:"network"`
+	Linux         Linux     `json:"linux"`
+	Mounts        []Mount   `json:"mounts"`
+	Env           []Env     `json:"env"`
+}
+
+// Interface lists the plugin APIs implemented by the plugin.
+type Interface struct {
+	Types  []string `json:"types"`
+	Socket string   `json:"socket"`
+}
+
+// Network is the network mode of the plugin.
+type Network struct {
+	Type string `json:"type"`
+}
+
+// Linux lists the capabilities granted to the plugin.
+type Linux struct {
+	Capabilities []string `json:"capabilities"`
+}
+
+// Mount is a bind mount from the host into the plugin rootfs.
+type Mount struct {
+	Name        string   `json:"name,omitempty"`
+	Description string   `json:"description,omitempty"`
+	Settable    []string `json:"settable,omitempty"`
+	Source      string   `json:"source"`
+	Destination string   `json:"destination"`
+	Type        string   `json:"type"`
+	Options     []string `json:"options"`
+}
+
+// Env is an environment variable of the plugin.
+// Settable variables can be changed with `docker plugin set`.
+type Env struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Settable    []string `json:"settable,omitempty"`
+	Value       string   `json:"value"`
+}
+
+// New returns the plugin config. dataDir is bind mounted into the plugin
+// at the same path, and env is the list of the settings of the plugin.
+func New(entrypoint, dataDir string, env []Env) *Config {
+	return &Config{
+		Description:   "QingCloud vxnet network and IPAM driver",
+		Documentation: "https://github.com/nicescale/qingcloud-docker-network",
+		Entrypoint:    []string{entrypoint},
+		Interface: Interface{
+			Types:  []string{"docker.networkdriver/1.0", "docker.ipamdriver/1.0"},
+			Socket: SocketName,
+		},
+		// The nics are attached to the host and moved into the sandboxes
+		// by docker, so the plugin must live in the host network namespace.
+		Network: Network{Type: "host"},
+		Linux: Linux{
+			Capabilities: []string{"CAP_NET_ADMIN"},
+		},
+		Mounts: []Mount{
+			{
+				Name:        "data-dir",
+				Description: "The directory to store network related files.",
+				Settable:    []string{"source"},
+				Source:      dataDir,
+				Destination: dataDir,
+				Type:        "bind",
+				Options:     []string{"rbind", "rw"},
+			},
+			{
+				// The reconciler checks whether the sandboxes of the
+				// endpoints still exist.
+				Name:        "netns",
+				Description: "The network namespaces of the docker sandboxes.",
+				Source:      "/var/run/docker/netns",
+				Destination: "/var/run/docker/netns",
+				Type:        "bind",
+				Options:     []string{"rbind", "ro"},
+			},
+		},
+		Env: env,
+	}
+}
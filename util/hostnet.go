@@ -0,0 +1,302 @@
+package util
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/nicescale/qingcloud-docker-network/cloud"
+	"github.com/vishvananda/netlink"
+)
+
+// The policies for the links of the idle nics in the host network namespace.
+const (
+	// IdleLinkDown keeps the links down and removes the addresses that
+	// DHCP clients of the host assigned to them before they were disabled.
+	IdleLinkDown = "down"
+	// IdleLinkUp keeps the links up. The traffic from the address of each
+	// nic is routed through its own link by a source-based rule, and
+	// default routes through the links are removed from the main table.
+	IdleLinkUp = "up"
+)
+
+const (
+	// rulePriority is the priority of the rules installed for idle links,
+	// ahead of the main table (32766).
+	rulePriority = 30000
+	// tableBase plus the index of an idle link is the routing table of the
+	// link.
+	tableBase = 10000
+
+	sysctlRoot = "/proc/sys"
+)
+
+// nmcli is the NetworkManager CLI that stops DHCP on the idle links.
+var nmcli = "nmcli"
+
+// idleSysctls keep an idle link from answering ARP for the addresses of
+// other links, and from configuring itself by router advertisements.
+// The reverse path filter is loose because the replies to the traffic of
+// the host may arrive at any link.
+var idleSysctls = []struct{ path, value string }{
+	{"net/ipv4/conf/%s/rp_filter", "2"},
+	{"net/ipv4/conf/%s/arp_ignore", "1"},
+	{"net/ipv4/conf/%s/arp_announce", "2"},
+	{"net/ipv6/conf/%s/accept_ra", "0"},
+	{"net/ipv6/conf/%s/autoconf", "0"},
+}
+
+// HostGuard keeps the links of the idle nics from changing the routing of
+// the host. The primary nic of the instance and the routes of its link are
+// never touched; the callers must not pass it to the guard.
+// The methods are no-ops on a nil HostGuard.
+type HostGuard struct {
+	api    cloud.API
+	nl     Netlink
+	policy string
+
+	mu       sync.Mutex
+	networks map[string]*net.IPNet // The networks of the vxnets.
+	gateways map[string]net.IP     // The gateways of the vxnets.
+}
+
+// NewHostGuard creates a HostGuard with the idle link policy.
+// An empty policy means IdleLinkDown.
+func NewHostGuard(api cloud.API, nl Netlink, policy string) (*HostGuard, error) {
+	switch policy {
+	case "":
+		policy = IdleLinkDown
+	case IdleLinkDown, IdleLinkUp:
+	default:
+		return nil, fmt.Errorf("invalid idle link policy %q. Valid values are %s and %s", policy, IdleLinkDown, IdleLinkUp)
+	}
+	return &HostGuard{
+		api:      api,
+		nl:       nl,
+		policy:   policy,
+		networks: make(map[string]*net.IPNet),
+		gateways: make(map[string]net.IP),
+	}, nil
+}
+
+// PrepareIdle configures the link of an idle nic with the address ip in
+// the vxnet according to the policy. It's idempotent.
+// The sysctls and DHCP are best effort because /proc/sys is read-only and
+// NetworkManager is out of reach in the managed plugin.
+func (g *HostGuard) PrepareIdle(link netlink.Link, vxnet string, ip net.IP) error {
+	if g == nil {
+		return nil
+	}
+	name := link.Attrs().Name
+	log := logrus.WithField("link", name)
+	for _, s := range idleSysctls {
+		if err := writeSysctl(fmt.Sprintf(s.path, name), s.value); err != nil {
+			log.Warn(err)
+		}
+	}
+	if err := disableDHCP(name); err != nil {
+		log.Warnf("Failed to disable DHCP: %v", err)
+	}
+
+	if g.policy == IdleLinkDown {
+		return g.keepDown(link, ip)
+	}
+	return g.keepUp(link, vxnet, ip)
+}
+
+func (g *HostGuard) keepDown(link netlink.Link, ip net.IP) error {
+	if err := g.Release(ip); err != nil {
+		return err
+	}
+	if link.Attrs().Flags&net.FlagUp != 0 {
+		if err := g.nl.LinkSetDown(link); err != nil {
+			return err
+		}
+	}
+	// Removing the addresses also removes their routes.
+	addrs, err := g.nl.AddrList(link, netlink.FAMILY_ALL)
+	if err != nil {
+		return err
+	}
+	for _, addr := range addrs {
+		if addr.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		if err := g.nl.AddrDel(link, &addr); err != nil {
+			return fmt.Errorf("failed to remove address %s from idle link %s: %v", addr.IPNet, link.Attrs().Name, err)
+		}
+		logrus.WithField("link", link.Attrs().Name).Infof("Address %s removed from idle link", addr.IPNet)
+	}
+	return nil
+}
+
+func (g *HostGuard) keepUp(link netlink.Link, vxnet string, ip net.IP) error {
+	ipnet, gw, err := g.vxnetNetwork(vxnet)
+	if err != nil {
+		return err
+	}
+	if link.Attrs().Flags&net.FlagUp == 0 {
+		if err := g.nl.LinkSetUp(link); err != nil {
+			return err
+		}
+	}
+
+	index := link.Attrs().Index
+	table := tableBase + index
+	routes := []*netlink.Route{
+		{LinkIndex: index, Dst: ipnet, Scope: netlink.SCOPE_LINK, Table: table},
+		{LinkIndex: index, Gw: gw, Table: table},
+	}
+	for _, r := range routes {
+		if err := g.nl.RouteAdd(r); err != nil && err != syscall.EEXIST {
+			return fmt.Errorf("failed to add route %s to table %d: %v", r, table, err)
+		}
+	}
+
+	rules, err := g.rules(ip)
+	if err != nil {
+		return err
+	}
+	found := false
+	for _, r := range rules {
+		if r.Table == table {
+			found = true
+			continue
+		}
+		if err := g.nl.RuleDel(&r); err != nil {
+			return err
+		}
+	}
+	if !found {
+		r := netlink.NewRule()
+		r.Priority = rulePriority
+		r.Table = table
+		r.Src = &net.IPNet{IP: ip.To4(), Mask: net.CIDRMask(32, 32)}
+		if err := g.nl.RuleAdd(r); err != nil {
+			return fmt.Errorf("failed to add rule from %s to table %d: %v", ip, table, err)
+		}
+	}
+
+	// Default routes through the link in the main table would capture the
+	// traffic of the host.
+	defaults, err := g.nl.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{LinkIndex: index}, netlink.RT_FILTER_OIF)
+	if err != nil {
+		return err
+	}
+	for _, r := range defaults {
+		if r.Dst != nil {
+			continue
+		}
+		if err := g.nl.RouteDel(&r); err != nil {
+			return fmt.Errorf("failed to remove default route via idle link %s: %v", link.Attrs().Name, err)
+		}
+		logrus.WithField("link", link.Attrs().Name).Infof("Default route via %s removed from the main table", r.Gw)
+	}
+	return nil
+}
+
+// Release removes the rules of the nic with the address ip, e.g. before
+// the nic is moved into a container or detached. The routes in the table
+// of the link are removed by the kernel when the link leaves the host.
+func (g *HostGuard) Release(ip net.IP) error {
+	if g == nil || ip == nil {
+		return nil
+	}
+	rules, err := g.rules(ip)
+	if err != nil {
+		return err
+	}
+	for _, r := range rules {
+		if err := g.nl.RuleDel(&r); err != nil {
+			return fmt.Errorf("failed to remove rule from %s: %v", ip, err)
+		}
+	}
+	return nil
+}
+
+// Sweep removes the rules installed for the addresses that are not in idle,
+// e.g. of the nics taken over by other instances.
+func (g *HostGuard) Sweep(idle map[string]bool) error {
+	if g == nil {
+		return nil
+	}
+	rules, err := g.nl.RuleList(netlink.FAMILY_V4)
+	if err != nil {
+		return err
+	}
+	for _, r := range rules {
+		if r.Priority != rulePriority || r.Src == nil || idle[r.Src.IP.String()] {
+			continue
+		}
+		if err := g.nl.RuleDel(&r); err != nil {
+			return fmt.Errorf("failed to remove rule from %s: %v", r.Src.IP, err)
+		}
+		logrus.Infof("Rule from %s to table %d removed", r.Src.IP, r.Table)
+	}
+	return nil
+}
+
+// rules returns the rules installed for ip.
+func (g *HostGuard) rules(ip net.IP) ([]netlink.Rule, error) {
+	all, err := g.nl.RuleList(netlink.FAMILY_V4)
+	if err != nil {
+		return nil, err
+	}
+	var rules []netlink.Rule
+	for _, r := range all {
+		if r.Priority == rulePriority && r.Src != nil && r.Src.IP.Equal(ip) {
+			rules = append(rules, r)
+		}
+	}
+	return rules, nil
+}
+
+func (g *HostGuard) vxnetNetwork(vxnet string) (*net.IPNet, net.IP, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if ipnet := g.networks[vxnet]; ipnet != nil {
+		return ipnet, g.gateways[vxnet], nil
+	}
+
+	v, err := DescribeVxnet(g.api, vxnet)
+	if err != nil {
+		return nil, nil, err
+	}
+	ipnet := v.Router.IPNetwork.IPNet
+	g.networks[vxnet] = &ipnet
+	g.gateways[vxnet] = v.Router.ManagerIP
+	return &ipnet, v.Router.ManagerIP, nil
+}
+
+// disableDHCP makes NetworkManager leave the link alone so that it doesn't
+// run DHCP on it. Hosts without NetworkManager are left alone.
+func disableDHCP(name string) error {
+	path, err := exec.LookPath(nmcli)
+	if err != nil {
+		return nil
+	}
+	if out, err := exec.Command(path, "device", "set", name, "managed", "no").CombinedOutput(); err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// writeSysctl sets the sysctl at path, e.g. net/ipv4/ip_forward.
+// Missing sysctls, e.g. of IPv6 disabled in the kernel, are ignored.
+func writeSysctl(path, value string) error {
+	f := filepath.Join(sysctlRoot, path)
+	if _, err := os.Stat(f); os.IsNotExist(err) {
+		return nil
+	}
+	if err := ioutil.WriteFile(f, []byte(value), 0644); err != nil {
+		return fmt.Errorf("failed to set sysctl %s: %v", path, err)
+	}
+	return nil
+}
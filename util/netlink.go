@@ -0,0 +1,197 @@
+package util
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"github.com/vishvananda/netns"
+)
+
+// Netlink is the set of link operations used by the drivers.
+// Links are identified by their hardware address which is the ID of the
+// corresponding qingcloud nic.
+type Netlink interface {
+	// LinkList returns the links keyed by hardware address.
+	LinkList() (map[string]netlink.Link, error)
+	LinkByName(name string) (netlink.Link, error)
+	// RenameLink brings the link down and renames it. The name in the
+	// attributes of link is updated.
+	RenameLink(link netlink.Link, name string) error
+	LinkSetUp(link netlink.Link) error
+	LinkSetDown(link netlink.Link) error
+	LinkSetMTU(link netlink.Link, mtu int) error
+	LinkSetTxQLen(link netlink.Link, qlen int) error
+	// LinkSetNs moves the link to the network namespace at path.
+	LinkSetNs(link netlink.Link, path string) error
+	AddrAdd(link netlink.Link, addr *netlink.Addr) error
+	AddrDel(link netlink.Link, addr *netlink.Addr) error
+	AddrList(link netlink.Link, family int) ([]netlink.Addr, error)
+	RouteAdd(route *netlink.Route) error
+	RouteDel(route *netlink.Route) error
+	RouteListFiltered(family int, filter *netlink.Route, filterMask uint64) ([]netlink.Route, error)
+	RuleAdd(rule *netlink.Rule) error
+	RuleDel(rule *netlink.Rule) error
+	RuleList(family int) ([]netlink.Rule, error)
+	// WaitForLink waits until the link with the hardware address mac
+	// appears, and is up if up is true. The link is brought up if it
+	// appears down. Otherwise it's left as the kernel created it.
+	WaitForLink(mac string, timeout time.Duration, up bool) (netlink.Link, error)
+}
+
+// LinkTimeoutError is returned by WaitForLink if the link of a hot-plugged
+// nic doesn't show up in time.
+type LinkTimeoutError struct {
+	MAC     string
+	Timeout time.Duration
+}
+
+func (e *LinkTimeoutError) Error() string {
+	return fmt.Sprintf("link of nic %s didn't come up within %s", e.MAC, e.Timeout)
+}
+
+type nlHandle struct {
+	*netlink.Handle
+	ns netns.NsHandle
+}
+
+// NewNetlink returns a Netlink operating in the network namespace of the
+// calling process.
+func NewNetlink() (Netlink, error) {
+	return NewNetlinkAt(netns.None())
+}
+
+// NewNetlinkAt returns a Netlink operating in the network namespace ns.
+// netns.None() means the namespace of the calling process.
+func NewNetlinkAt(ns netns.NsHandle) (Netlink, error) {
+	h, err := netlink.NewHandleAt(ns)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create netlink handle: %v", err)
+	}
+	return &nlHandle{Handle: h, ns: ns}, nil
+}
+
+func (h *nlHandle) LinkList() (map[string]netlink.Link, error) {
+	links, err := h.Handle.LinkList()
+	if err != nil {
+		return nil, err
+	}
+	m := make(map[string]netlink.Link)
+	for _, n := range links {
+		m[n.Attrs().HardwareAddr.String()] = n
+	}
+	return m, nil
+}
+
+func (h *nlHandle) RenameLink(link netlink.Link, name string) error {
+	if err := h.Handle.LinkSetDown(link); err != nil {
+		return err
+	}
+	if err := h.Handle.LinkSetName(link, name); err != nil {
+		return err
+	}
+	link.Attrs().Name = name
+	return nil
+}
+
+// LinkSetTxQLen sets the transmit queue length of the link like
+// `ip link set $link txqueuelen $qlen`, which the vendored netlink lacks.
+func (h *nlHandle) LinkSetTxQLen(link netlink.Link, qlen int) error {
+	index := link.Attrs().Index
+	if index == 0 {
+		l, err := h.Handle.LinkByName(link.Attrs().Name)
+		if err != nil {
+			return err
+		}
+		index = l.Attrs().Index
+	}
+
+	s, err := nl.GetNetlinkSocketAt(h.ns, netns.None(), syscall.NETLINK_ROUTE)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	req := &nl.NetlinkRequest{
+		NlMsghdr: syscall.NlMsghdr{
+			Len:   uint32(syscall.SizeofNlMsghdr),
+			Type:  uint16(syscall.RTM_SETLINK),
+			Flags: syscall.NLM_F_REQUEST | syscall.NLM_F_ACK,
+		},
+		Sockets: map[int]*nl.SocketHandle{syscall.NETLINK_ROUTE: {Socket: s}},
+	}
+	msg := nl.NewIfInfomsg(syscall.AF_UNSPEC)
+	msg.Index = int32(index)
+	req.AddData(msg)
+	b := make([]byte, 4)
+	nl.NativeEndian().PutUint32(b, uint32(qlen))
+	req.AddData(nl.NewRtAttr(syscall.IFLA_TXQLEN, b))
+
+	_, err = req.Execute(syscall.NETLINK_ROUTE, 0)
+	return err
+}
+
+func (h *nlHandle) LinkSetNs(link netlink.Link, path string) error {
+	ns, err := netns.GetFromPath(path)
+	if err != nil {
+		return err
+	}
+	defer ns.Close()
+	return h.Handle.LinkSetNsFd(link, int(ns))
+}
+
+func (h *nlHandle) WaitForLink(mac string, timeout time.Duration, up bool) (netlink.Link, error) {
+	ch := make(chan netlink.LinkUpdate)
+	done := make(chan struct{})
+	if err := netlink.LinkSubscribeAt(h.ns, ch, done); err != nil {
+		return nil, err
+	}
+	defer func() {
+		close(done)
+		// Unblock the subscriber until it notices the socket is closed.
+		go func() {
+			for range ch {
+			}
+		}()
+	}()
+
+	// Subscribe before listing so that the link can't slip through
+	// between the two calls.
+	links, err := h.LinkList()
+	if err != nil {
+		return nil, err
+	}
+	if link := links[mac]; link != nil {
+		if !up || link.Attrs().Flags&net.FlagUp != 0 {
+			return link, nil
+		}
+		if err := h.Handle.LinkSetUp(link); err != nil {
+			return nil, err
+		}
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case u, ok := <-ch:
+			if !ok {
+				return nil, fmt.Errorf("link subscription closed while waiting for nic %s", mac)
+			}
+			if u.Header.Type != syscall.RTM_NEWLINK || !strings.EqualFold(u.Attrs().HardwareAddr.String(), mac) {
+				continue
+			}
+			if !up || u.Attrs().Flags&net.FlagUp != 0 {
+				return u.Link, nil
+			}
+			if err := h.Handle.LinkSetUp(u.Link); err != nil {
+				return nil, err
+			}
+		case <-timer.C:
+			return nil, &LinkTimeoutError{MAC: mac, Timeout: timeout}
+		}
+	}
+}
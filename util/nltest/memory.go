@@ -0,0 +1,420 @@
+package nltest
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	sdktypes "github.com/nicescale/qcsdk/types"
+	"github.com/nicescale/qingcloud-docker-network/util"
+	"github.com/vishvananda/netlink"
+)
+
+var _ util.Netlink = (*Memory)(nil)
+
+// Memory is a util.Netlink that keeps the links, addresses, routes and
+// rules of a network namespace in memory. Unlike Harness it needs no
+// privileges, but nothing reaches the kernel.
+// The zero value is not usable, create one with NewMemory.
+type Memory struct {
+	mu     sync.Mutex
+	index  int
+	links  map[string]*netlink.Dummy // By hardware address.
+	addrs  map[int][]netlink.Addr    // By link index.
+	routes []netlink.Route
+	rules  []netlink.Rule
+	moved  map[string]string  // Hardware address to network namespace path.
+	peers  map[string]*Memory // By network namespace path.
+	errs   map[string][]error
+}
+
+// NewMemory creates an empty network namespace.
+func NewMemory() *Memory {
+	return &Memory{
+		links: make(map[string]*netlink.Dummy),
+		addrs: make(map[int][]netlink.Addr),
+		moved: make(map[string]string),
+		peers: make(map[string]*Memory),
+		errs:  make(map[string][]error),
+	}
+}
+
+// Connect makes the links moved by LinkSetNs to the network namespace at
+// path show up in ns, down and without addresses like the kernel moves
+// them between namespaces.
+func (m *Memory) Connect(path string, ns *Memory) {
+	m.mu.Lock()
+	m.peers[path] = ns
+	m.mu.Unlock()
+}
+
+// InjectError makes the next call of the method, e.g. "RenameLink", fail
+// with err. Errors injected for the same method are returned in order.
+func (m *Memory) InjectError(method string, err error) {
+	m.mu.Lock()
+	m.errs[method] = append(m.errs[method], err)
+	m.mu.Unlock()
+}
+
+// call returns the error injected for the method, if any.
+// It must be called with the lock held.
+func (m *Memory) call(method string) error {
+	errs := m.errs[method]
+	if len(errs) == 0 {
+		return nil
+	}
+	m.errs[method] = errs[1:]
+	return errs[0]
+}
+
+// AddLink creates a link with the hardware address mac, named after mac
+// like the link of an idle nic. The link is down like a hot-plugged nic.
+func (m *Memory) AddLink(mac string) (netlink.Link, error) {
+	hw, err := net.ParseMAC(mac)
+	if err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.links[hw.String()] != nil {
+		return nil, fmt.Errorf("link %s already exists", mac)
+	}
+	m.index++
+	link := &netlink.Dummy{LinkAttrs: netlink.LinkAttrs{
+		Index:        m.index,
+		Name:         util.CanonicalNicName(mac),
+		HardwareAddr: hw,
+		MTU:          1500,
+		TxQLen:       1000,
+	}}
+	m.links[hw.String()] = link
+	return copyLink(link), nil
+}
+
+// DelLink deletes the link with the hardware address mac if it exists.
+func (m *Memory) DelLink(mac string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if link := m.links[mac]; link != nil {
+		delete(m.addrs, link.Index)
+		delete(m.links, mac)
+	}
+	delete(m.moved, mac)
+}
+
+// Link returns a copy of the link with the hardware address mac, or nil if
+// it's not in the namespace.
+func (m *Memory) Link(mac string) netlink.Link {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if link := m.links[mac]; link != nil {
+		return copyLink(link)
+	}
+	return nil
+}
+
+// Moved returns the network namespace that the link with the hardware
+// address mac was moved to by LinkSetNs, or "".
+func (m *Memory) Moved(mac string) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.moved[mac]
+}
+
+// Rules returns the rules in the namespace.
+func (m *Memory) Rules() []netlink.Rule {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]netlink.Rule(nil), m.rules...)
+}
+
+// AttachHook returns a function suitable for fake.Cloud.OnAttach that
+// hot-plugs a link for each attached nic.
+func (m *Memory) AttachHook() func(*sdktypes.Nic) {
+	return func(nic *sdktypes.Nic) {
+		m.AddLink(nic.ID)
+	}
+}
+
+// DetachHook returns a function suitable for fake.Cloud.OnDetach that
+// removes the link of each detached nic.
+func (m *Memory) DetachHook() func(*sdktypes.Nic) {
+	return func(nic *sdktypes.Nic) {
+		m.DelLink(nic.ID)
+	}
+}
+
+// get returns the stored link of link.
+// It must be called with the lock held.
+func (m *Memory) get(link netlink.Link) (*netlink.Dummy, error) {
+	l := m.links[link.Attrs().HardwareAddr.String()]
+	if l == nil {
+		return nil, fmt.Errorf("link %s not found", link.Attrs().Name)
+	}
+	return l, nil
+}
+
+// update applies f to the stored link of link and copies its attributes
+// back to link.
+func (m *Memory) update(method string, link netlink.Link, f func(l *netlink.Dummy)) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.call(method); err != nil {
+		return err
+	}
+	l, err := m.get(link)
+	if err != nil {
+		return err
+	}
+	f(l)
+	*link.Attrs() = l.LinkAttrs
+	return nil
+}
+
+func (m *Memory) LinkList() (map[string]netlink.Link, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.call("LinkList"); err != nil {
+		return nil, err
+	}
+	links := make(map[string]netlink.Link, len(m.links))
+	for mac, l := range m.links {
+		links[mac] = copyLink(l)
+	}
+	return links, nil
+}
+
+func (m *Memory) LinkByName(name string) (netlink.Link, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.call("LinkByName"); err != nil {
+		return nil, err
+	}
+	for _, l := range m.links {
+		if l.Name == name {
+			return copyLink(l), nil
+		}
+	}
+	return nil, fmt.Errorf("link %s not found", name)
+}
+
+func (m *Memory) RenameLink(link netlink.Link, name string) error {
+	return m.update("RenameLink", link, func(l *netlink.Dummy) {
+		l.Flags &^= net.FlagUp
+		l.Name = name
+	})
+}
+
+func (m *Memory) LinkSetUp(link netlink.Link) error {
+	return m.update("LinkSetUp", link, func(l *netlink.Dummy) { l.Flags |= net.FlagUp })
+}
+
+func (m *Memory) LinkSetDown(link netlink.Link) error {
+	return m.update("LinkSetDown", link, func(l *netlink.Dummy) { l.Flags &^= net.FlagUp })
+}
+
+func (m *Memory) LinkSetMTU(link netlink.Link, mtu int) error {
+	return m.update("LinkSetMTU", link, func(l *netlink.Dummy) { l.MTU = mtu })
+}
+
+func (m *Memory) LinkSetTxQLen(link netlink.Link, qlen int) error {
+	return m.update("LinkSetTxQLen", link, func(l *netlink.Dummy) { l.TxQLen = qlen })
+}
+
+func (m *Memory) LinkSetNs(link netlink.Link, path string) error {
+	m.mu.Lock()
+	if err := m.call("LinkSetNs"); err != nil {
+		m.mu.Unlock()
+		return err
+	}
+	l, err := m.get(link)
+	if err != nil {
+		m.mu.Unlock()
+		return err
+	}
+	mac := l.HardwareAddr.String()
+	delete(m.addrs, l.Index)
+	delete(m.links, mac)
+	m.moved[mac] = path
+	peer := m.peers[path]
+	m.mu.Unlock()
+
+	if peer != nil {
+		peer.insert(l)
+	}
+	return nil
+}
+
+// insert adds a link moved from another namespace.
+func (m *Memory) insert(l *netlink.Dummy) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.index++
+	l.Index = m.index
+	l.Flags &^= net.FlagUp
+	mac := l.HardwareAddr.String()
+	m.links[mac] = l
+	delete(m.moved, mac)
+}
+
+func (m *Memory) AddrAdd(link netlink.Link, addr *netlink.Addr) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.call("AddrAdd"); err != nil {
+		return err
+	}
+	l, err := m.get(link)
+	if err != nil {
+		return err
+	}
+	m.addrs[l.Index] = append(m.addrs[l.Index], *addr)
+	return nil
+}
+
+func (m *Memory) AddrDel(link netlink.Link, addr *netlink.Addr) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.call("AddrDel"); err != nil {
+		return err
+	}
+	l, err := m.get(link)
+	if err != nil {
+		return err
+	}
+	addrs := m.addrs[l.Index]
+	for i, a := range addrs {
+		if a.IPNet.String() == addr.IPNet.String() {
+			m.addrs[l.Index] = append(addrs[:i:i], addrs[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("address %s not found on link %s", addr.IPNet, l.Name)
+}
+
+func (m *Memory) AddrList(link netlink.Link, family int) ([]netlink.Addr, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.call("AddrList"); err != nil {
+		return nil, err
+	}
+	l, err := m.get(link)
+	if err != nil {
+		return nil, err
+	}
+	var addrs []netlink.Addr
+	for _, a := range m.addrs[l.Index] {
+		if family == netlink.FAMILY_ALL || family == netlink.FAMILY_V4 && a.IP.To4() != nil ||
+			family == netlink.FAMILY_V6 && a.IP.To4() == nil {
+			addrs = append(addrs, a)
+		}
+	}
+	return addrs, nil
+}
+
+func (m *Memory) RouteAdd(route *netlink.Route) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.call("RouteAdd"); err != nil {
+		return err
+	}
+	m.routes = append(m.routes, *route)
+	return nil
+}
+
+func (m *Memory) RouteDel(route *netlink.Route) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.call("RouteDel"); err != nil {
+		return err
+	}
+	for i, r := range m.routes {
+		if r.Table == route.Table && r.LinkIndex == route.LinkIndex && r.Dst.String() == route.Dst.String() {
+			m.routes = append(m.routes[:i:i], m.routes[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("route not found")
+}
+
+func (m *Memory) RouteListFiltered(family int, filter *netlink.Route, filterMask uint64) ([]netlink.Route, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.call("RouteListFiltered"); err != nil {
+		return nil, err
+	}
+	var routes []netlink.Route
+	for _, r := range m.routes {
+		if filter != nil && filterMask&netlink.RT_FILTER_TABLE != 0 && r.Table != filter.Table ||
+			filter != nil && filterMask&netlink.RT_FILTER_OIF != 0 && r.LinkIndex != filter.LinkIndex {
+			continue
+		}
+		routes = append(routes, r)
+	}
+	return routes, nil
+}
+
+func (m *Memory) RuleAdd(rule *netlink.Rule) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.call("RuleAdd"); err != nil {
+		return err
+	}
+	m.rules = append(m.rules, *rule)
+	return nil
+}
+
+func (m *Memory) RuleDel(rule *netlink.Rule) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.call("RuleDel"); err != nil {
+		return err
+	}
+	for i, r := range m.rules {
+		if r.Table == rule.Table && r.Priority == rule.Priority && r.Src.String() == rule.Src.String() {
+			m.rules = append(m.rules[:i:i], m.rules[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("rule not found")
+}
+
+func (m *Memory) RuleList(family int) ([]netlink.Rule, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.call("RuleList"); err != nil {
+		return nil, err
+	}
+	return append([]netlink.Rule(nil), m.rules...), nil
+}
+
+// WaitForLink polls for the link like util.Netlink waits for its update.
+func (m *Memory) WaitForLink(mac string, timeout time.Duration, up bool) (netlink.Link, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		m.mu.Lock()
+		if err := m.call("WaitForLink"); err != nil {
+			m.mu.Unlock()
+			return nil, err
+		}
+		if l := m.links[mac]; l != nil {
+			if up {
+				l.Flags |= net.FlagUp
+			}
+			link := copyLink(l)
+			m.mu.Unlock()
+			return link, nil
+		}
+		m.mu.Unlock()
+
+		if !time.Now().Before(deadline) {
+			return nil, &util.LinkTimeoutError{MAC: mac, Timeout: timeout}
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func copyLink(l *netlink.Dummy) netlink.Link {
+	c := *l
+	return &c
+}
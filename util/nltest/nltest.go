@@ -0,0 +1,169 @@
+// Package nltest creates dummy links with chosen hardware addresses in a
+// private network namespace, so that the link handling of the drivers can
+// be exercised in integration tests without qingcloud nics.
+//
+// Creating a network namespace requires CAP_SYS_ADMIN and CAP_NET_ADMIN.
+// Unprivileged users can run the tests under `unshare -rn`. Tests that use
+// NewForTest are skipped without the capabilities.
+package nltest
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+
+	sdktypes "github.com/nicescale/qcsdk/types"
+	"github.com/nicescale/qingcloud-docker-network/util"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+)
+
+// Harness owns a private network namespace.
+type Harness struct {
+	// NS is the private network namespace.
+	NS netns.NsHandle
+	// Netlink operates in NS. Pass it to the drivers under test.
+	Netlink util.Netlink
+
+	handle *netlink.Handle
+}
+
+// New creates a private network namespace without changing the namespace
+// of the calling thread.
+func New() (*Harness, error) {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	orig, err := netns.Get()
+	if err != nil {
+		return nil, err
+	}
+	defer orig.Close()
+
+	ns, err := netns.New()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create network namespace: %v", err)
+	}
+	if err := netns.Set(orig); err != nil {
+		ns.Close()
+		return nil, fmt.Errorf("failed to restore network namespace: %v", err)
+	}
+
+	h := &Harness{NS: ns}
+	if h.handle, err = netlink.NewHandleAt(ns); err != nil {
+		ns.Close()
+		return nil, err
+	}
+	if h.Netlink, err = util.NewNetlinkAt(ns); err != nil {
+		h.Close()
+		return nil, err
+	}
+	return h, nil
+}
+
+// NewForTest creates a Harness for t, or skips t if the process lacks
+// CAP_NET_ADMIN or the kernel can't create dummy links.
+// The harness must be closed by the test.
+func NewForTest(t testing.TB) *Harness {
+	if !hasCapNetAdmin() {
+		t.Skip("CAP_NET_ADMIN is required, run the tests as root or under `unshare -rn`")
+	}
+	h, err := New()
+	if err != nil {
+		t.Skipf("Failed to create a network namespace: %v", err)
+	}
+	// Probe with a locally administered address, which nics never have.
+	const probe = "02:00:00:00:00:01"
+	if _, err := h.AddLink(probe); err != nil {
+		h.Close()
+		t.Skipf("Dummy links are not supported: %v", err)
+	}
+	if err := h.DelLink(probe); err != nil {
+		h.Close()
+		t.Fatal(err)
+	}
+	return h
+}
+
+// capNetAdmin is the bit of CAP_NET_ADMIN in the capability sets.
+const capNetAdmin = 12
+
+// hasCapNetAdmin reports whether CAP_NET_ADMIN is in the effective
+// capabilities of the process.
+func hasCapNetAdmin() bool {
+	f, err := os.Open("/proc/self/status")
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		if !strings.HasPrefix(s.Text(), "CapEff:") {
+			continue
+		}
+		caps, err := strconv.ParseUint(strings.TrimSpace(strings.TrimPrefix(s.Text(), "CapEff:")), 16, 64)
+		return err == nil && caps&(1<<capNetAdmin) != 0
+	}
+	return false
+}
+
+// AddLink creates a dummy link with the hardware address mac.
+// The link is named after mac like the link of an idle nic.
+func (h *Harness) AddLink(mac string) (netlink.Link, error) {
+	hw, err := net.ParseMAC(mac)
+	if err != nil {
+		return nil, err
+	}
+
+	link := &netlink.Dummy{
+		LinkAttrs: netlink.LinkAttrs{
+			Name:         util.CanonicalNicName(mac),
+			HardwareAddr: hw,
+		},
+	}
+	if err := h.handle.LinkAdd(link); err != nil {
+		return nil, fmt.Errorf("failed to add dummy link %s: %v", mac, err)
+	}
+	return h.handle.LinkByName(link.Name)
+}
+
+// DelLink deletes the link with the hardware address mac if it exists.
+func (h *Harness) DelLink(mac string) error {
+	links, err := h.Netlink.LinkList()
+	if err != nil {
+		return err
+	}
+	if link := links[mac]; link != nil {
+		return h.handle.LinkDel(link)
+	}
+	return nil
+}
+
+// AttachHook returns a function suitable for fake.Cloud.OnAttach that
+// hot-plugs a dummy link for each attached nic.
+func (h *Harness) AttachHook() func(*sdktypes.Nic) {
+	return func(nic *sdktypes.Nic) {
+		h.AddLink(nic.ID)
+	}
+}
+
+// DetachHook returns a function suitable for fake.Cloud.OnDetach that
+// removes the dummy link of each detached nic.
+func (h *Harness) DetachHook() func(*sdktypes.Nic) {
+	return func(nic *sdktypes.Nic) {
+		h.DelLink(nic.ID)
+	}
+}
+
+// Close deletes the network namespace together with its links.
+func (h *Harness) Close() error {
+	if h.handle != nil {
+		h.handle.Delete()
+	}
+	return h.NS.Close()
+}
@@ -0,0 +1,324 @@
+package util
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// Reservation records a nic that the IPAM driver attached for an address.
+// The network driver claims it when the endpoint of the address is created,
+// and the reservation is removed when the address is released.
+type Reservation struct {
+	PoolID  string
+	Address string
+	NicID   string
+	Created time.Time
+
+	// AddressIPv6 is the IPv6 address of the nic on a dual-stack vxnet.
+	// IPv6Assigned is set once it's handed out by the IPv6 pool.
+	AddressIPv6  string `json:",omitempty"`
+	IPv6Assigned bool   `json:",omitempty"`
+
+	// EndpointID is set once the reservation is claimed.
+	EndpointID string `json:",omitempty"`
+}
+
+// ErrReserved is returned by ReservationStore.Add if the nic is already
+// reserved for another address or endpoint.
+var ErrReserved = fmt.Errorf("nic is already reserved")
+
+// ReservationStore persists reservations in the data dir so that the
+// handoff between the IPAM and network drivers survives plugin restarts.
+// The store may be shared by several processes, e.g. the docker plugin and
+// the CNI plugin, which exclude each other with a lock file.
+type ReservationStore struct {
+	root string
+	ttl  time.Duration
+	mu   sync.Mutex
+}
+
+// NewReservationStore creates a store under root.
+// Reservations not claimed within ttl are removed by GC.
+func NewReservationStore(root string, ttl time.Duration) *ReservationStore {
+	return &ReservationStore{
+		root: root,
+		ttl:  ttl,
+	}
+}
+
+func (s *ReservationStore) dir() string {
+	return filepath.Join(s.root, "reservations")
+}
+
+func (s *ReservationStore) path(poolID, address string) string {
+	return filepath.Join(s.dir(), poolID+"_"+address+".json")
+}
+
+// lock locks the store against the other goroutines and processes.
+// The returned function releases the lock.
+func (s *ReservationStore) lock() (func(), error) {
+	s.mu.Lock()
+	if err := os.MkdirAll(s.dir(), 0700); err != nil {
+		s.mu.Unlock()
+		return nil, err
+	}
+	f, err := os.OpenFile(filepath.Join(s.dir(), ".lock"), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		s.mu.Unlock()
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		s.mu.Unlock()
+		return nil, fmt.Errorf("failed to lock the reservation store: %v", err)
+	}
+	return func() {
+		// Closing the file releases the flock.
+		f.Close()
+		s.mu.Unlock()
+	}, nil
+}
+
+// live reports whether r is claimed or not yet expired.
+func (s *ReservationStore) live(r *Reservation) bool {
+	return r.EndpointID != "" || time.Since(r.Created) < s.ttl
+}
+
+// Add saves r, replacing any expired reservation for the same pool and
+// address. ErrReserved is returned if the nic of r is already reserved.
+func (s *ReservationStore) Add(r *Reservation) error {
+	if r.Created.IsZero() {
+		r.Created = time.Now()
+	}
+
+	unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	rs, err := s.list()
+	if err != nil {
+		return err
+	}
+	for _, o := range rs {
+		if o.NicID == r.NicID && s.live(o) {
+			return ErrReserved
+		}
+	}
+	return WriteJSON(filepath.Join(s.root, "tmp"), s.path(r.PoolID, r.Address), r)
+}
+
+// Claim marks the reservation of address in the pool as used by the endpoint.
+func (s *ReservationStore) Claim(poolID, address, endpointID string) (*Reservation, error) {
+	unlock, err := s.lock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	path := s.path(poolID, address)
+	r := &Reservation{}
+	if err := ReadJSON(path, r); err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("no nic is reserved for %s in pool %s", address, poolID)
+		}
+		return nil, err
+	}
+	if r.EndpointID != "" && r.EndpointID != endpointID {
+		return nil, fmt.Errorf("nic %s of %s is already used by endpoint %s", r.NicID, address, r.EndpointID)
+	}
+
+	r.EndpointID = endpointID
+	if err := WriteJSON(filepath.Join(s.root, "tmp"), path, r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Unclaim reverts Claim for an endpoint that failed to be created. The
+// reservation is renewed so that it lives until docker releases the address.
+func (s *ReservationStore) Unclaim(poolID, address, endpointID string) error {
+	unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	path := s.path(poolID, address)
+	r := &Reservation{}
+	if err := ReadJSON(path, r); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if r.EndpointID != endpointID {
+		return nil
+	}
+	r.EndpointID = ""
+	r.Created = time.Now()
+	return WriteJSON(filepath.Join(s.root, "tmp"), path, r)
+}
+
+// AssignIPv6 hands out the IPv6 address of a nic reserved in any of the
+// pools. Docker requests the IPv6 address of an endpoint right after its
+// IPv4 address, so the oldest unclaimed reservation whose IPv6 address
+// isn't assigned yet is used. If address is not empty the reservation with
+// that IPv6 address is used instead.
+func (s *ReservationStore) AssignIPv6(poolIDs []string, address string) (*Reservation, error) {
+	unlock, err := s.lock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	rs, err := s.list()
+	if err != nil {
+		return nil, err
+	}
+	pools := make(map[string]bool, len(poolIDs))
+	for _, id := range poolIDs {
+		pools[id] = true
+	}
+	var found *Reservation
+	for _, r := range rs {
+		if !pools[r.PoolID] || r.EndpointID != "" || r.AddressIPv6 == "" || !s.live(r) {
+			continue
+		}
+		if address != "" && r.AddressIPv6 != address || address == "" && r.IPv6Assigned {
+			continue
+		}
+		if found == nil || r.Created.Before(found.Created) {
+			found = r
+		}
+	}
+	if found == nil && address != "" {
+		return nil, fmt.Errorf("no nic with IPv6 address %s is reserved in pool %s. Request the IPv4 address of the nic as well",
+			address, strings.Join(poolIDs, ","))
+	}
+	if found == nil {
+		return nil, fmt.Errorf("no nic with an IPv6 address is reserved in pool %s", strings.Join(poolIDs, ","))
+	}
+
+	found.IPv6Assigned = true
+	if err := WriteJSON(filepath.Join(s.root, "tmp"), s.path(found.PoolID, found.Address), found); err != nil {
+		return nil, err
+	}
+	return found, nil
+}
+
+// Remove deletes the reservation of address in the pool if there is one.
+func (s *ReservationStore) Remove(poolID, address string) error {
+	unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	err = os.Remove(s.path(poolID, address))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// List returns all the reservations, including the expired ones.
+func (s *ReservationStore) List() ([]*Reservation, error) {
+	unlock, err := s.lock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	return s.list()
+}
+
+func (s *ReservationStore) list() ([]*Reservation, error) {
+	files, err := filepath.Glob(filepath.Join(s.dir(), "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	var rs []*Reservation
+	for _, f := range files {
+		r := &Reservation{}
+		if err := ReadJSON(f, r); err != nil {
+			logrus.Warnf("Failed to read reservation file %s: %v", f, err)
+			continue
+		}
+		rs = append(rs, r)
+	}
+	return rs, nil
+}
+
+// Reserved returns the IDs of the nics that are claimed or reserved and
+// not expired.
+func (s *ReservationStore) Reserved() (map[string]bool, error) {
+	rs, err := s.List()
+	if err != nil {
+		return nil, err
+	}
+
+	m := make(map[string]bool, len(rs))
+	for _, r := range rs {
+		if s.live(r) {
+			m[r.NicID] = true
+		}
+	}
+	return m, nil
+}
+
+// GC removes the reservations that were not claimed within the TTL.
+// The nics of the removed reservations stay attached and become idle.
+func (s *ReservationStore) GC() ([]*Reservation, error) {
+	unlock, err := s.lock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	rs, err := s.list()
+	if err != nil {
+		return nil, err
+	}
+
+	var expired []*Reservation
+	for _, r := range rs {
+		if s.live(r) {
+			continue
+		}
+		if err := os.Remove(s.path(r.PoolID, r.Address)); err != nil && !os.IsNotExist(err) {
+			return expired, err
+		}
+		expired = append(expired, r)
+	}
+	return expired, nil
+}
+
+// RunGC calls GC every interval until stop is closed.
+func (s *ReservationStore) RunGC(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		expired, err := s.GC()
+		if err != nil {
+			logrus.Errorf("Failed to collect expired reservations: %v", err)
+		}
+		for _, r := range expired {
+			logrus.Warnf("Reservation of nic %s for %s in pool %s expired", r.NicID, r.Address, r.PoolID)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package util
+
+import (
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// OptStickyID is the endpoint option that names the logical identity of a
+// container. The nic and address used by the identity are recorded and
+// held for it after the container is removed, until the binding expires.
+const OptStickyID = "sticky_id"
+
+// StickyBinding records the nic last used by a logical container identity.
+type StickyBinding struct {
+	ID      string
+	Vxnet   string
+	NicID   string
+	Address string
+	Updated time.Time
+	// Released is when the nic was last released, or zero while the
+	// identity uses it.
+	Released time.Time
+}
+
+// StickyStore persists the sticky bindings in the data dir.
+// A bound nic is never handed out to other identities unless its address is
+// explicitly requested, and it stays attached to the instance when released
+// until the binding expires. See Expire.
+type StickyStore struct {
+	root string
+	mu   sync.Mutex
+}
+
+// NewStickyStore creates a store under root.
+func NewStickyStore(root string) *StickyStore {
+	return &StickyStore{root: root}
+}
+
+func (s *StickyStore) dir() string {
+	return filepath.Join(s.root, "sticky")
+}
+
+func (s *StickyStore) path(id string) string {
+	// IDs like namespace/name must not escape the directory.
+	return filepath.Join(s.dir(), url.QueryEscape(id)+".json")
+}
+
+// Get returns the binding of the identity, or nil if there is none.
+func (s *StickyStore) Get(id string) (*StickyBinding, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b := &StickyBinding{}
+	if err := ReadJSON(s.path(id), b); err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return b, nil
+}
+
+// Set saves b, replacing the previous binding of the identity.
+func (s *StickyStore) Set(b *StickyBinding) error {
+	b.Updated = time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return WriteJSON(filepath.Join(s.root, "tmp"), s.path(b.ID), b)
+}
+
+// Remove deletes the binding of the identity if there is one.
+func (s *StickyStore) Remove(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := os.Remove(s.path(id))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// List returns all the bindings.
+func (s *StickyStore) List() ([]*StickyBinding, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.list()
+}
+
+func (s *StickyStore) list() ([]*StickyBinding, error) {
+	files, err := filepath.Glob(filepath.Join(s.dir(), "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	var bs []*StickyBinding
+	for _, f := range files {
+		b := &StickyBinding{}
+		if err := ReadJSON(f, b); err != nil {
+			logrus.Warnf("Failed to read sticky binding file %s: %v", f, err)
+			continue
+		}
+		bs = append(bs, b)
+	}
+	return bs, nil
+}
+
+// Held returns the IDs of the bound nics.
+func (s *StickyStore) Held() (map[string]bool, error) {
+	bs, err := s.List()
+	if err != nil {
+		return nil, err
+	}
+	m := make(map[string]bool, len(bs))
+	for _, b := range bs {
+		m[b.NicID] = true
+	}
+	return m, nil
+}
+
+// MarkReleased records that the nic of a binding has been released, which
+// starts the expiry of the binding.
+func (s *StickyStore) MarkReleased(nicID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	bs, err := s.list()
+	if err != nil {
+		return err
+	}
+	for _, b := range bs {
+		if b.NicID != nicID {
+			continue
+		}
+		b.Released = time.Now()
+		if err := WriteJSON(filepath.Join(s.root, "tmp"), s.path(b.ID), b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Expire removes the bindings to the nics of the vxnet that were released
+// more than ttl ago and returns them.
+func (s *StickyStore) Expire(vxnet string, ttl time.Duration) ([]*StickyBinding, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	bs, err := s.list()
+	if err != nil {
+		return nil, err
+	}
+	var expired []*StickyBinding
+	for _, b := range bs {
+		if b.Vxnet != vxnet || b.Released.IsZero() || time.Since(b.Released) < ttl {
+			continue
+		}
+		if err := os.Remove(s.path(b.ID)); err != nil && !os.IsNotExist(err) {
+			return expired, err
+		}
+		expired = append(expired, b)
+	}
+	return expired, nil
+}
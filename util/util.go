@@ -5,37 +5,35 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strings"
 
-	"github.com/vishvananda/netlink"
+	sdktypes "github.com/nicescale/qcsdk/types"
 )
 
 var (
 	InstanceID string
-	NlHandle   *netlink.Handle
 )
 
-func Init() {
-	id, err := ioutil.ReadFile("/etc/qingcloud/instance-id")
-	if err != nil {
-		id, err = ioutil.ReadFile("/proc/sys/kernel/hostname")
-	}
-	if err != nil {
-		msg := fmt.Sprintf("can't find instance ID from /etc/qingcloud/instance-id: %v", err)
-		panic(msg)
+// Init sets InstanceID. If id is empty the ID of the qingcloud VM that the
+// process runs in is used.
+func Init(id string) error {
+	if id == "" {
+		data, err := ioutil.ReadFile("/etc/qingcloud/instance-id")
+		if err != nil {
+			data, err = ioutil.ReadFile("/proc/sys/kernel/hostname")
+		}
+		if err != nil {
+			return fmt.Errorf("can't find instance ID from /etc/qingcloud/instance-id: %v", err)
+		}
+		id = strings.TrimSpace(string(data))
 	}
 
 	if len(id) < 10 || id[0] != 'i' || id[1] != '-' {
-		msg := fmt.Sprintf("invalid instance id %s. Are you running in a qingcloud VM?", string(id))
-		panic(msg)
-	}
-	InstanceID = strings.TrimSpace(string(id))
-
-	NlHandle, err = netlink.NewHandle()
-	if err != nil {
-		msg := fmt.Sprintf("failed to create netlink handle: %v", err)
-		panic(msg)
+		return fmt.Errorf("invalid instance id %s. Are you running in a qingcloud VM?", id)
 	}
+	InstanceID = id
+	return nil
 }
 
 func ReadJSON(path string, data interface{}) error {
@@ -48,21 +46,48 @@ func ReadJSON(path string, data interface{}) error {
 	return json.NewDecoder(fp).Decode(data)
 }
 
-func LinkList() (map[string]netlink.Link, error) {
-	links, err := NlHandle.LinkList()
-	if err != nil {
-		return nil, err
+// WriteJSON atomically replaces the file at path with the JSON encoding of data.
+// The temporary file is created in tmpDir which must be on the same filesystem.
+func WriteJSON(tmpDir, path string, data interface{}) error {
+	if err := os.MkdirAll(tmpDir, 0700); err != nil {
+		return err
 	}
-	m := make(map[string]netlink.Link)
-	for _, n := range links {
-		m[n.Attrs().HardwareAddr.String()] = n
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
 	}
-	return m, nil
-}
 
-func RenameLink(link netlink.Link, name string) error {
-	if err := NlHandle.LinkSetDown(link); err != nil {
+	tmp, err := ioutil.TempFile(tmpDir, "")
+	if err != nil {
 		return err
 	}
-	return NlHandle.LinkSetName(link, name)
+	err = json.NewEncoder(tmp).Encode(data)
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	tmp.Sync()
+	tmp.Close()
+	return os.Rename(tmp.Name(), path)
+}
+
+// CanonicalNicName returns the name of the link of an idle nic.
+// The name is derived from the MAC address so that it's unique on the host.
+func CanonicalNicName(mac string) string {
+	return "qc" + strings.Replace(strings.ToLower(mac), ":", "", -1)
+}
+
+const (
+	// NicName is the name of the nics created by the plugin.
+	NicName = "qingcloud-docker-network"
+	// LeasePrefix starts the leases that the IPAM driver publishes as the
+	// names of the nics of the plugin. See ipam.lease.
+	LeasePrefix = "qdn"
+)
+
+// PluginNic reports whether the nic belongs to the plugin by its name,
+// i.e. it was created by the plugin or carries a lease of the plugin.
+func PluginNic(nic *sdktypes.Nic) bool {
+	return nic.NicName == NicName || strings.HasPrefix(nic.NicName, LeasePrefix+"|")
 }
@@ -0,0 +1,124 @@
+package util
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/nicescale/qcsdk"
+	sdktypes "github.com/nicescale/qcsdk/types"
+	"github.com/nicescale/qingcloud-docker-network/cloud"
+)
+
+// OptAllowSubnetMismatch is the network and IPAM option that disables the
+// subnet and gateway check against the vxnet router.
+const OptAllowSubnetMismatch = "allow_subnet_mismatch"
+
+// SplitVxnets splits the comma separated vxnet option of a network.
+// Empty entries are ignored.
+func SplitVxnets(s string) []string {
+	var vxnets []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			vxnets = append(vxnets, v)
+		}
+	}
+	return vxnets
+}
+
+// DescribeVxnet returns the vxnet with the specified ID.
+// An error is returned if the vxnet doesn't exist in the zone of api
+// or if it isn't joined to a router.
+func DescribeVxnet(api cloud.API, id string) (*sdktypes.Vxnet, error) {
+	vxnets, err := api.DescribeVxnets(qcsdk.Params{"vxnets": id})
+	if err != nil {
+		return nil, err
+	}
+	if len(vxnets) == 0 {
+		return nil, fmt.Errorf("vxnet %s not found in the current zone", id)
+	}
+
+	vxnet := vxnets[0]
+	if vxnet.Router.ID == "" || vxnet.Router.IPNetwork.IP == nil {
+		return nil, fmt.Errorf("vxnet %s is not joined to a router", id)
+	}
+	return vxnet, nil
+}
+
+// CheckVxnetNetwork verifies that subnet and gateway match the network
+// parameters of the router that the vxnet is joined to.
+// Both subnet and gateway are optional and may be in CIDR notation.
+func CheckVxnetNetwork(vxnet *sdktypes.Vxnet, subnet, gateway string) error {
+	router := vxnet.Router
+	if subnet != "" {
+		_, ipnet, err := net.ParseCIDR(subnet)
+		if err != nil {
+			return fmt.Errorf("invalid subnet %s: %v", subnet, err)
+		}
+		if ipnet.String() != router.IPNetwork.String() {
+			return fmt.Errorf("subnet %s doesn't match the network %s of vxnet %s on router %s",
+				subnet, router.IPNetwork.String(), vxnet.ID, router.ID)
+		}
+	}
+
+	if gateway != "" {
+		gw := net.ParseIP(strings.Split(gateway, "/")[0])
+		if gw == nil {
+			return fmt.Errorf("invalid gateway %s", gateway)
+		}
+		if !gw.Equal(router.ManagerIP) {
+			return fmt.Errorf("gateway %s doesn't match the manager IP %s of router %s",
+				gw, router.ManagerIP, router.ID)
+		}
+	}
+	return nil
+}
+
+// VxnetIPv6 returns the IPv6 network of a dual-stack vxnet and its
+// gateway, which is the first address of the network like the manager IP
+// of the router.
+func VxnetIPv6(vxnet *sdktypes.Vxnet) (*net.IPNet, net.IP, error) {
+	ipnet := vxnet.Router.IPv6Network.IPNet
+	if ipnet.IP == nil {
+		return nil, nil, fmt.Errorf("vxnet %s has no IPv6 network", vxnet.ID)
+	}
+	gw := make(net.IP, len(ipnet.IP))
+	copy(gw, ipnet.IP)
+	gw[len(gw)-1]++
+	return &ipnet, gw, nil
+}
+
+// CheckVxnetIPv6 is the IPv6 counterpart of CheckVxnetNetwork.
+func CheckVxnetIPv6(vxnet *sdktypes.Vxnet, subnet, gateway string) error {
+	ipnet, vgw, err := VxnetIPv6(vxnet)
+	if err != nil {
+		return err
+	}
+	if subnet != "" {
+		_, n, err := net.ParseCIDR(subnet)
+		if err != nil {
+			return fmt.Errorf("invalid subnet %s: %v", subnet, err)
+		}
+		if n.String() != ipnet.String() {
+			return fmt.Errorf("subnet %s doesn't match the IPv6 network %s of vxnet %s", subnet, ipnet, vxnet.ID)
+		}
+	}
+	if gateway != "" {
+		gw := net.ParseIP(strings.Split(gateway, "/")[0])
+		if gw == nil {
+			return fmt.Errorf("invalid gateway %s", gateway)
+		}
+		if !gw.Equal(vgw) {
+			return fmt.Errorf("gateway %s doesn't match the IPv6 gateway %s of vxnet %s", gw, vgw, vxnet.ID)
+		}
+	}
+	return nil
+}
+
+// BoolOpt parses the option key of opts as a boolean.
+// A missing or malformed value is treated as false.
+func BoolOpt(opts map[string]string, key string) bool {
+	v, _ := strconv.ParseBool(opts[key])
+	return v
+}